@@ -3,34 +3,26 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/acmavirus/foxdocker-panel"
 	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/acmavirus/foxdocker-panel/internal/nodes"
 	"github.com/acmavirus/foxdocker-panel/internal/security"
 	"github.com/acmavirus/foxdocker-panel/internal/system"
 	"github.com/gin-gonic/gin"
-	"github.com/shirou/gopsutil/v3/cpu"
-	"github.com/shirou/gopsutil/v3/disk"
-	"github.com/shirou/gopsutil/v3/mem"
 )
 
-type SystemStats struct {
-	CPU    float64 `json:"cpu"`
-	RAM    float64 `json:"ram"`
-	Disk   float64 `json:"disk"`
-	Uptime string  `json:"uptime"`
-}
-
 type FirewallRule struct {
 	ID      int    `json:"id"`
 	IP      string `json:"ip"`
@@ -76,29 +68,6 @@ type FirewallConfig struct {
 	Ports   []string `json:"ports"`
 }
 
-var startTime = time.Now()
-
-func getSystemStats() SystemStats {
-	c, _ := cpu.Percent(time.Second, false)
-	vm, _ := mem.VirtualMemory()
-	d, _ := disk.Usage("/")
-
-	cpuVal := 0.0
-	if len(c) > 0 {
-		cpuVal = c[0]
-	}
-
-	uptime := time.Since(startTime)
-	uptimeStr := fmt.Sprintf("%dd %dh %dm", int(uptime.Hours())/24, int(uptime.Hours())%24, int(uptime.Minutes())%60)
-
-	return SystemStats{
-		CPU:    cpuVal,
-		RAM:    vm.UsedPercent,
-		Disk:   d.UsedPercent,
-		Uptime: uptimeStr,
-	}
-}
-
 func getAttackTrend() []AttackTrend {
 	// Real logic: group firewall/blocked logs by hour
 	now := time.Now()
@@ -122,6 +91,18 @@ func getAttackTrend() []AttackTrend {
 }
 
 func main() {
+	// Agent mode: `fox-admin agent --ca ca.crt --cert agent.crt --key agent.key`
+	// serves the same API to a remote panel over mutual TLS, without the UI
+	agentMode := len(os.Args) > 1 && os.Args[1] == "agent"
+	agentFlags := flag.NewFlagSet("agent", flag.ExitOnError)
+	agentListen := agentFlags.String("listen", ":7443", "address the agent listens on")
+	agentCA := agentFlags.String("ca", "data/agent/ca.crt", "panel CA certificate")
+	agentCert := agentFlags.String("cert", "data/agent/agent.crt", "agent certificate")
+	agentKey := agentFlags.String("key", "data/agent/agent.key", "agent private key")
+	if agentMode {
+		agentFlags.Parse(os.Args[2:])
+	}
+
 	// Initialize logging to file
 	os.MkdirAll("data", 0755)
 	logFile, err := os.OpenFile("data/foxdocker.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
@@ -141,6 +122,41 @@ func main() {
 		log.Printf("Warning: Failed to init security: %v", err)
 	}
 
+	// Project templates shipped inside the binary
+	system.BuiltinTemplates = foxdocker.TemplatesDist
+
+	// Background metrics sampler: stats endpoints serve cached readings
+	system.StartMetricsSampler(2*time.Second, 5*time.Second)
+
+	// Docker event watcher: live project status, event history and crash alerts
+	system.StartEventWatcher()
+
+	// Scheduled docker garbage collection (disabled until configured)
+	system.StartGCScheduler()
+
+	// Image update detection and auto-update in maintenance windows
+	system.StartUpdateChecker()
+
+	// Container health monitoring with auto-heal
+	system.StartHealthMonitor()
+
+	// Secret-named variables still written in compose files go to the store,
+	// before resumed jobs read those files
+	system.MigratePlaintextSecrets()
+	system.MigrateGitCredentials()
+
+	// Background job queue: picks up the jobs a restart interrupted
+	system.StartJobQueue()
+
+	// Traefik routes to projects over TraefikNetwork; older installs left
+	// Traefik and the panel off it
+	go system.AttachTraefikNetwork()
+
+	// Remote node heartbeat (panel only)
+	if !agentMode {
+		nodes.StartHeartbeat()
+	}
+
 	r := gin.Default()
 
 	// Auth Middleware (Phase 1)
@@ -188,9 +204,53 @@ func main() {
 		}
 	})
 
+	// Agent Auth: the TLS listener already verified the panel's client
+	// certificate, the panel tells us which user is acting
+	agentAuthMiddleware := func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Client certificate required"})
+			c.Abort()
+			return
+		}
+		user := c.GetHeader(nodes.UserHeader)
+		if user == "" {
+			user = "panel"
+		}
+		c.Set("username", user)
+		c.Next()
+	}
+
+	// Node Selector: ?node=<id|name> forwards node-scoped APIs to that agent
+	nodeProxyMiddleware := func(c *gin.Context) {
+		node := c.Query("node")
+		if node == "" || node == nodes.LocalNode || !nodes.IsNodeScoped(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		if err := nodes.Proxy(node, c.GetString("username"), c.Writer, c.Request); err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		}
+		c.Abort()
+	}
+
+	// Git Push Webhooks: authenticated by the provider signature, not a JWT
+	r.POST("/api/webhooks/:token", func(c *gin.Context) {
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, 10<<20))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		res := system.HandleWebhook(c.Param("token"), c.Request.Header, body)
+		c.JSON(res.Code, res)
+	})
+
 	// API Routes
 	api := r.Group("/api")
-	api.Use(authMiddleware)
+	if agentMode {
+		api.Use(agentAuthMiddleware)
+	} else {
+		api.Use(authMiddleware, nodeProxyMiddleware)
+	}
 	{
 		api.GET("/ping", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{
@@ -200,7 +260,7 @@ func main() {
 		})
 
 		api.GET("/system/stats", func(c *gin.Context) {
-			c.JSON(http.StatusOK, getSystemStats())
+			c.JSON(http.StatusOK, system.GetHostStats())
 		})
 
 		// App Store Endpoints
@@ -220,14 +280,86 @@ func main() {
 				return
 			}
 
-			go func() {
-				err := system.InstallApp(req.App, req.EnvVars)
-				if err != nil {
-					log.Printf("Failed to install app %s: %v", req.App.ID, err)
-				}
-			}()
+			user := c.GetString("username")
+			job, err := system.InstallApp(req.App, req.EnvVars, user)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(user, "Install App", req.App.ID)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Installation queued", "job": job})
+		})
+
+		// Project Templates
+		api.GET("/templates", func(c *gin.Context) {
+			templates, err := system.ListTemplates()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, templates)
+		})
+
+		api.GET("/templates/:id", func(c *gin.Context) {
+			tpl, err := system.GetTemplate(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, tpl)
+		})
+
+		api.POST("/templates", func(c *gin.Context) {
+			var req struct {
+				ID      string `json:"id"`
+				Content string `json:"content"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			tpl, err := system.SaveUserTemplate(req.ID, []byte(req.Content))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Save Template", req.ID)
+			c.JSON(http.StatusOK, tpl)
+		})
+
+		api.DELETE("/templates/:id", func(c *gin.Context) {
+			if err := system.DeleteUserTemplate(c.Param("id")); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Delete Template", c.Param("id"))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
 
-			c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Installation started"})
+		// Preview the compose file a template renders to
+		api.POST("/templates/:id/render", func(c *gin.Context) {
+			var req struct {
+				Name   string            `json:"name"`
+				Params map[string]string `json:"params"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			tpl, err := system.GetTemplate(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			if req.Name == "" {
+				req.Name = "preview"
+			}
+			content, err := tpl.Render(req.Name, req.Params)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"compose": string(content)})
 		})
 
 		// Project Endpoints (Phase 2)
@@ -236,10 +368,15 @@ func main() {
 			projects := []gin.H{}
 			files, _ := os.ReadDir(system.ProjectsRoot)
 			for _, f := range files {
-				if f.IsDir() {
+				if system.IsProjectDir(f) {
+					status := "unknown"
+					var p database.Project
+					if database.DB != nil && database.DB.Where("name = ?", f.Name()).First(&p).Error == nil {
+						status = p.Status
+					}
 					projects = append(projects, gin.H{
 						"name":    f.Name(),
-						"status":  "online", // Needs real docker status check
+						"status":  status, // Kept in sync by the docker event watcher
 						"type":    "Docker",
 						"domains": []string{f.Name() + ".local", "test.dev"},
 					})
@@ -248,183 +385,1258 @@ func main() {
 			c.JSON(http.StatusOK, projects)
 		})
 
-		api.POST("/projects/stop", func(c *gin.Context) {
+		// Create a project from a template, from a compose file pasted as
+		// JSON or uploaded as multipart form (files "compose" and "env"), or
+		// from a source archive uploaded as file "source"
+		api.POST("/projects", func(c *gin.Context) {
 			var req struct {
-				Name string `json:"name"`
+				system.ProjectSpec
+				Template string            `json:"template"`
+				Params   map[string]string `json:"params"`
+				// Set to build and deploy the project from a git repository
+				Git *system.GitSource `json:"git"`
 			}
-			if err := c.ShouldBindJSON(&req); err != nil {
+			if strings.HasPrefix(c.ContentType(), "multipart/") {
+				req.Name = c.PostForm("name")
+				req.Service = c.PostForm("service")
+				req.Port, _ = strconv.Atoi(c.PostForm("port"))
+				for _, d := range strings.Split(c.PostForm("domains"), ",") {
+					if d = strings.TrimSpace(d); d != "" {
+						req.Domains = append(req.Domains, d)
+					}
+				}
+				if fh, err := c.FormFile("source"); err == nil {
+					f, err := fh.Open()
+					if err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+					defer f.Close()
+					job, err := system.CreateUploadProject(req.Name, fh.Filename, f, req.Domains, req.Port, c.GetString("username"))
+					if err != nil {
+						c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+						return
+					}
+					security.LogAction(c.GetString("username"), "Create Project", req.Name+" from uploaded source "+fh.Filename)
+					c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Build started", "job": job})
+					return
+				}
+				for field, dst := range map[string]*string{"compose": &req.Compose, "env": &req.Env} {
+					*dst = c.PostForm(field)
+					if fh, err := c.FormFile(field); err == nil {
+						f, err := fh.Open()
+						if err != nil {
+							c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+							return
+						}
+						data, _ := io.ReadAll(io.LimitReader(f, 1<<20+1))
+						f.Close()
+						*dst = string(data)
+					}
+				}
+			} else if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			cmd := exec.Command("docker", "compose", "stop")
-			cmd.Dir = filepath.Join(system.ProjectsRoot, req.Name)
-			if err := cmd.Run(); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop project"})
+
+			if req.Git != nil {
+				job, err := system.CreateGitProject(req.Name, *req.Git, req.Domains, req.Port, c.GetString("username"))
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				security.LogAction(c.GetString("username"), "Create Project", req.Name+" from a git repository")
+				c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Build started", "job": job})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"status": "success"})
+
+			source := "compose file"
+			if req.Template != "" {
+				if err := system.ValidateNewProjectName(req.Name); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				tpl, err := system.GetTemplate(req.Template)
+				if err != nil {
+					c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+					return
+				}
+				content, err := tpl.Render(req.Name, req.Params)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+				req.Compose = string(content)
+				source = "template " + req.Template
+			}
+
+			job, err := system.CreateProject(req.ProjectSpec, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Create Project", req.Name+" from "+source)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Project creation started", "job": job})
 		})
 
-		api.DELETE("/projects/:name", func(c *gin.Context) {
-			name := c.Param("name")
-			projectDir := filepath.Join(system.ProjectsRoot, name)
-			cmd := exec.Command("docker", "compose", "down", "-v")
-			cmd.Dir = projectDir
-			cmd.Run() // Best effort down
-			os.RemoveAll(projectDir)
-			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		// Jobs (long-running operations started from the panel)
+		api.GET("/jobs", func(c *gin.Context) {
+			limit, _ := strconv.Atoi(c.Query("limit"))
+			c.JSON(http.StatusOK, system.ListJobs(system.JobFilter{
+				Project: c.Query("project"),
+				Status:  c.Query("status"),
+				Type:    c.Query("type"),
+				Limit:   limit,
+			}))
 		})
 
-		// Databases API
-		api.GET("/databases", func(c *gin.Context) {
-			dbs, err := database.ListDatabases()
+		api.GET("/jobs/:id", func(c *gin.Context) {
+			job, err := system.GetJob(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, job)
+		})
+
+		// Live output and progress of a job as server-sent events: line (with
+		// its number as event id, so a client can resume with Last-Event-ID or
+		// ?after=), progress, state, and done with the final job.
+		api.GET("/jobs/:id/stream", func(c *gin.Context) {
+			after, _ := strconv.Atoi(c.GetHeader("Last-Event-ID"))
+			if q := c.Query("after"); q != "" {
+				after, _ = strconv.Atoi(q)
+			}
+			if _, err := system.GetJob(c.Param("id")); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+			c.Header("X-Accel-Buffering", "no")
+
+			system.StreamJob(c.Request.Context(), c.Param("id"), after, func(ev system.JobEvent) {
+				switch ev.Type {
+				case "ping":
+					fmt.Fprint(c.Writer, ": ping\n\n")
+				case "line":
+					fmt.Fprintf(c.Writer, "id: %d\n", ev.Line)
+					c.SSEvent(ev.Type, ev)
+				default:
+					c.SSEvent(ev.Type, ev)
+				}
+				c.Writer.Flush()
+			})
+		})
+
+		api.POST("/jobs/:id/cancel", func(c *gin.Context) {
+			job, err := system.CancelJob(c.Param("id"), c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Cancel Job", job.Type+" "+job.ID)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
+		})
+
+		api.GET("/projects/:name/events", func(c *gin.Context) {
+			events, err := system.GetProjectEvents(c.Param("name"), 100)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, dbs)
+			c.JSON(http.StatusOK, events)
 		})
 
-		api.POST("/databases", func(c *gin.Context) {
+		// Resource Limits
+		api.GET("/projects/:name/resources", func(c *gin.Context) {
+			res, err := system.GetProjectResources(c.Param("name"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, res)
+		})
+
+		api.POST("/projects/:name/resources", func(c *gin.Context) {
 			var req struct {
-				Type     string `json:"type"`
-				Name     string `json:"name"`
-				Password string `json:"password"`
+				Service string `json:"service"`
+				system.ServiceResources
 			}
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			if err := database.CreateDatabase(req.Type, req.Name, req.Password); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			applied, err := system.SetServiceResources(c.Param("name"), req.Service, req.ServiceResources)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"status": "success"})
+			system.RecordProjectChange(c.Param("name"), c.GetString("username"), "Set resource limits of "+req.Service, "docker-compose.yml")
+			security.LogAction(c.GetString("username"), "Set Resource Limits", c.Param("name")+"/"+req.Service)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "applied": applied})
 		})
 
-		// Files API
-		api.GET("/files", func(c *gin.Context) {
-			path := c.Query("path")
-			items, err := system.ListFiles(path)
+		// Deployments and Rollback
+		api.GET("/projects/:name/deployments", func(c *gin.Context) {
+			deployments, err := system.ListDeployments(c.Param("name"), 50)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, items)
+			c.JSON(http.StatusOK, deployments)
 		})
 
-		api.GET("/files/content", func(c *gin.Context) {
-			path := c.Query("path")
-			content, err := system.ReadFileContent(path)
+		api.POST("/projects/:name/deploy", func(c *gin.Context) {
+			job, err := system.DeployProject(c.Param("name"), c.GetString("username"))
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"content": content})
+			security.LogAction(c.GetString("username"), "Deploy Project", c.Param("name"))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
 		})
 
-		api.POST("/files/save", func(c *gin.Context) {
+		api.POST("/projects/:name/rollback", func(c *gin.Context) {
 			var req struct {
-				Path    string `json:"path"`
-				Content string `json:"content"`
+				DeploymentID uint `json:"deployment_id"`
 			}
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			if err := system.SaveFileContent(req.Path, req.Content); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			job, err := system.RollbackProject(c.Param("name"), req.DeploymentID, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Rollback Project", fmt.Sprintf("%s to deployment #%d", c.Param("name"), req.DeploymentID))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
+		})
+
+		// Push-to-deploy Webhook
+		api.GET("/projects/:name/webhook", func(c *gin.Context) {
+			hook, err := system.GetWebhook(c.Param("name"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, hook)
+		})
+
+		api.POST("/projects/:name/webhook", func(c *gin.Context) {
+			req := struct {
+				Branch  string `json:"branch"`
+				Enabled *bool  `json:"enabled"`
+				Rotate  bool   `json:"rotate_secret"`
+			}{}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			enabled := req.Enabled == nil || *req.Enabled
+			hook, err := system.SaveWebhook(c.Param("name"), req.Branch, enabled, req.Rotate)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Save Webhook", c.Param("name"))
+			c.JSON(http.StatusOK, hook)
+		})
+
+		api.DELETE("/projects/:name/webhook", func(c *gin.Context) {
+			if err := system.DeleteWebhook(c.Param("name")); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 				return
 			}
+			security.LogAction(c.GetString("username"), "Delete Webhook", c.Param("name"))
 			c.JSON(http.StatusOK, gin.H{"status": "success"})
 		})
 
-		// Domains API
-		api.GET("/domains", func(c *gin.Context) {
-			// Mock logic: return domains based on Traefik labels
-			c.JSON(http.StatusOK, []gin.H{
-				{"domain": "panel.yourdomain.com", "target": "fox-admin", "status": "active"},
-			})
+		api.GET("/projects/:name/webhook/deliveries", func(c *gin.Context) {
+			deliveries, err := system.ListWebhookDeliveries(c.Param("name"), 100)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, deliveries)
 		})
 
-		// System Utilities API
-		api.POST("/terminal/exec", func(c *gin.Context) {
+		// Staging clones: <name>-staging with copied data, promoted back on confirmation
+		api.POST("/projects/:name/staging", func(c *gin.Context) {
 			var req struct {
-				ContainerID string `json:"containerId"`
-				Command     string `json:"command"`
+				Domain string `json:"domain"`
 			}
-			if err := c.ShouldBindJSON(&req); err != nil {
+			if c.Request.ContentLength > 0 {
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+			job, err := system.CloneToStaging(c.Param("name"), req.Domain, c.GetString("username"))
+			if err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			output, err := system.ExecuteContainerCommand(req.ContainerID, req.Command)
+			security.LogAction(c.GetString("username"), "Clone To Staging", c.Param("name"))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
+		})
+
+		api.GET("/projects/:name/promote", func(c *gin.Context) {
+			plan, err := system.GetPromotePlan(c.Param("name"))
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "output": output})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"output": output})
+			c.JSON(http.StatusOK, plan)
 		})
 
-		api.POST("/backups/create", func(c *gin.Context) {
+		api.POST("/projects/:name/promote", func(c *gin.Context) {
 			var req struct {
-				ProjectID string `json:"projectId"`
+				Confirm string `json:"confirm"` // production project name
 			}
 			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			path, err := system.CreateBackup(req.ProjectID)
+			job, err := system.PromoteStaging(c.Param("name"), req.Confirm, c.GetString("username"))
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"path": path})
+			security.LogAction(c.GetString("username"), "Promote Staging", c.Param("name"))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
 		})
 
-		api.GET("/cron", func(c *gin.Context) {
-			jobs, err := system.GetCronJobs()
+		// Secrets: encrypted environment variables, values never returned
+		api.GET("/projects/:name/secrets", func(c *gin.Context) {
+			secrets, err := system.ListSecrets(c.Param("name"))
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, jobs)
+			c.JSON(http.StatusOK, secrets)
 		})
 
-		api.POST("/cron", func(c *gin.Context) {
-			var jobs []system.CronJob
-			if err := c.ShouldBindJSON(&jobs); err != nil {
+		api.PUT("/projects/:name/secrets/:key", func(c *gin.Context) {
+			var req struct {
+				Value string `json:"value"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			if err := system.SaveCronJobs(jobs); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			if err := system.SetSecret(c.Param("name"), c.Param("key"), req.Value, c.GetString("username")); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			c.JSON(http.StatusOK, gin.H{"status": "success"})
+			security.LogAction(c.GetString("username"), "Set Secret", c.Param("name")+"/"+c.Param("key"))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Secret saved, it applies on the next deploy"})
 		})
 
-		// Notification Settings
-		api.GET("/settings/notifications", func(c *gin.Context) {
-			settings, _ := system.GetNotificationSettings()
-			c.JSON(http.StatusOK, settings)
+		// Rotate: a new value, random when none is given, then a redeploy
+		api.POST("/projects/:name/secrets/:key/rotate", func(c *gin.Context) {
+			var req struct {
+				Value string `json:"value"`
+			}
+			if c.Request.ContentLength > 0 {
+				if err := c.ShouldBindJSON(&req); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+					return
+				}
+			}
+			job, err := system.RotateSecret(c.Param("name"), c.Param("key"), req.Value, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Rotate Secret", c.Param("name")+"/"+c.Param("key"))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
 		})
 
-		api.POST("/settings/notifications", func(c *gin.Context) {
-			var settings system.NotificationSettings
-			if err := c.ShouldBindJSON(&settings); err != nil {
+		api.DELETE("/projects/:name/secrets/:key", func(c *gin.Context) {
+			if err := system.DeleteSecret(c.Param("name"), c.Param("key")); err != nil {
 				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
-			system.SaveNotificationSettings(settings)
+			security.LogAction(c.GetString("username"), "Delete Secret", c.Param("name")+"/"+c.Param("key"))
 			c.JSON(http.StatusOK, gin.H{"status": "success"})
 		})
 
-		// Container Stats
+		// Portable bundles: a project with its data, to move it to another server
+		api.GET("/projects/:name/export", func(c *gin.Context) {
+			started := false
+			err := system.ExportProject(c.Param("name"), c.Writer, func(fileName string) {
+				started = true
+				c.Header("Content-Type", "application/gzip")
+				c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+				c.Status(http.StatusOK)
+			})
+			if err != nil && !started {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			} else if err != nil {
+				log.Printf("Project export interrupted: %v", err)
+				return
+			}
+			security.LogAction(c.GetString("username"), "Export Project", c.Param("name"))
+		})
+
+		// Multipart: file "bundle", optional "name" and "domains" as a JSON
+		// object mapping exported domains to the ones to serve them on
+		api.POST("/projects/import", func(c *gin.Context) {
+			fh, err := c.FormFile("bundle")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "bundle file is required"})
+				return
+			}
+			opts := system.ImportOptions{Name: c.PostForm("name")}
+			if domains := c.PostForm("domains"); domains != "" {
+				if err := json.Unmarshal([]byte(domains), &opts.Domains); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "domains must be a JSON object: " + err.Error()})
+					return
+				}
+			}
+			f, err := fh.Open()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			defer f.Close()
+			result, err := system.ImportProject(f, opts, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Import Project", result.Project+" from "+fh.Filename)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "project": result.Project, "changes": result.Changes, "job": result.Job})
+		})
+
+		// Replace the source of a project built from an uploaded archive and redeploy it
+		api.POST("/projects/:name/source", func(c *gin.Context) {
+			fh, err := c.FormFile("source")
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "source archive is required"})
+				return
+			}
+			f, err := fh.Open()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			defer f.Close()
+			job, err := system.ReplaceUploadSource(c.Param("name"), fh.Filename, f, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Upload Source", c.Param("name")+" from "+fh.Filename)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
+		})
+
+		// Generated Dockerfile of projects built from source without one
+		api.GET("/projects/:name/build-plan", func(c *gin.Context) {
+			plan, err := system.GetBuildPlan(c.Param("name"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, plan)
+		})
+
+		api.POST("/projects/:name/build-plan", func(c *gin.Context) {
+			var req struct {
+				Dockerfile   string `json:"dockerfile"`
+				Dockerignore string `json:"dockerignore"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SaveBuildPlan(c.Param("name"), req.Dockerfile, req.Dockerignore, c.GetString("username")); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Edit Dockerfile", c.Param("name"))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.DELETE("/projects/:name/build-plan", func(c *gin.Context) {
+			if err := system.DeleteBuildPlan(c.Param("name"), c.GetString("username")); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Remove Dockerfile", c.Param("name"))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Revision History (every panel change is a commit in the project's git repository)
+		api.GET("/projects/:name/history", func(c *gin.Context) {
+			limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+			if limit <= 0 || limit > 500 {
+				limit = 50
+			}
+			revisions, err := system.GetProjectHistory(c.Param("name"), c.Query("path"), limit)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, revisions)
+		})
+
+		api.GET("/projects/:name/diff", func(c *gin.Context) {
+			diff, err := system.GetProjectDiff(c.Param("name"), c.Query("from"), c.Query("to"), c.Query("path"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"diff": diff})
+		})
+
+		api.GET("/projects/:name/revisions/:rev/file", func(c *gin.Context) {
+			content, err := system.GetFileAtRevision(c.Param("name"), c.Param("rev"), c.Query("path"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"content": content})
+		})
+
+		// Container Health
+		api.GET("/health", func(c *gin.Context) {
+			c.JSON(http.StatusOK, system.GetContainerHealth(""))
+		})
+
+		api.GET("/projects/:name/health", func(c *gin.Context) {
+			history, err := system.GetHealthHistory(c.Param("name"), 200)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"containers": system.GetContainerHealth(c.Param("name")),
+				"history":    history,
+			})
+		})
+
+		api.POST("/projects/:name/health-policy", func(c *gin.Context) {
+			var req struct {
+				Policy *system.HealthPolicy `json:"policy"` // null resets to the default
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SetProjectHealthPolicy(c.Param("name"), req.Policy); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Set Health Policy", c.Param("name"))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.GET("/settings/health", func(c *gin.Context) {
+			settings, err := system.GetHealthSettings()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, settings)
+		})
+
+		api.POST("/settings/health", func(c *gin.Context) {
+			var settings system.HealthSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SaveHealthSettings(settings); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Update Health Settings", "")
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Image Updates
+		api.GET("/updates", func(c *gin.Context) {
+			c.JSON(http.StatusOK, system.GetUpdateStatuses())
+		})
+
+		api.POST("/updates/check", func(c *gin.Context) {
+			job := system.StartUpdateCheck(c.GetString("username"))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
+		})
+
+		api.POST("/projects/:name/updates/check", func(c *gin.Context) {
+			status, err := system.CheckProjectUpdates(c.Param("name"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, status)
+		})
+
+		api.POST("/projects/:name/update-policy", func(c *gin.Context) {
+			var req struct {
+				Policy            string `json:"policy"`
+				MaintenanceWindow string `json:"maintenance_window"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SetUpdatePolicy(c.Param("name"), req.Policy, req.MaintenanceWindow); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Set Update Policy", c.Param("name")+": "+req.Policy)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Deploy strategy: recreate in place, or blue-green behind Traefik
+		api.POST("/projects/:name/deploy-strategy", func(c *gin.Context) {
+			var req struct {
+				Strategy string `json:"strategy"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SetDeployStrategy(c.Param("name"), req.Strategy); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Set Deploy Strategy", c.Param("name")+": "+req.Strategy)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/projects/:name/update", func(c *gin.Context) {
+			job, err := system.UpdateProject(c.Param("name"), c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Update Project", c.Param("name"))
+			c.JSON(http.StatusOK, gin.H{"status": "success", "job": job})
+		})
+
+		api.POST("/projects/stop", func(c *gin.Context) {
+			var req struct {
+				Name string `json:"name"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.StopProject(req.Name); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to stop project: " + err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.DELETE("/projects/:name", func(c *gin.Context) {
+			if err := system.RemoveProject(c.Param("name")); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Databases API
+		api.GET("/databases", func(c *gin.Context) {
+			dbs, err := database.ListDatabases()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, dbs)
+		})
+
+		api.POST("/databases", func(c *gin.Context) {
+			var req struct {
+				Type     string `json:"type"`
+				Name     string `json:"name"`
+				Password string `json:"password"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := database.CreateDatabase(req.Type, req.Name, req.Password); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Files API
+		api.GET("/files", func(c *gin.Context) {
+			path := c.Query("path")
+			items, err := system.ListFiles(path)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, items)
+		})
+
+		api.GET("/files/content", func(c *gin.Context) {
+			path := c.Query("path")
+			content, err := system.ReadFileContent(path)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"content": content})
+		})
+
+		api.POST("/files/save", func(c *gin.Context) {
+			var req struct {
+				Path    string `json:"path"`
+				Content string `json:"content"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SaveFileContent(req.Path, req.Content); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			system.RecordFileSave(req.Path, c.GetString("username"))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Domains API
+		api.GET("/domains", func(c *gin.Context) {
+			// Mock logic: return domains based on Traefik labels
+			c.JSON(http.StatusOK, []gin.H{
+				{"domain": "panel.yourdomain.com", "target": "fox-admin", "status": "active"},
+			})
+		})
+
+		// System Utilities API
+		api.POST("/terminal/exec", func(c *gin.Context) {
+			var req struct {
+				ContainerID string `json:"containerId"`
+				Command     string `json:"command"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			output, err := system.ExecuteContainerCommand(req.ContainerID, req.Command)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "output": output})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"output": output})
+		})
+
+		api.POST("/backups/create", func(c *gin.Context) {
+			var req struct {
+				ProjectID string `json:"projectId"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			job, err := system.BackupProject(req.ProjectID, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Create Backup", req.ProjectID)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Backup queued", "job": job})
+		})
+
+		api.GET("/backups", func(c *gin.Context) {
+			backups, err := system.ListBackups(c.Query("project"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, backups)
+		})
+
+		api.POST("/backups/restore", func(c *gin.Context) {
+			var req struct {
+				ProjectID string `json:"projectId"`
+				File      string `json:"file"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			job, err := system.RestoreBackup(req.ProjectID, req.File, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Restore Backup", req.ProjectID+" from "+req.File)
+			c.JSON(http.StatusOK, gin.H{"status": "success", "message": "Restore queued", "job": job})
+		})
+
+		api.GET("/cron", func(c *gin.Context) {
+			jobs, err := system.GetCronJobs()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, jobs)
+		})
+
+		api.POST("/cron", func(c *gin.Context) {
+			var jobs []system.CronJob
+			if err := c.ShouldBindJSON(&jobs); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SaveCronJobs(jobs); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Notification Settings
+		api.GET("/settings/notifications", func(c *gin.Context) {
+			settings, _ := system.GetNotificationSettings()
+			c.JSON(http.StatusOK, settings)
+		})
+
+		api.POST("/settings/notifications", func(c *gin.Context) {
+			var settings system.NotificationSettings
+			if err := c.ShouldBindJSON(&settings); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			system.SaveNotificationSettings(settings)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Container Stats
 		api.GET("/containers/stats", func(c *gin.Context) {
-			// Proxy to docker stats --no-stream --format json
-			cmd := exec.Command("docker", "stats", "--no-stream", "--format", "json")
-			output, _ := cmd.CombinedOutput()
-			c.Data(http.StatusOK, "application/json", output)
+			c.JSON(http.StatusOK, system.GetContainerStats())
+		})
+
+		// Images API
+		api.GET("/images", func(c *gin.Context) {
+			images, err := system.ListImages()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, images)
+		})
+
+		api.POST("/images/pull", func(c *gin.Context) {
+			var req struct {
+				Image string `json:"image"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			job, err := system.StartPull(req.Image, c.GetString("username"))
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Pull Image", req.Image)
+
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+			c.SSEvent("job", job.ID)
+
+			// The pull is a job: it goes on if the client disconnects
+			progress := make(chan system.PullProgress, 64)
+			result := make(chan system.Job, 1)
+			go func() {
+				tracker := system.NewPullTracker()
+				final, err := system.FollowJob(c.Request.Context(), job.ID, func(line string) {
+					select {
+					case progress <- tracker.Track(line):
+					default: // Slow client: drop intermediate lines
+					}
+				})
+				if err != nil && final.Error == "" {
+					final.Error = err.Error()
+				}
+				result <- final
+				close(progress)
+			}()
+
+			c.Stream(func(w io.Writer) bool {
+				select {
+				case <-c.Request.Context().Done():
+					return false
+				case p, ok := <-progress:
+					if !ok {
+						if final := <-result; final.Status != system.JobSucceeded {
+							c.SSEvent("error", final.Error)
+						} else {
+							c.SSEvent("done", req.Image)
+						}
+						return false
+					}
+					c.SSEvent("progress", p)
+					return true
+				}
+			})
+		})
+
+		api.POST("/images/tag", func(c *gin.Context) {
+			var req struct {
+				Source string `json:"source"`
+				Target string `json:"target"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.TagImage(req.Source, req.Target); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Tag Image", req.Source+" -> "+req.Target)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// The reference may be an ID or a name with slashes, like ghcr.io/org/app:tag
+		api.DELETE("/images/*ref", func(c *gin.Context) {
+			ref := strings.TrimPrefix(c.Param("ref"), "/")
+			if err := system.RemoveImage(ref, c.Query("force") == "true"); err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Remove Image", ref)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/images/prune", func(c *gin.Context) {
+			report, err := system.PruneImages(c.Query("all") == "true")
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Prune Images", report.ReclaimedSpace)
+			c.JSON(http.StatusOK, report)
+		})
+
+		// Registry Credentials
+		api.GET("/registries", func(c *gin.Context) {
+			creds, err := system.ListRegistries()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, creds)
+		})
+
+		api.POST("/registries", func(c *gin.Context) {
+			var cred system.RegistryCredential
+			if err := c.ShouldBindJSON(&cred); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.SaveRegistry(cred); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Save Registry", cred.Server)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.DELETE("/registries/:id", func(c *gin.Context) {
+			if err := system.DeleteRegistry(c.Param("id")); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Delete Registry", c.Param("id"))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/registries/test", func(c *gin.Context) {
+			var req struct {
+				Server   string `json:"server"`
+				Username string `json:"username"`
+				Password string `json:"password"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.TestRegistryLogin(req.Server, req.Username, req.Password); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Volumes API
+		api.GET("/volumes", func(c *gin.Context) {
+			volumes, err := system.ListVolumes()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, volumes)
+		})
+
+		api.POST("/volumes", func(c *gin.Context) {
+			var req struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.CreateVolume(req.Name, req.Labels); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Create Volume", req.Name)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.DELETE("/volumes/:name", func(c *gin.Context) {
+			name := c.Param("name")
+			if err := system.RemoveVolume(name); err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Remove Volume", name)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/volumes/prune", func(c *gin.Context) {
+			report, err := system.PruneVolumes()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Prune Volumes", report.ReclaimedSpace)
+			c.JSON(http.StatusOK, report)
+		})
+
+		api.GET("/volumes/:name/files", func(c *gin.Context) {
+			items, err := system.ListVolumeFiles(c.Param("name"), c.Query("path"))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, items)
+		})
+
+		api.GET("/volumes/:name/download", func(c *gin.Context) {
+			started := false
+			err := system.DownloadVolumePath(c.Param("name"), c.Query("path"), c.Writer, func(fileName string) {
+				started = true
+				c.Header("Content-Type", "application/octet-stream")
+				c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+				c.Status(http.StatusOK)
+			})
+			if err != nil && !started {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else if err != nil {
+				log.Printf("Volume download interrupted: %v", err)
+			}
+		})
+
+		// Networks API
+		api.GET("/networks", func(c *gin.Context) {
+			networks, err := system.ListNetworks()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, networks)
+		})
+
+		api.GET("/networks/:name", func(c *gin.Context) {
+			network, err := system.GetNetwork(c.Param("name"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, network)
+		})
+
+		api.POST("/networks", func(c *gin.Context) {
+			var req struct {
+				Name     string            `json:"name"`
+				Driver   string            `json:"driver"`
+				Internal bool              `json:"internal"`
+				Labels   map[string]string `json:"labels"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.CreateNetwork(req.Name, req.Driver, req.Internal, req.Labels); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Create Network", req.Name)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.DELETE("/networks/:name", func(c *gin.Context) {
+			name := c.Param("name")
+			if err := system.RemoveNetwork(name); err != nil {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Remove Network", name)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/networks/:name/connect", func(c *gin.Context) {
+			var req struct {
+				Container string `json:"container"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.ConnectNetwork(c.Param("name"), req.Container); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Connect Network", c.Param("name")+" <- "+req.Container)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/networks/:name/disconnect", func(c *gin.Context) {
+			var req struct {
+				Container string `json:"container"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if err := system.DisconnectNetwork(c.Param("name"), req.Container); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Disconnect Network", c.Param("name")+" -> "+req.Container)
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		// Disk Usage & Garbage Collection
+		api.GET("/system/disk-usage", func(c *gin.Context) {
+			report, err := system.GetDiskUsage()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, report)
+		})
+
+		api.GET("/settings/gc", func(c *gin.Context) {
+			policy, err := system.GetGCPolicy()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"policy": policy, "last_run": system.LastGCReport()})
+		})
+
+		api.POST("/settings/gc", func(c *gin.Context) {
+			var policy system.GCPolicy
+			if err := c.ShouldBindJSON(&policy); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			current, _ := system.GetGCPolicy()
+			policy.LastRun = current.LastRun
+			if err := system.SaveGCPolicy(policy); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Update GC Policy", fmt.Sprintf("Enabled: %v", policy.Enabled))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/system/gc", func(c *gin.Context) {
+			policy, err := system.GetGCPolicy()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			dryRun := c.DefaultQuery("dry_run", "true") != "false"
+			report, err := system.RunGC(policy, dryRun)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !dryRun {
+				security.LogAction(c.GetString("username"), "Run GC", report.Reclaimed)
+			}
+			c.JSON(http.StatusOK, report)
+		})
+
+		// Nodes API (remote hosts running fox-agent)
+		api.GET("/nodes", func(c *gin.Context) {
+			list, err := nodes.ListNodes()
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, list)
+		})
+
+		api.POST("/nodes", func(c *gin.Context) {
+			var req struct {
+				Name    string `json:"name"`
+				Address string `json:"address"`
+			}
+			if err := c.ShouldBindJSON(&req); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			node, bundle, err := nodes.CreateNode(req.Name, req.Address)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Add Node", node.Name+" ("+node.Address+")")
+			_, port, _ := net.SplitHostPort(node.Address)
+			// The bundle holds the agent's private key and is only returned once
+			c.JSON(http.StatusOK, gin.H{
+				"node":    node,
+				"bundle":  bundle,
+				"command": fmt.Sprintf("fox-admin agent --listen :%s --ca data/agent/ca.crt --cert data/agent/agent.crt --key data/agent/agent.key", port),
+			})
+		})
+
+		api.DELETE("/nodes/:id", func(c *gin.Context) {
+			if err := nodes.DeleteNode(c.Param("id")); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			security.LogAction(c.GetString("username"), "Remove Node", c.Param("id"))
+			c.JSON(http.StatusOK, gin.H{"status": "success"})
+		})
+
+		api.POST("/nodes/:id/ping", func(c *gin.Context) {
+			node, err := nodes.GetNode(c.Param("id"))
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+			if err := nodes.PingNode(node); err != nil {
+				c.JSON(http.StatusBadGateway, gin.H{"status": "offline", "error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"status": "online"})
 		})
 
 		// Security Endpoints
@@ -543,6 +1755,16 @@ func main() {
 		})
 	}
 
+	if agentMode {
+		tlsConfig, err := nodes.AgentServerTLS(*agentCA, *agentCert, *agentKey)
+		if err != nil {
+			log.Fatalf("Failed to load agent certificates: %v", err)
+		}
+		srv := &http.Server{Addr: *agentListen, Handler: r, TLSConfig: tlsConfig}
+		log.Printf("FoxDocker agent starting on %s (mTLS)...", *agentListen)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+
 	// Serve Static Web Files (UI)
 	dist, err := fs.Sub(foxdocker.WebDist, "web/dist")
 	if err != nil {
@@ -24,7 +24,7 @@ func Init() error {
 
 	// Auto Migration
 	log.Println("Database migration started...")
-	return DB.AutoMigrate(&Project{}, &User{})
+	return DB.AutoMigrate(&Project{}, &User{}, &ProjectEvent{}, &HealthRecord{}, &Node{}, &Deployment{}, &Webhook{}, &WebhookDelivery{}, &ProjectSecret{}, &Job{})
 }
 
 type User struct {
@@ -0,0 +1,30 @@
+// Copyright by AcmaTvirus
+package database
+
+import (
+	"time"
+)
+
+// Deployment lưu lại trạng thái của một lần triển khai để có thể rollback về sau
+type Deployment struct {
+	ID       uint   `json:"id" gorm:"primaryKey"`
+	Project  string `json:"project" gorm:"index"`
+	Trigger  string `json:"trigger"`  // create, install, update, deploy, rollback...
+	Revision string `json:"revision"` // commit git của thư mục dự án
+	Compose  string `json:"compose"`
+	// Nội dung .env được mã hóa, không trả về qua API
+	EnvEncrypted string `json:"-"`
+	HasEnv       bool   `json:"has_env"`
+	// Image đang chạy của từng service
+	Images    map[string]DeployedImage `json:"images" gorm:"serializer:json"`
+	User      string                   `json:"user"`
+	Detail    string                   `json:"detail"`
+	CreatedAt time.Time                `json:"created_at" gorm:"index"`
+}
+
+// DeployedImage là image của một service tại thời điểm triển khai
+type DeployedImage struct {
+	Image  string `json:"image"`  // tham chiếu trong compose, ví dụ nginx:1.25
+	Digest string `json:"digest"` // repo@sha256:... trên registry, rỗng với image build cục bộ
+	ID     string `json:"id"`     // image ID cục bộ
+}
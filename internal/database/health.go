@@ -0,0 +1,19 @@
+// Copyright by AcmaTvirus
+package database
+
+import (
+	"time"
+)
+
+// HealthRecord là một mốc trong lịch sử sức khỏe của container (đổi trạng thái, restart, auto-heal)
+type HealthRecord struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	Project      string    `json:"project" gorm:"index"`
+	Container    string    `json:"container"`
+	Service      string    `json:"service"`
+	Status       string    `json:"status"` // healthy, unhealthy, starting, running, exited...
+	RestartCount int       `json:"restart_count"`
+	Action       string    `json:"action"` // status_change, restart_detected, restart, recreate, escalate
+	Detail       string    `json:"detail"`
+	Time         time.Time `json:"time" gorm:"index"`
+}
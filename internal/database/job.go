@@ -0,0 +1,29 @@
+// Copyright by AcmaTvirus
+package database
+
+import (
+	"time"
+)
+
+// Job là một thao tác chạy nền (cài đặt, triển khai, sao lưu, pull image...)
+// được lưu lại để xem lịch sử và chạy tiếp sau khi panel khởi động lại
+type Job struct {
+	ID       string `json:"id" gorm:"primaryKey"`
+	Type     string `json:"type" gorm:"index"`
+	Project  string `json:"project" gorm:"index"`
+	User     string `json:"user"`
+	Status   string `json:"status" gorm:"index"` // queued, running, succeeded, failed, canceled
+	Progress int    `json:"progress"`            // 0-100
+	Step     string `json:"step"`
+	// Tham số để chạy lại job, được mã hóa vì có thể chứa mật khẩu.
+	// Job không có tham số sẽ không được chạy lại.
+	ParamsEncrypted string `json:"-"`
+	// Các dòng output cuối cùng, DroppedLines là số dòng cũ đã bỏ đi
+	Output       []string   `json:"output" gorm:"serializer:json"`
+	DroppedLines int        `json:"dropped_lines"`
+	Error        string     `json:"error"`
+	ErrorLine    string     `json:"error_line"` // dòng output giải thích lỗi
+	CreatedAt    time.Time  `json:"created_at" gorm:"index"`
+	StartedAt    *time.Time `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+}
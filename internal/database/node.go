@@ -0,0 +1,19 @@
+// Copyright by AcmaTvirus
+package database
+
+import (
+	"time"
+)
+
+// Node là một VPS từ xa chạy fox-agent, được panel quản lý qua mTLS
+type Node struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Name        string     `json:"name" gorm:"unique;not null"`
+	Address     string     `json:"address" gorm:"not null"` // host:port của agent
+	Status      string     `json:"status"`                  // online, offline, pending
+	LastSeen    *time.Time `json:"last_seen"`
+	LastError   string     `json:"last_error"`
+	CertExpires time.Time  `json:"cert_expires"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
@@ -9,6 +9,44 @@ type Project struct {
 	Name      string    `json:"name" gorm:"unique;not null"`
 	Image     string    `json:"image"`
 	Status    string    `json:"status"` // running, stopped, etc.
+
+	// Chính sách cập nhật image: notify, auto, pinned
+	UpdatePolicy      string     `json:"update_policy" gorm:"default:notify"`
+	MaintenanceWindow string     `json:"maintenance_window"` // ví dụ "02:00-04:00"
+	UpdateAvailable   bool       `json:"update_available"`
+	LastUpdateCheck   *time.Time `json:"last_update_check"`
+
+	// Cách thay container khi triển khai: recreate (mặc định) hoặc blue-green
+	DeployStrategy string `json:"deploy_strategy" gorm:"default:recreate"`
+
+	// Nguồn triển khai: compose (mặc định), git hoặc upload (file nén mã nguồn)
+	SourceType string   `json:"source_type" gorm:"default:compose"`
+	GitURL     string   `json:"git_url"` // không chứa thông tin đăng nhập
+	GitBranch  string   `json:"git_branch"`
+	GitSubdir  string   `json:"git_subdir"`
+	Dockerfile string   `json:"dockerfile"` // rỗng: dùng compose file trong repo
+	GitCommit  string   `json:"git_commit"` // commit (hoặc hash bản upload) của mã nguồn
+	AppPort    int      `json:"app_port"`
+	Domains    []string `json:"domains" gorm:"serializer:json"`
+
+	// Thông tin đăng nhập của repository (user:token), đã mã hoá
+	GitCredentialsEncrypted string `json:"-"`
+
+	// Dự án production mà dự án staging này được nhân bản từ đó
+	StagingOf string `json:"staging_of"`
+
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
+
+// ProjectEvent lưu lại các sự kiện container (die, oom, restart, health_status) của dự án
+type ProjectEvent struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Project   string    `json:"project" gorm:"index"`
+	Container string    `json:"container"`
+	Service   string    `json:"service"`
+	Action    string    `json:"action"`
+	ExitCode  string    `json:"exit_code"`
+	Detail    string    `json:"detail"`
+	Time      time.Time `json:"time" gorm:"index"`
+}
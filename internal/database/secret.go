@@ -0,0 +1,17 @@
+// Copyright by AcmaTvirus
+package database
+
+import (
+	"time"
+)
+
+// ProjectSecret là một biến môi trường bí mật của dự án, giá trị được mã hóa
+// và chỉ được ghi ra file env (quyền 0600) khi triển khai
+type ProjectSecret struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	Project        string    `json:"project" gorm:"uniqueIndex:idx_project_secret"`
+	Key            string    `json:"key" gorm:"uniqueIndex:idx_project_secret"`
+	ValueEncrypted string    `json:"-"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
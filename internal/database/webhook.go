@@ -0,0 +1,36 @@
+// Copyright by AcmaTvirus
+package database
+
+import (
+	"time"
+)
+
+// Webhook là URL nhận sự kiện push từ GitHub/GitLab/Gitea để tự động redeploy dự án
+type Webhook struct {
+	ID      uint   `json:"id" gorm:"primaryKey"`
+	Project string `json:"project" gorm:"uniqueIndex"`
+	Token   string `json:"-" gorm:"uniqueIndex"` // phần ngẫu nhiên trong URL
+	// Secret dùng để kiểm tra chữ ký, được mã hóa
+	SecretEncrypted string    `json:"-"`
+	Branch          string    `json:"branch"` // rỗng: nhánh của dự án
+	Enabled         bool      `json:"enabled"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery lưu lại mỗi lần nhận webhook và kết quả xử lý
+type WebhookDelivery struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	Project    string    `json:"project" gorm:"index"`
+	Provider   string    `json:"provider"` // github, gitlab, gitea
+	DeliveryID string    `json:"delivery_id" gorm:"index"`
+	Event      string    `json:"event"`
+	Branch     string    `json:"branch"`
+	Commit     string    `json:"commit"`
+	Pusher     string    `json:"pusher"`
+	Message    string    `json:"message"`
+	Status     string    `json:"status"` // accepted, queued, ignored, duplicate, rejected, failed
+	Detail     string    `json:"detail"`
+	JobID      string    `json:"job_id"`
+	CreatedAt  time.Time `json:"created_at" gorm:"index"`
+}
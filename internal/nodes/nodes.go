@@ -0,0 +1,208 @@
+// Copyright by AcmaTvirus
+package nodes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+)
+
+// LocalNode is the selector value for the host the panel runs on
+const LocalNode = "local"
+
+// UserHeader carries the acting panel user to the agent for its audit log
+const UserHeader = "X-Fox-User"
+
+// panelOnlyPrefixes are APIs that always act on the panel itself, never on a node
+var panelOnlyPrefixes = []string{
+	"/api/nodes", "/api/security", "/api/settings", "/api/registries", "/api/cron",
+}
+
+var nodeNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+var (
+	transportMu sync.Mutex
+	transport   *http.Transport
+	heartbeat   sync.Once
+)
+
+func agentTransport() (*http.Transport, error) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+	if transport != nil {
+		return transport, nil
+	}
+	cfg, err := panelClientTLS()
+	if err != nil {
+		return nil, err
+	}
+	transport = &http.Transport{
+		TLSClientConfig:     cfg,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return transport, nil
+}
+
+func ListNodes() ([]database.Node, error) {
+	nodes := []database.Node{}
+	if database.DB == nil {
+		return nodes, fmt.Errorf("database not initialized")
+	}
+	err := database.DB.Order("name").Find(&nodes).Error
+	return nodes, err
+}
+
+// GetNode looks a node up by ID or name
+func GetNode(selector string) (database.Node, error) {
+	var node database.Node
+	if database.DB == nil {
+		return node, fmt.Errorf("database not initialized")
+	}
+	q := database.DB.Where("name = ?", selector)
+	if id, err := strconv.Atoi(selector); err == nil {
+		q = database.DB.Where("id = ? OR name = ?", id, selector)
+	}
+	if err := q.First(&node).Error; err != nil {
+		return node, fmt.Errorf("node %s not found", selector)
+	}
+	return node, nil
+}
+
+// CreateNode registers an agent and returns the certificate bundle it must
+// be started with. The private key is not kept by the panel.
+func CreateNode(name, address string) (database.Node, Bundle, error) {
+	if !nodeNameRe.MatchString(name) || name == LocalNode {
+		return database.Node{}, Bundle{}, fmt.Errorf("invalid node name: %q", name)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return database.Node{}, Bundle{}, fmt.Errorf("address must be host:port, e.g. 10.0.0.2:7443")
+	}
+	if database.DB == nil {
+		return database.Node{}, Bundle{}, fmt.Errorf("database not initialized")
+	}
+
+	bundle, expires, err := IssueAgentBundle(name, address)
+	if err != nil {
+		return database.Node{}, Bundle{}, err
+	}
+	node := database.Node{Name: name, Address: address, Status: "pending", CertExpires: expires}
+	if err := database.DB.Create(&node).Error; err != nil {
+		return database.Node{}, Bundle{}, err
+	}
+	return node, bundle, nil
+}
+
+func DeleteNode(selector string) error {
+	node, err := GetNode(selector)
+	if err != nil {
+		return err
+	}
+	return database.DB.Delete(&node).Error
+}
+
+// PingNode checks that the agent answers over mTLS and records the result
+func PingNode(node database.Node) error {
+	t, err := agentTransport()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: t, Timeout: 10 * time.Second}
+	resp, err := client.Get("https://" + node.Address + "/api/ping")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("agent returned %s", resp.Status)
+		}
+	}
+
+	updates := map[string]interface{}{}
+	if err != nil {
+		updates["status"] = "offline"
+		updates["last_error"] = err.Error()
+	} else {
+		now := time.Now()
+		updates["status"] = "online"
+		updates["last_error"] = ""
+		updates["last_seen"] = &now
+	}
+	if database.DB != nil {
+		database.DB.Model(&database.Node{}).Where("id = ?", node.ID).Updates(updates)
+	}
+	return err
+}
+
+// StartHeartbeat pings every registered node twice a minute
+func StartHeartbeat() {
+	heartbeat.Do(func() {
+		go func() {
+			for {
+				nodes, _ := ListNodes()
+				for _, n := range nodes {
+					if err := PingNode(n); err != nil && n.Status == "online" {
+						log.Printf("Node %s went offline: %v", n.Name, err)
+					}
+				}
+				time.Sleep(30 * time.Second)
+			}
+		}()
+	})
+}
+
+// IsNodeScoped reports whether an API path can be forwarded to a node
+func IsNodeScoped(path string) bool {
+	for _, p := range panelOnlyPrefixes {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return false
+		}
+	}
+	return strings.HasPrefix(path, "/api/")
+}
+
+// Proxy forwards an API request to the agent of a node. The panel's JWT is
+// replaced by the mTLS client certificate and the acting user header.
+// Streaming responses (SSE, downloads) are flushed as they arrive.
+func Proxy(selector, username string, w http.ResponseWriter, r *http.Request) error {
+	node, err := GetNode(selector)
+	if err != nil {
+		return err
+	}
+	t, err := agentTransport()
+	if err != nil {
+		return err
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport:     t,
+		FlushInterval: -1,
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "https"
+			req.URL.Host = node.Address
+			req.Host = node.Address
+			q := req.URL.Query()
+			q.Del("node")
+			req.URL.RawQuery = q.Encode()
+			req.Header.Del("Authorization")
+			req.Header.Set(UserHeader, username)
+		},
+		ErrorHandler: func(rw http.ResponseWriter, _ *http.Request, err error) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(rw).Encode(map[string]string{
+				"error": fmt.Sprintf("node %s unreachable: %v", node.Name, err),
+			})
+		},
+	}
+	proxy.ServeHTTP(w, r)
+	return nil
+}
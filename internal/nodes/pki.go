@@ -0,0 +1,235 @@
+// Copyright by AcmaTvirus
+package nodes
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The panel is its own certificate authority: it signs one client
+// certificate for itself and one server certificate per agent, and both
+// sides only accept peers signed by that CA.
+const (
+	pkiDir        = "data/pki"
+	PanelClientCN = "foxdocker-panel"
+	certValidity  = 2 * 365 * 24 * time.Hour
+)
+
+// Bundle is what an agent needs to start: the CA and its own key pair, PEM encoded
+type Bundle struct {
+	CACert    string `json:"ca_crt"`
+	AgentCert string `json:"agent_crt"`
+	AgentKey  string `json:"agent_key"`
+}
+
+var pkiMu sync.Mutex
+
+func pkiPath(name string) string {
+	return filepath.Join(pkiDir, name)
+}
+
+// loadCA returns the panel CA, creating it on first use
+func loadCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pkiMu.Lock()
+	defer pkiMu.Unlock()
+
+	certPEM, certErr := os.ReadFile(pkiPath("ca.crt"))
+	keyPEM, keyErr := os.ReadFile(pkiPath("ca.key"))
+	if certErr == nil && keyErr == nil {
+		return parsePair(certPEM, keyPEM)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "FoxDocker Panel CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM, keyPEM, err = encodePair(der, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	os.MkdirAll(pkiDir, 0700)
+	if err := os.WriteFile(pkiPath("ca.crt"), certPEM, 0644); err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(pkiPath("ca.key"), keyPEM, 0600); err != nil {
+		return nil, nil, err
+	}
+	return parsePair(certPEM, keyPEM)
+}
+
+// issue signs a leaf certificate for a client or server
+func issue(cn string, hosts []string, usage x509.ExtKeyUsage) ([]byte, []byte, time.Time, error) {
+	caCert, caKey, err := loadCA()
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if h != "" {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	certPEM, keyPEM, err := encodePair(der, key)
+	return certPEM, keyPEM, tmpl.NotAfter, err
+}
+
+// IssueAgentBundle creates the server certificate an agent at address serves
+func IssueAgentBundle(name, address string) (Bundle, time.Time, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return Bundle{}, time.Time{}, fmt.Errorf("address must be host:port: %v", err)
+	}
+	certPEM, keyPEM, expires, err := issue("fox-agent-"+name, []string{host, "localhost", "127.0.0.1"}, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return Bundle{}, time.Time{}, err
+	}
+	caPEM, err := os.ReadFile(pkiPath("ca.crt"))
+	if err != nil {
+		return Bundle{}, time.Time{}, err
+	}
+	return Bundle{CACert: string(caPEM), AgentCert: string(certPEM), AgentKey: string(keyPEM)}, expires, nil
+}
+
+// panelClientTLS returns the TLS config the panel uses to dial agents
+func panelClientTLS() (*tls.Config, error) {
+	if _, _, err := loadCA(); err != nil {
+		return nil, err
+	}
+
+	pkiMu.Lock()
+	certPEM, certErr := os.ReadFile(pkiPath("panel.crt"))
+	keyPEM, keyErr := os.ReadFile(pkiPath("panel.key"))
+	pkiMu.Unlock()
+
+	if certErr != nil || keyErr != nil {
+		var err error
+		certPEM, keyPEM, _, err = issue(PanelClientCN, nil, x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		pkiMu.Lock()
+		os.WriteFile(pkiPath("panel.crt"), certPEM, 0644)
+		os.WriteFile(pkiPath("panel.key"), keyPEM, 0600)
+		pkiMu.Unlock()
+	}
+
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(pkiPath("ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// AgentServerTLS builds the agent's listener config: it serves its own
+// certificate and only accepts the panel's client certificate.
+func AgentServerTLS(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificate found in CA file")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 || chains[0][0].Subject.CommonName != PanelClientCN {
+				return errors.New("client certificate is not the panel's")
+			}
+			return nil
+		},
+	}, nil
+}
+
+func encodePair(der []byte, key *ecdsa.PrivateKey) ([]byte, []byte, error) {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+func parsePair(certPEM, keyPEM []byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cb, _ := pem.Decode(certPEM)
+	kb, _ := pem.Decode(keyPEM)
+	if cb == nil || kb == nil {
+		return nil, nil, errors.New("invalid CA files in " + pkiDir)
+	}
+	cert, err := x509.ParseCertificate(cb.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(kb.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func randomSerial() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 120))
+	return n
+}
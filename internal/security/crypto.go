@@ -0,0 +1,96 @@
+// Copyright by AcmaTvirus
+package security
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// keyPath holds the data-at-rest key used when FOXDOCKER_SECRET_KEY is unset
+var keyPath = "data/secret.key"
+
+var (
+	keyOnce sync.Once
+	key     []byte
+	keyErr  error
+)
+
+func loadKey() ([]byte, error) {
+	keyOnce.Do(func() {
+		if env := os.Getenv("FOXDOCKER_SECRET_KEY"); env != "" {
+			sum := sha256.Sum256([]byte(env))
+			key = sum[:]
+			return
+		}
+
+		if existing, err := os.ReadFile(keyPath); err == nil && len(existing) == 32 {
+			key = existing
+			return
+		}
+
+		os.MkdirAll("data", 0755)
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			keyErr = err
+			return
+		}
+		keyErr = os.WriteFile(keyPath, key, 0600)
+	})
+	return key, keyErr
+}
+
+// EncryptString seals a value with AES-256-GCM and returns base64(nonce|ciphertext)
+func EncryptString(plain string) (string, error) {
+	k, err := loadKey()
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptString(encoded string) (string, error) {
+	k, err := loadKey()
+	if err != nil {
+		return "", err
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plain, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,150 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupInfo is an archive of a project directory in BackupRoot
+type BackupInfo struct {
+	File      string    `json:"file"`
+	Project   string    `json:"project"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// restoreParams are what a restore job needs to run again after a restart
+type restoreParams struct {
+	File string `json:"file"`
+}
+
+// BackupProject queues a backup of a project directory, taken while no
+// other operation changes it
+func BackupProject(project, user string) (Job, error) {
+	if !composeNameRe.MatchString(project) || !projectExists(project) {
+		return Job{}, fmt.Errorf("project %s not found", project)
+	}
+	return enqueueJob("backup", project, user, struct{}{}, backupTask(project)), nil
+}
+
+func backupTask(project string) jobTask {
+	return func(ctx context.Context, logf JobLogger) error {
+		setJobProgress(ctx, 10, "Archiving project directory")
+		path, err := CreateBackup(ctx, project)
+		if err != nil {
+			return err
+		}
+		logf("Backup written to " + path)
+		return nil
+	}
+}
+
+// ListBackups returns the backups of a project, or of every project,
+// newest first
+func ListBackups(project string) ([]BackupInfo, error) {
+	backups := []BackupInfo{}
+	entries, err := os.ReadDir(BackupRoot)
+	if os.IsNotExist(err) {
+		return backups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, created, ok := parseBackupName(entry.Name())
+		if !ok || entry.IsDir() || (project != "" && name != project) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{File: entry.Name(), Project: name, Size: info.Size(), CreatedAt: created})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// parseBackupName splits a CreateBackup file name, <project>_<unix time>.tar.gz
+func parseBackupName(file string) (string, time.Time, bool) {
+	base := strings.TrimSuffix(file, ".tar.gz")
+	idx := strings.LastIndex(base, "_")
+	if base == file || idx <= 0 {
+		return "", time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(base[idx+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return base[:idx], time.Unix(unix, 0), true
+}
+
+// RestoreBackup queues putting a project directory back as it was in one
+// of its backups and redeploying it
+func RestoreBackup(project, file, user string) (Job, error) {
+	if !composeNameRe.MatchString(project) || !projectExists(project) {
+		return Job{}, fmt.Errorf("project %s not found", project)
+	}
+	name, _, ok := parseBackupName(file)
+	if !ok || name != project || filepath.Base(file) != file {
+		return Job{}, fmt.Errorf("%s is not a backup of project %s", file, project)
+	}
+	if _, err := os.Stat(filepath.Join(BackupRoot, file)); err != nil {
+		return Job{}, fmt.Errorf("backup %s not found", file)
+	}
+	return enqueueJob("restore", project, user, restoreParams{File: file}, restoreTask(project, file, user)), nil
+}
+
+func restoreTask(project, file, user string) jobTask {
+	return func(ctx context.Context, logf JobLogger) error {
+		// Unpack on the projects' filesystem so the swap is a rename
+		tmp, err := projectTempDir("restore")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+
+		setJobProgress(ctx, 10, "Unpacking "+file)
+		restored := filepath.Join(tmp, "project")
+		if err := os.Mkdir(restored, 0755); err != nil {
+			return err
+		}
+		cmd := exec.CommandContext(ctx, "tar", "-xzf", filepath.Join(BackupRoot, file), "-C", restored)
+		if err := streamCommand(cmd, logf); err != nil {
+			return fmt.Errorf("failed to unpack %s: %v", file, err)
+		}
+
+		// The project's history carries on: the archive's .git, older than
+		// the revisions recorded since, gives way to the current one
+		dir := filepath.Join(ProjectsRoot, project)
+		if err := os.RemoveAll(filepath.Join(restored, ".git")); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(dir, ".git"), filepath.Join(restored, ".git")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		previous := filepath.Join(tmp, "previous")
+		if err := os.Rename(dir, previous); err != nil {
+			os.Rename(filepath.Join(restored, ".git"), filepath.Join(dir, ".git"))
+			return err
+		}
+		if err := os.Rename(restored, dir); err != nil {
+			os.Rename(previous, dir)
+			os.Rename(filepath.Join(restored, ".git"), filepath.Join(dir, ".git"))
+			return err
+		}
+		logf("Restored project directory from " + file)
+		RecordProjectChange(project, user, "Restore backup "+file, "docker-compose.yml")
+
+		setJobProgress(ctx, 30, "Redeploying")
+		return deployTask(project, user)(ctx, logf)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/goccy/go-yaml"
+)
+
+// Deploy strategies: how `up` replaces the containers of a running project
+const (
+	DeployRecreate  = "recreate"   // stop the old container, start the new one
+	DeployBlueGreen = "blue-green" // start the new one next to the old one first
+)
+
+const composeConfigHashLabel = "com.docker.compose.config-hash"
+
+func SetDeployStrategy(project, strategy string) error {
+	switch strategy {
+	case DeployRecreate, DeployBlueGreen:
+	default:
+		return fmt.Errorf("unknown deploy strategy: %s", strategy)
+	}
+	if database.DB == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if !projectExists(project) {
+		return fmt.Errorf("project %s not found", project)
+	}
+	getOrCreateProject(project)
+	return database.DB.Model(&database.Project{}).Where("name = ?", project).Update("deploy_strategy", strategy).Error
+}
+
+// composeUp brings a project to its compose file with the project's deploy
+// strategy, its secrets written out first. extra is appended to every `up`.
+func composeUp(ctx context.Context, project string, logf JobLogger, extra ...string) error {
+	if err := syncSecretsEnv(project); err != nil {
+		return fmt.Errorf("failed to write secrets: %v", err)
+	}
+	if getOrCreateProject(project).DeployStrategy == DeployBlueGreen {
+		if err := blueGreenRollout(ctx, project, logf, extra); err != nil {
+			return err
+		}
+	}
+	return streamCompose(ctx, project, logf, append([]string{"up", "-d", "--remove-orphans"}, extra...)...)
+}
+
+// blueGreenRollout replaces the outdated containers of every service routed
+// by Traefik without dropping traffic. The new container is started next to
+// the old one with the same router labels, so Traefik balances between both
+// and only sends traffic to it once its healthcheck passes. When it is
+// healthy the old one is stopped gracefully; when it is not, it is removed
+// and the old one keeps serving untouched. Services without a healthcheck
+// would get traffic the moment they start, so they are recreated in place.
+func blueGreenRollout(ctx context.Context, project string, logf JobLogger, extra []string) error {
+	content, err := os.ReadFile(projectComposePath(project))
+	if err != nil {
+		return err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()); err != nil {
+		return fmt.Errorf("invalid compose file: %v", err)
+	}
+	containers, err := inspectProjectContainers(project)
+	if err != nil {
+		return err
+	}
+
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		name := fmt.Sprint(svc.Key)
+		def, _ := svc.Value.(yaml.MapSlice)
+		if !routedByTraefik(def) {
+			continue
+		}
+		var old []containerInspect
+		for _, ct := range containers {
+			if ct.Config.Labels[composeServiceLabel] == name && ct.State.Running {
+				old = append(old, ct)
+			}
+		}
+		if len(old) == 0 || !serviceOutdated(project, name, old) {
+			continue
+		}
+		if mapValue(def, "container_name") != nil || publishesHostPort(def) {
+			logf(fmt.Sprintf("Service %s has a fixed container name or host port and cannot run twice: it is recreated in place", name))
+			continue
+		}
+		if !serviceHasHealthcheck(project, name, def) {
+			logf(fmt.Sprintf("Warning: service %s has no healthcheck to hold traffic back until it is ready: it is recreated in place", name))
+			continue
+		}
+		if err := rolloutService(ctx, project, name, old, logf, extra); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rolloutService(ctx context.Context, project, service string, old []containerInspect, logf JobLogger, extra []string) error {
+	oldIDs := make([]string, len(old))
+	for i, ct := range old {
+		oldIDs[i] = ct.ID
+	}
+
+	logf(fmt.Sprintf("Starting the new version of %s next to the running one", service))
+	args := append([]string{"up", "-d", "--no-deps", "--no-recreate", "--scale", fmt.Sprintf("%s=%d", service, 2*len(old))}, extra...)
+	err := streamCompose(ctx, project, logf, append(args, service)...)
+
+	var newIDs []string
+	if current, inspectErr := inspectProjectContainers(project); inspectErr == nil {
+		for _, ct := range current {
+			if ct.Config.Labels[composeServiceLabel] == service && !containsString(oldIDs, ct.ID) {
+				newIDs = append(newIDs, ct.ID)
+			}
+		}
+	}
+	abort := func(cause error) error {
+		if len(newIDs) > 0 {
+			runDocker(append([]string{"rm", "-f"}, newIDs...)...)
+		}
+		logf(fmt.Sprintf("Removed the new version of %s, the previous one is still serving", service))
+		return fmt.Errorf("new version of %s: %v", service, cause)
+	}
+	if err != nil {
+		return abort(err)
+	}
+	if len(newIDs) == 0 {
+		return abort(fmt.Errorf("no new container was started"))
+	}
+
+	logf(fmt.Sprintf("Waiting for the new version of %s to become healthy...", service))
+	if err := waitContainersHealthy(ctx, newIDs, updateHealthTimeout); err != nil {
+		return abort(err)
+	}
+
+	logf(fmt.Sprintf("Switching %s traffic to the new version", service))
+	if _, err := runDocker(append([]string{"stop", "-t", "30"}, oldIDs...)...); err != nil {
+		return fmt.Errorf("failed to stop the previous version of %s: %v", service, err)
+	}
+	runDocker(append([]string{"rm"}, oldIDs...)...)
+	return nil
+}
+
+// serviceOutdated reports whether `up` would recreate a service: its
+// definition or the image behind its tag changed
+func serviceOutdated(project, service string, running []containerInspect) bool {
+	out, err := runCompose(project, "config", "--hash", service)
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		return true
+	}
+	for _, ct := range running {
+		if ct.Config.Labels[composeConfigHashLabel] != fields[1] {
+			return true
+		}
+		id, err := runDocker("image", "inspect", "--format", "{{.Id}}", ct.Config.Image)
+		if err != nil || strings.TrimSpace(id) != ct.Image {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceHasHealthcheck reports whether the containers of a service run a
+// healthcheck, set in the compose file or inherited from their image
+func serviceHasHealthcheck(project, service string, def yaml.MapSlice) bool {
+	if hc, ok := mapValue(def, "healthcheck").(yaml.MapSlice); ok {
+		if fmt.Sprint(mapValue(hc, "disable")) == "true" {
+			return false
+		}
+		switch test := mapValue(hc, "test").(type) {
+		case []interface{}:
+			return len(test) > 0 && fmt.Sprint(test[0]) != "NONE"
+		case string:
+			return test != ""
+		}
+	}
+	image, err := runCompose(project, "config", "--images", service)
+	if err != nil || strings.TrimSpace(image) == "" {
+		return false
+	}
+	out, err := runDocker("image", "inspect", "--format", "{{json .Config.Healthcheck}}", strings.TrimSpace(image))
+	if err != nil {
+		return false
+	}
+	var hc struct {
+		Test []string `json:"Test"`
+	}
+	if json.Unmarshal([]byte(out), &hc) != nil {
+		return false
+	}
+	return len(hc.Test) > 0 && hc.Test[0] != "NONE"
+}
+
+// routedByTraefik reports whether a service definition enables Traefik
+func routedByTraefik(def yaml.MapSlice) bool {
+	switch labels := mapValue(def, "labels").(type) {
+	case yaml.MapSlice:
+		return fmt.Sprint(mapValue(labels, "traefik.enable")) == "true"
+	case []interface{}:
+		return containsValue(labels, "traefik.enable=true")
+	}
+	return false
+}
+
+// publishesHostPort reports whether a service binds a fixed host port,
+// which two containers cannot share
+func publishesHostPort(def yaml.MapSlice) bool {
+	ports, _ := mapValue(def, "ports").([]interface{})
+	for _, p := range ports {
+		if long, ok := p.(yaml.MapSlice); ok {
+			if v := mapValue(long, "published"); v != nil && fmt.Sprint(v) != "" {
+				return true
+			}
+			continue
+		}
+		if strings.Contains(fmt.Sprint(p), ":") {
+			return true
+		}
+	}
+	return false
+}
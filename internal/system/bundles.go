@@ -0,0 +1,939 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/goccy/go-yaml"
+)
+
+// A bundle is a .tar.gz holding what a project needs to run on another
+// FoxDocker server:
+//
+//	manifest.json         panel metadata, routed domains, volumes, databases
+//	project/              the project directory: compose file, .env, source
+//	secrets.env           the project's secrets, in clear like the .env
+//	volumes/<key>.tar     content of each named volume
+//	databases/<svc>.dump  logical dump of each running database
+//
+// Databases are dumped so their copy is consistent; the other volumes are
+// read while the project runs. Importing renames what is already taken on
+// the server: the project, host ports, container names and domains.
+
+const (
+	bundleFormat     = "foxdocker-bundle"
+	bundleVersion    = 1
+	bundleManifest   = "manifest.json"
+	bundleSecrets    = "secrets.env"
+	bundleProjectDir = "project"
+	maxBundleSize    = 50 << 30 // what a bundle unpacks to
+)
+
+var (
+	bundleKeyRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	publishedRe = regexp.MustCompile(`:(\d+)->`)
+	shortPortRe = regexp.MustCompile(`^(.*:)?(\d+):(\d+(?:-\d+)?(?:/[a-z]+)?)$`)
+)
+
+// BundleManifest describes the content of a bundle
+type BundleManifest struct {
+	Format     string           `json:"format"`
+	Version    int              `json:"version"`
+	Project    string           `json:"project"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Metadata   BundleMetadata   `json:"metadata"`
+	Routes     []BundleRoute    `json:"routes"`
+	Volumes    []BundleVolume   `json:"volumes"`
+	Databases  []BundleDatabase `json:"databases"`
+	Secrets    []string         `json:"secrets"` // names of the secrets in secrets.env
+}
+
+// BundleMetadata is the part of database.Project that describes the
+// project rather than its state on one server
+type BundleMetadata struct {
+	SourceType        string   `json:"source_type"`
+	GitURL            string   `json:"git_url,omitempty"`
+	GitBranch         string   `json:"git_branch,omitempty"`
+	GitSubdir         string   `json:"git_subdir,omitempty"`
+	Dockerfile        string   `json:"dockerfile,omitempty"`
+	GitCommit         string   `json:"git_commit,omitempty"`
+	AppPort           int      `json:"app_port,omitempty"`
+	Domains           []string `json:"domains"`
+	UpdatePolicy      string   `json:"update_policy"`
+	MaintenanceWindow string   `json:"maintenance_window,omitempty"`
+	DeployStrategy    string   `json:"deploy_strategy"`
+}
+
+// BundleRoute is a service Traefik routes domains to
+type BundleRoute struct {
+	Service string   `json:"service"`
+	Domains []string `json:"domains"`
+	Port    int      `json:"port"`
+}
+
+// BundleVolume is a named volume; File is empty when its data travels as
+// a database dump instead
+type BundleVolume struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+}
+
+// BundleDatabase is the dump of a database service
+type BundleDatabase struct {
+	Service string `json:"service"`
+	Engine  string `json:"engine"`
+	File    string `json:"file"`
+}
+
+// ImportOptions adapts a bundle to the server it is imported on
+type ImportOptions struct {
+	Name    string            `json:"name"`    // empty keeps the exported name, or a free variant of it
+	Domains map[string]string `json:"domains"` // exported domain -> domain to serve it on
+}
+
+// ImportResult tells what had to change for the project to fit the server
+type ImportResult struct {
+	Project string   `json:"project"`
+	Changes []string `json:"changes"`
+	Job     Job      `json:"job"`
+}
+
+// ExportProject writes a bundle of a project to w. Dumps and volume
+// archives are prepared first, so start, which receives the download file
+// name, is only called once nothing can fail but the transfer itself.
+func ExportProject(project string, w io.Writer, start func(fileName string)) error {
+	if !projectExists(project) {
+		return fmt.Errorf("project %s not found", project)
+	}
+	content, err := os.ReadFile(projectComposePath(project))
+	if err != nil {
+		return fmt.Errorf("project %s has no docker-compose.yml", project)
+	}
+	var doc yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()); err != nil {
+		return fmt.Errorf("invalid compose file: %v", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(ProjectsRoot), ".export-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	os.Mkdir(filepath.Join(tmp, "volumes"), 0700)
+	os.Mkdir(filepath.Join(tmp, "databases"), 0700)
+
+	p := getOrCreateProject(project)
+	m := BundleManifest{
+		Format: bundleFormat, Version: bundleVersion, Project: project, ExportedAt: time.Now(),
+		Metadata: BundleMetadata{
+			SourceType: p.SourceType, GitURL: p.GitURL, GitBranch: p.GitBranch, GitSubdir: p.GitSubdir,
+			Dockerfile: p.Dockerfile, GitCommit: p.GitCommit, AppPort: p.AppPort, Domains: p.Domains,
+			UpdatePolicy: p.UpdatePolicy, MaintenanceWindow: p.MaintenanceWindow, DeployStrategy: p.DeployStrategy,
+		},
+		Routes:    bundleRoutes(doc),
+		Volumes:   []BundleVolume{},
+		Databases: []BundleDatabase{},
+		Secrets:   []string{},
+	}
+	secrets, err := projectSecrets(project)
+	if err != nil {
+		return err
+	}
+	for key := range secrets {
+		m.Secrets = append(m.Secrets, key)
+	}
+	sort.Strings(m.Secrets)
+
+	running := map[string]string{} // service -> container
+	if containers, err := inspectProjectContainers(project); err == nil {
+		for _, ct := range containers {
+			if ct.State.Running {
+				running[ct.Config.Labels[composeServiceLabel]] = ct.ID
+			}
+		}
+	}
+	volumes := projectVolumes(project, doc)
+	dumped := map[string]bool{}
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		name := fmt.Sprint(svc.Key)
+		def, _ := svc.Value.(yaml.MapSlice)
+		engine := detectDatabaseEngine(fmt.Sprint(mapValue(def, "image")))
+		if engine == nil || running[name] == "" {
+			continue
+		}
+		file := "databases/" + name + ".dump"
+		if err := dumpDatabase(running[name], engine, filepath.Join(tmp, file)); err != nil {
+			return fmt.Errorf("failed to dump database of service %s: %v", name, err)
+		}
+		m.Databases = append(m.Databases, BundleDatabase{Service: name, Engine: engine.Name, File: file})
+		for _, source := range serviceVolumeMounts(def) {
+			dumped[source] = true
+		}
+	}
+
+	keys := make([]string, 0, len(volumes))
+	for key := range volumes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := BundleVolume{Key: key, Name: volumes[key]}
+		if _, err := runDocker("volume", "inspect", v.Name); err == nil && !dumped[key] {
+			v.File = "volumes/" + key + ".tar"
+			if err := saveVolume(v.Name, filepath.Join(tmp, v.File)); err != nil {
+				return fmt.Errorf("failed to archive volume %s: %v", v.Name, err)
+			}
+		}
+		m.Volumes = append(m.Volumes, v)
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(tmp, bundleManifest), manifest, 0600); err != nil {
+		return err
+	}
+
+	if start != nil {
+		start(fmt.Sprintf("%s-%s.tar.gz", project, time.Now().Format("20060102-150405")))
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tarFile(tw, bundleManifest, filepath.Join(tmp, bundleManifest)); err != nil {
+		return err
+	}
+	if err := tarProjectDir(tw, project, p); err != nil {
+		return err
+	}
+	if len(m.Secrets) > 0 {
+		var b strings.Builder
+		for _, key := range m.Secrets {
+			fmt.Fprintf(&b, "%s=%s\n", key, quoteSecret(secrets[key]))
+		}
+		h := &tar.Header{Name: bundleSecrets, Mode: 0600, Size: int64(b.Len()), ModTime: m.ExportedAt, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, b.String()); err != nil {
+			return err
+		}
+	}
+	for _, d := range m.Databases {
+		if err := tarFile(tw, d.File, filepath.Join(tmp, d.File)); err != nil {
+			return err
+		}
+	}
+	for _, v := range m.Volumes {
+		if v.File != "" {
+			if err := tarFile(tw, v.File, filepath.Join(tmp, v.File)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// bundleRoutes lists the services Traefik routes to and their domains
+func bundleRoutes(doc yaml.MapSlice) []BundleRoute {
+	routes := []BundleRoute{}
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		if !routedByTraefik(def) {
+			continue
+		}
+		route := BundleRoute{Service: fmt.Sprint(svc.Key), Port: traefikServicePort(def)}
+		labels, _ := yaml.Marshal(mapValue(def, "labels"))
+		for _, m := range hostRuleRe.FindAllStringSubmatch(string(labels), -1) {
+			if !containsString(route.Domains, m[1]) {
+				route.Domains = append(route.Domains, m[1])
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// projectVolumes maps the volume keys of a compose file to docker volumes
+func projectVolumes(project string, doc yaml.MapSlice) map[string]string {
+	names := map[string]string{}
+	volumes, _ := mapValue(doc, "volumes").(yaml.MapSlice)
+	for _, v := range volumes {
+		key := fmt.Sprint(v.Key)
+		def, _ := v.Value.(yaml.MapSlice)
+		switch {
+		case mapValue(def, "name") != nil:
+			names[key] = fmt.Sprint(mapValue(def, "name"))
+		case fmt.Sprint(mapValue(def, "external")) == "true":
+			names[key] = key
+		default:
+			names[key] = project + "_" + key
+		}
+	}
+	return names
+}
+
+func dumpDatabase(container string, engine *databaseEngine, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var stderr strings.Builder
+	cmd := exec.Command("docker", "exec", container, "sh", "-c", engine.Dump)
+	cmd.Stdout, cmd.Stderr = f, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func saveVolume(name, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var stderr strings.Builder
+	cmd := volumeHelper(name, "tar", "-C", "/data", "-cf", "-", ".")
+	cmd.Stdout, cmd.Stderr = f, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// tarProjectDir adds the project directory under project/. The checkout of
+// a git project is left out: the import clones it again.
+func tarProjectDir(tw *tar.Writer, project string, p database.Project) error {
+	root := filepath.Join(ProjectsRoot, project)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if rel == "." {
+			return nil
+		}
+		name := bundleProjectDir + "/" + filepath.ToSlash(rel)
+		switch {
+		case d.IsDir() && (d.Name() == ".git" || rel == unpackedTmpName || (rel == sourceDir && p.SourceType == SourceGit)):
+			return filepath.SkipDir
+		case d.IsDir():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			h, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			h.Name = name + "/"
+			return tw.WriteHeader(h)
+		case d.Type().IsRegular():
+			return tarFile(tw, name, path)
+		}
+		return nil
+	})
+}
+
+func tarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	h, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, h.Size)
+	return err
+}
+
+// importPlan is what fitting a bundle to this server decided
+type importPlan struct {
+	doc      yaml.MapSlice
+	volumes  map[string]string // volume key -> volume on this server
+	external map[string]bool   // volumes the compose file does not own
+	networks []string          // external networks to create
+	domains  map[string]string // exported domain -> imported domain
+	changes  []string
+}
+
+// ImportProject unpacks a bundle into a new project and restores it as a
+// job: volumes first, then the deploy, then the database dumps.
+func ImportProject(archive io.Reader, opts ImportOptions, user string) (ImportResult, error) {
+	if database.DB == nil {
+		return ImportResult{}, fmt.Errorf("database not initialized")
+	}
+	for from, to := range opts.Domains {
+		if err := ValidateDomain(to); err != nil {
+			return ImportResult{}, fmt.Errorf("domain for %s: %v", from, err)
+		}
+	}
+	// Unpack on the projects' filesystem so the project directory is moved
+	// in place with a rename
+	tmp, err := projectTempDir("import")
+	if err != nil {
+		return ImportResult{}, err
+	}
+	cleanup := true
+	defer func() {
+		if cleanup {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("not a bundle: %v", err)
+	}
+	if err := extractTar(gz, tmp, maxBundleSize); err != nil {
+		return ImportResult{}, fmt.Errorf("failed to unpack bundle: %v", err)
+	}
+	m, err := readBundleManifest(tmp)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	var result ImportResult
+	if opts.Name != "" {
+		if err := ValidateNewProjectName(opts.Name); err != nil {
+			return ImportResult{}, err
+		}
+		result.Project = opts.Name
+	} else if result.Project, err = freeProjectName(m.Project); err != nil {
+		return ImportResult{}, err
+	}
+	name := result.Project
+	if name != m.Project {
+		result.Changes = append(result.Changes, fmt.Sprintf("project %s is imported as %s", m.Project, name))
+	}
+
+	content, err := os.ReadFile(filepath.Join(tmp, bundleProjectDir, "docker-compose.yml"))
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("bundle has no docker-compose.yml")
+	}
+	doc, err := ParseComposeDocument(content)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	plan, err := importCompose(doc, m, name, opts.Domains)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	result.Changes = append(result.Changes, plan.changes...)
+	if result.Changes == nil {
+		result.Changes = []string{}
+	}
+	compose, err := yaml.MarshalWithOptions(plan.doc, yaml.IndentSequence(true))
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	dir := filepath.Join(ProjectsRoot, name)
+	if err := os.Rename(filepath.Join(tmp, bundleProjectDir), dir); err != nil {
+		return ImportResult{}, fmt.Errorf("failed to create project directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), compose, 0644); err != nil {
+		os.RemoveAll(dir)
+		return ImportResult{}, err
+	}
+	// .env usually holds passwords: keep it private
+	os.Chmod(filepath.Join(dir, ".env"), 0600)
+
+	domains := []string{}
+	for _, d := range m.Metadata.Domains {
+		if to, ok := plan.domains[d]; ok {
+			d = to
+		}
+		domains = append(domains, d)
+	}
+	if len(m.Secrets) > 0 {
+		secrets, err := readBundleSecrets(filepath.Join(tmp, bundleSecrets))
+		if err == nil {
+			err = storeSecrets(name, secrets)
+		}
+		if err != nil {
+			os.RemoveAll(dir)
+			return ImportResult{}, fmt.Errorf("failed to import secrets: %v", err)
+		}
+	}
+	p := getOrCreateProject(name)
+	database.DB.Model(&p).Updates(database.Project{
+		Image: firstServiceImage(plan.doc), Status: "creating",
+		SourceType: m.Metadata.SourceType, GitBranch: m.Metadata.GitBranch,
+		GitSubdir: m.Metadata.GitSubdir, Dockerfile: m.Metadata.Dockerfile, GitCommit: m.Metadata.GitCommit,
+		AppPort: m.Metadata.AppPort, Domains: domains, UpdatePolicy: m.Metadata.UpdatePolicy,
+		MaintenanceWindow: m.Metadata.MaintenanceWindow, DeployStrategy: m.Metadata.DeployStrategy,
+	})
+	if err := setGitURL(name, m.Metadata.GitURL); err != nil {
+		return ImportResult{}, fmt.Errorf("failed to save the repository: %v", err)
+	}
+	RecordProjectChange(name, user, fmt.Sprintf("Import %s exported on %s", m.Project, m.ExportedAt.Format("2006-01-02 15:04")),
+		"docker-compose.yml")
+
+	cleanup = false
+	result.Job = StartJob("import", name, user, func(ctx context.Context, logf JobLogger) error {
+		defer os.RemoveAll(tmp)
+		err := restoreBundle(ctx, name, tmp, m, plan, user, logf)
+		if err != nil {
+			database.DB.Model(&database.Project{}).Where("name = ?", name).Update("status", "error")
+		}
+		return err
+	})
+	return result, nil
+}
+
+// readBundleSecrets reads the KEY="value" lines of an exported secrets file
+func readBundleSecrets(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("bundle has no %s", bundleSecrets)
+	}
+	secrets := map[string]string{}
+	for _, line := range splitLines(string(content)) {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, _ := strings.Cut(line, "=")
+		value = unquoteSecret(value)
+		if err := validateSecret(key, value); err != nil {
+			return nil, err
+		}
+		secrets[key] = value
+	}
+	return secrets, nil
+}
+
+func readBundleManifest(dir string) (BundleManifest, error) {
+	var m BundleManifest
+	data, err := os.ReadFile(filepath.Join(dir, bundleManifest))
+	if err != nil {
+		return m, fmt.Errorf("not a bundle: %s is missing", bundleManifest)
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("invalid %s: %v", bundleManifest, err)
+	}
+	if m.Format != bundleFormat {
+		return m, fmt.Errorf("not a bundle: unknown format %q", m.Format)
+	}
+	if m.Version > bundleVersion {
+		return m, fmt.Errorf("bundle version %d is newer than this panel supports", m.Version)
+	}
+	if !projectNameRe.MatchString(m.Project) {
+		return m, fmt.Errorf("invalid project name in bundle: %q", m.Project)
+	}
+	for _, v := range m.Volumes {
+		if !bundleKeyRe.MatchString(v.Key) || (v.File != "" && v.File != "volumes/"+v.Key+".tar") {
+			return m, fmt.Errorf("invalid volume in bundle: %q", v.Key)
+		}
+	}
+	for _, d := range m.Databases {
+		if !bundleKeyRe.MatchString(d.Service) || d.File != "databases/"+d.Service+".dump" {
+			return m, fmt.Errorf("invalid database in bundle: %q", d.Service)
+		}
+	}
+	return m, nil
+}
+
+// freeProjectName returns name, or name-2, name-3... if it is taken
+func freeProjectName(name string) (string, error) {
+	if ValidateNewProjectName(name) == nil {
+		return name, nil
+	}
+	for i := 2; i < 100; i++ {
+		candidate := fmt.Sprintf("%s-%d", name, i)
+		if len(candidate) <= 63 && ValidateNewProjectName(candidate) == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("project %s already exists, choose another name", name)
+}
+
+// volumeExists reports whether a docker volume exists on this server
+func volumeExists(name string) bool {
+	_, err := runDocker("volume", "inspect", name)
+	return err == nil
+}
+
+// importCompose fits an exported compose file to this server: networks and
+// volumes follow the project name, host ports, container names and domains
+// already in use are replaced, and the Traefik routers are renamed.
+func importCompose(doc yaml.MapSlice, m BundleManifest, name string, domainMap map[string]string) (importPlan, error) {
+	plan := importPlan{volumes: map[string]string{}, external: map[string]bool{}, domains: map[string]string{}}
+	renamed := name != m.Project
+	doc = retargetSecrets(doc, m.Project, name)
+	rename := func(old, key string) string {
+		if strings.HasPrefix(old, m.Project) {
+			return name + strings.TrimPrefix(old, m.Project)
+		}
+		return name + "-" + key
+	}
+
+	networks, _ := mapValue(doc, "networks").(yaml.MapSlice)
+	for i, n := range networks {
+		key := fmt.Sprint(n.Key)
+		def, _ := n.Value.(yaml.MapSlice)
+		explicit := mapValue(def, "name")
+		switch {
+		case fmt.Sprint(mapValue(def, "external")) == "true":
+			if explicit == nil {
+				explicit = key
+			}
+			if fmt.Sprint(explicit) != TraefikNetwork {
+				plan.networks = append(plan.networks, fmt.Sprint(explicit))
+			}
+		case renamed && key == "default":
+			networks[i].Value = setMapValue(def, "name", projectNetworkName(name))
+		case renamed && explicit != nil:
+			networks[i].Value = setMapValue(def, "name", rename(fmt.Sprint(explicit), key))
+		}
+	}
+
+	volumes, _ := mapValue(doc, "volumes").(yaml.MapSlice)
+	for i, v := range volumes {
+		key := fmt.Sprint(v.Key)
+		def, _ := v.Value.(yaml.MapSlice)
+		explicit := mapValue(def, "name")
+		external := fmt.Sprint(mapValue(def, "external")) == "true"
+		// A volume of that name already on this server holds another
+		// project's data: the import gets its own copy instead
+		taken := false
+		if explicit != nil {
+			taken = volumeExists(fmt.Sprint(explicit))
+		} else if external {
+			taken = volumeExists(key)
+		}
+		switch {
+		case (explicit != nil || external) && (renamed || taken):
+			// The copy belongs to the imported project, not to the original
+			clean := yaml.MapSlice{}
+			for _, item := range def {
+				if k := fmt.Sprint(item.Key); k != "name" && k != "external" {
+					clean = append(clean, item)
+				}
+			}
+			volumes[i].Value = clean
+			plan.volumes[key] = name + "_" + key
+			plan.changes = append(plan.changes, fmt.Sprintf("volume %s is created as %s", key, plan.volumes[key]))
+		case explicit != nil:
+			plan.volumes[key] = fmt.Sprint(explicit)
+			plan.external[key] = external
+		case external:
+			plan.volumes[key] = key
+			plan.external[key] = true
+		default:
+			plan.volumes[key] = name + "_" + key
+		}
+	}
+
+	for key, target := range plan.volumes {
+		if volumeExists(target) {
+			return plan, fmt.Errorf("volume %s of %s already exists on this server, import it under another name", target, key)
+		}
+	}
+
+	usedPorts := usedHostPorts()
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for i, svc := range services {
+		service := fmt.Sprint(svc.Key)
+		def, _ := svc.Value.(yaml.MapSlice)
+
+		if cn := mapValue(def, "container_name"); cn != nil {
+			target := fmt.Sprint(cn)
+			if renamed {
+				target = rename(target, service)
+			}
+			if _, err := runDocker("container", "inspect", target); err == nil {
+				def = deleteMapKey(def, "container_name")
+				plan.changes = append(plan.changes, fmt.Sprintf("service %s: container name %s is taken, compose names it", service, target))
+			} else if target != fmt.Sprint(cn) {
+				def = setMapValue(def, "container_name", target)
+			}
+		}
+
+		if ports, ok := mapValue(def, "ports").([]interface{}); ok {
+			for j, entry := range ports {
+				if long, isLong := entry.(yaml.MapSlice); isLong {
+					published, err := strconv.Atoi(fmt.Sprint(mapValue(long, "published")))
+					if err != nil || !usedPorts[published] {
+						usedPorts[published] = true
+						continue
+					}
+					free := freeHostPort(published, usedPorts)
+					ports[j] = setMapValue(long, "published", fmt.Sprint(free))
+					plan.changes = append(plan.changes, fmt.Sprintf("service %s: host port %d is taken, published on %d", service, published, free))
+					continue
+				}
+				parts := shortPortRe.FindStringSubmatch(fmt.Sprint(entry))
+				if parts == nil {
+					continue
+				}
+				published, _ := strconv.Atoi(parts[2])
+				if !usedPorts[published] {
+					usedPorts[published] = true
+					continue
+				}
+				free := freeHostPort(published, usedPorts)
+				ports[j] = fmt.Sprintf("%s%d:%s", parts[1], free, parts[3])
+				plan.changes = append(plan.changes, fmt.Sprintf("service %s: host port %d is taken, published on %d", service, published, free))
+			}
+			def = setMapValue(def, "ports", ports)
+		}
+		services[i].Value = def
+	}
+	doc = setMapValue(doc, "services", services)
+
+	taken := domainsInUse()
+	reroute := renamed
+	for _, route := range m.Routes {
+		for _, d := range route.Domains {
+			to, ok := domainMap[d]
+			if !ok && taken[d] != "" {
+				to = siblingDomain(d, "import-"+randomHex(3))
+				plan.changes = append(plan.changes, fmt.Sprintf("domain %s is served by project %s, %s is used instead", d, taken[d], to))
+			} else if !ok {
+				continue
+			}
+			plan.domains[d] = to
+			reroute = true
+		}
+	}
+	if reroute {
+		for i, route := range m.Routes {
+			router := name
+			if i > 0 {
+				router = name + "-" + route.Service
+			}
+			domains := make([]string, len(route.Domains))
+			for j, d := range route.Domains {
+				if to, ok := plan.domains[d]; ok {
+					d = to
+				}
+				domains[j] = d
+			}
+			if len(domains) == 0 {
+				continue
+			}
+			var err error
+			if doc, err = routeDomains(doc, router, route.Service, route.Port, domains); err != nil {
+				return plan, err
+			}
+		}
+	}
+	plan.doc = doc
+	return plan, nil
+}
+
+// usedHostPorts lists the host ports published by containers on this server
+func usedHostPorts() map[int]bool {
+	used := map[int]bool{}
+	out, err := runDocker("ps", "--format", "{{.Ports}}")
+	if err != nil {
+		return used
+	}
+	for _, m := range publishedRe.FindAllStringSubmatch(out, -1) {
+		if port, err := strconv.Atoi(m[1]); err == nil {
+			used[port] = true
+		}
+	}
+	return used
+}
+
+// freeHostPort finds the next port after a taken one and reserves it
+func freeHostPort(port int, used map[int]bool) int {
+	for p := port + 1; p <= 65535; p++ {
+		if !used[p] {
+			used[p] = true
+			return p
+		}
+	}
+	for p := 20000; ; p++ {
+		if !used[p] {
+			used[p] = true
+			return p
+		}
+	}
+}
+
+// domainsInUse maps the domains routed by the projects on this server to
+// the project routing them
+func domainsInUse() map[string]string {
+	taken := map[string]string{}
+	entries, _ := os.ReadDir(ProjectsRoot)
+	for _, e := range entries {
+		if !IsProjectDir(e) {
+			continue
+		}
+		content, err := os.ReadFile(projectComposePath(e.Name()))
+		if err != nil {
+			continue
+		}
+		for _, m := range hostRuleRe.FindAllStringSubmatch(string(content), -1) {
+			taken[m[1]] = e.Name()
+		}
+	}
+	return taken
+}
+
+func restoreBundle(ctx context.Context, name, dir string, m BundleManifest, plan importPlan, user string, logf JobLogger) error {
+	for _, c := range plan.changes {
+		logf("Changed: " + c)
+	}
+
+	if usesTraefikNetwork(plan.doc) {
+		if err := EnsureTraefikNetwork(); err != nil {
+			return fmt.Errorf("failed to prepare traefik network: %v", err)
+		}
+	}
+	for _, n := range plan.networks {
+		if _, err := runDocker("network", "inspect", n); err != nil {
+			logf("Creating external network " + n)
+			if _, err := runDocker("network", "create", n); err != nil {
+				return fmt.Errorf("failed to create network %s: %v", n, err)
+			}
+		}
+	}
+
+	// Volumes are filled before anything starts on them
+	for _, v := range m.Volumes {
+		target := plan.volumes[v.Key]
+		if v.File == "" || target == "" {
+			continue
+		}
+		if volumeExists(target) {
+			return fmt.Errorf("volume %s already exists on this server", target)
+		}
+		args := []string{"volume", "create"}
+		if !plan.external[v.Key] {
+			args = append(args, "--label", composeProjectLabel+"="+name, "--label", composeVolumeLabel+"="+v.Key)
+		}
+		if _, err := runDocker(append(args, target)...); err != nil {
+			return fmt.Errorf("failed to create volume %s: %v", target, err)
+		}
+		logf(fmt.Sprintf("Restoring volume %s...", target))
+		if err := loadVolume(target, filepath.Join(dir, v.File)); err != nil {
+			return fmt.Errorf("failed to restore volume %s: %v", target, err)
+		}
+	}
+
+	p := getOrCreateProject(name)
+	if isSourceProject(p) {
+		if err := deployFromSource(ctx, name, user, logf); err != nil {
+			return err
+		}
+	} else if err := composeUp(ctx, name, logf); err != nil {
+		return err
+	}
+
+	if len(m.Databases) > 0 {
+		containers, err := inspectProjectContainers(name)
+		if err != nil {
+			return err
+		}
+		engines := map[string]*databaseEngine{}
+		for _, e := range []*databaseEngine{&postgresEngine, &mysqlEngine, &mongoEngine} {
+			engines[e.Name] = e
+		}
+		restored, others := map[string]bool{}, []string{}
+		for _, d := range m.Databases {
+			engine := engines[d.Engine]
+			if engine == nil {
+				return fmt.Errorf("unknown database engine %s for service %s", d.Engine, d.Service)
+			}
+			for _, ct := range containers {
+				if ct.Config.Labels[composeServiceLabel] != d.Service || restored[d.Service] {
+					continue
+				}
+				logf(fmt.Sprintf("Restoring %s database of service %s...", engine.Name, d.Service))
+				if err := waitDatabaseReady(ct.ID, engine); err != nil {
+					return fmt.Errorf("database of service %s: %v", d.Service, err)
+				}
+				if err := restoreDatabase(ct.ID, engine, filepath.Join(dir, d.File), logf); err != nil {
+					return fmt.Errorf("failed to restore database of service %s: %v", d.Service, err)
+				}
+				restored[d.Service] = true
+			}
+		}
+		for _, ct := range containers {
+			service := ct.Config.Labels[composeServiceLabel]
+			if !restored[service] && !containsString(others, service) {
+				others = append(others, service)
+			}
+		}
+		// Apps that connected to the empty database start again on the restored one
+		if len(others) > 0 {
+			if err := streamCompose(ctx, name, logf, append([]string{"restart"}, others...)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	syncProjectStatus(name)
+	if !isSourceProject(p) {
+		recordDeploymentLogged(name, user, "import", "bundle of "+m.Project)
+	}
+	for _, d := range plan.domains {
+		logf("Serving on https://" + d)
+	}
+	return nil
+}
+
+func loadVolume(name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cmd := exec.Command("docker", "run", "--rm", "-i", "--network", "none", "-v", name+":/data",
+		volumeHelperImage, "tar", "-C", "/data", "-xf", "-")
+	cmd.Stdin = f
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// restoreDatabase feeds a dump file to a database container
+func restoreDatabase(container string, engine *databaseEngine, path string, logf JobLogger) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var out strings.Builder
+	cmd := exec.Command("docker", "exec", "-i", container, "sh", "-c", engine.Restore)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = f, &out, &out
+	err = cmd.Run()
+	logRestoreOutput(out.String(), logf)
+	return err
+}
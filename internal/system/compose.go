@@ -0,0 +1,463 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+// ComposeFile is the subset of the compose specification the panel writes.
+// It is serialized with a YAML library so values are always quoted and
+// escaped correctly, whatever they contain.
+type ComposeFile struct {
+	Services map[string]*ComposeService `yaml:"services"`
+	Networks map[string]*ComposeNetwork `yaml:"networks,omitempty"`
+	Volumes  map[string]*ComposeVolume  `yaml:"volumes,omitempty"`
+}
+
+type ComposeService struct {
+	Image          string            `yaml:"image,omitempty"`
+	Build          *ComposeBuild     `yaml:"build,omitempty"`
+	Command        []string          `yaml:"command,omitempty"`
+	Ports          []ComposePort     `yaml:"ports,omitempty"`
+	Environment    map[string]string `yaml:"environment,omitempty"`
+	EnvFile        []string          `yaml:"env_file,omitempty"`
+	Volumes        []string          `yaml:"volumes,omitempty"`
+	DependsOn      []string          `yaml:"depends_on,omitempty"`
+	Restart        string            `yaml:"restart,omitempty"`
+	CPUs           float64           `yaml:"cpus,omitempty"`
+	MemLimit       string            `yaml:"mem_limit,omitempty"`
+	MemReservation string            `yaml:"mem_reservation,omitempty"`
+	PidsLimit      int               `yaml:"pids_limit,omitempty"`
+	Networks       []string          `yaml:"networks,omitempty"`
+	Labels         map[string]string `yaml:"labels,omitempty"`
+}
+
+type ComposeBuild struct {
+	Context    string `yaml:"context"`
+	Dockerfile string `yaml:"dockerfile,omitempty"`
+}
+
+// ComposePort uses the long port syntax, which YAML can never misread as a
+// number the way it can the short "80:80" form.
+type ComposePort struct {
+	Target    int    `yaml:"target"`
+	Published string `yaml:"published,omitempty"`
+	HostIP    string `yaml:"host_ip,omitempty"`
+	Protocol  string `yaml:"protocol,omitempty"`
+}
+
+type ComposeNetwork struct {
+	Name     string `yaml:"name,omitempty"`
+	External bool   `yaml:"external,omitempty"`
+}
+
+type ComposeVolume struct {
+	Name     string `yaml:"name,omitempty"`
+	External bool   `yaml:"external,omitempty"`
+}
+
+var (
+	composeNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+	envKeyRe      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	labelKeyRe    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]*$`)
+	domainRe      = regexp.MustCompile(`^(\*\.)?([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+)
+
+// ParsePorts reads a comma separated list of port mappings. Each entry is
+// "80" (same port on both sides), "8080:80", "127.0.0.1:8080:80", or any of
+// those followed by "/udp".
+func ParsePorts(spec string) ([]ComposePort, error) {
+	ports := []ComposePort{}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		p := ComposePort{}
+		if i := strings.LastIndex(entry, "/"); i >= 0 {
+			p.Protocol = entry[i+1:]
+			entry = entry[:i]
+		}
+		parts := strings.Split(entry, ":")
+		var host, target string
+		switch len(parts) {
+		case 1:
+			host, target = parts[0], parts[0]
+		case 2:
+			host, target = parts[0], parts[1]
+		case 3:
+			p.HostIP, host, target = parts[0], parts[1], parts[2]
+		default:
+			return nil, fmt.Errorf("invalid port mapping %q", entry)
+		}
+		t, err := parsePortNumber(target)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parsePortNumber(host); err != nil {
+			return nil, err
+		}
+		p.Target, p.Published = t, host
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		ports = append(ports, p)
+	}
+	return ports, nil
+}
+
+func parsePortNumber(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %q, must be 1-65535", s)
+	}
+	return n, nil
+}
+
+func (p ComposePort) Validate() error {
+	if p.Target < 1 || p.Target > 65535 {
+		return fmt.Errorf("invalid container port %d, must be 1-65535", p.Target)
+	}
+	if p.Published != "" {
+		if _, err := parsePortNumber(p.Published); err != nil {
+			return err
+		}
+	}
+	if p.HostIP != "" && net.ParseIP(p.HostIP) == nil {
+		return fmt.Errorf("invalid host ip %q", p.HostIP)
+	}
+	switch p.Protocol {
+	case "", "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("invalid port protocol %q", p.Protocol)
+	}
+	return nil
+}
+
+// ValidateDomain checks a host name before it is put into a Traefik rule
+func ValidateDomain(d string) error {
+	if len(d) > 253 || !domainRe.MatchString(d) {
+		return fmt.Errorf("invalid domain %q", d)
+	}
+	return nil
+}
+
+// Validate checks names, ports, env keys and labels of every service, and
+// that services only reference networks the file declares.
+func (f *ComposeFile) Validate() error {
+	if len(f.Services) == 0 {
+		return fmt.Errorf("compose file has no services")
+	}
+	for name, svc := range f.Services {
+		if !composeNameRe.MatchString(name) {
+			return fmt.Errorf("invalid service name %q", name)
+		}
+		if svc == nil {
+			return fmt.Errorf("service %s is empty", name)
+		}
+		if svc.Image == "" && svc.Build == nil {
+			return fmt.Errorf("service %s needs an image or a build", name)
+		}
+		if svc.Image != "" {
+			if err := validRef(svc.Image); err != nil {
+				return fmt.Errorf("service %s: %v", name, err)
+			}
+		}
+		for _, p := range svc.Ports {
+			if err := p.Validate(); err != nil {
+				return fmt.Errorf("service %s: %v", name, err)
+			}
+		}
+		for k := range svc.Environment {
+			if !envKeyRe.MatchString(k) {
+				return fmt.Errorf("service %s: invalid environment variable name %q", name, k)
+			}
+		}
+		for k, v := range svc.Labels {
+			if !labelKeyRe.MatchString(k) {
+				return fmt.Errorf("service %s: invalid label %q", name, k)
+			}
+			if strings.ContainsAny(v, "\r\n") {
+				return fmt.Errorf("service %s: label %s cannot contain a newline", name, k)
+			}
+		}
+		for _, n := range svc.Networks {
+			if n == "default" {
+				continue
+			}
+			if _, ok := f.Networks[n]; !ok {
+				return fmt.Errorf("service %s uses undeclared network %s", name, n)
+			}
+		}
+		for _, d := range svc.DependsOn {
+			if _, ok := f.Services[d]; !ok {
+				return fmt.Errorf("service %s depends on unknown service %s", name, d)
+			}
+		}
+		if err := (ServiceResources{CPUs: svc.CPUs, Memory: svc.MemLimit,
+			MemoryReservation: svc.MemReservation, PidsLimit: svc.PidsLimit}).Validate(); err != nil {
+			return fmt.Errorf("service %s: %v", name, err)
+		}
+	}
+	for name := range f.Networks {
+		if !composeNameRe.MatchString(name) {
+			return fmt.Errorf("invalid network name %q", name)
+		}
+	}
+	for name := range f.Volumes {
+		if !composeNameRe.MatchString(name) {
+			return fmt.Errorf("invalid volume name %q", name)
+		}
+	}
+	return nil
+}
+
+// Marshal validates the file and serializes it
+func (f *ComposeFile) Marshal() ([]byte, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return yaml.MarshalWithOptions(f, yaml.IndentSequence(true), yaml.CustomMarshaler[string](marshalComposeString))
+}
+
+// marshalComposeString writes multi-line strings double-quoted: block
+// scalars would drop carriage returns and the final newline
+func marshalComposeString(s string) ([]byte, error) {
+	if strings.ContainsAny(s, "\r\n") {
+		return []byte(strconv.Quote(s)), nil
+	}
+	return yaml.Marshal(s)
+}
+
+// escapeComposeValue stops compose from interpolating "$" in literal values
+func escapeComposeValue(v string) string {
+	return strings.ReplaceAll(v, "$", "$$")
+}
+
+// traefikLabels routes the given domains to a service over HTTPS
+func traefikLabels(router string, domains []string, port int) map[string]string {
+	rules := make([]string, len(domains))
+	for i, d := range domains {
+		rules[i] = "Host(`" + d + "`)"
+	}
+	labels := map[string]string{
+		"traefik.enable":                                       "true",
+		"traefik.docker.network":                               TraefikNetwork,
+		"traefik.http.routers." + router + ".rule":             strings.Join(rules, " || "),
+		"traefik.http.routers." + router + ".entrypoints":      "websecure",
+		"traefik.http.routers." + router + ".tls.certresolver": "myresolver",
+	}
+	if port > 0 {
+		labels["traefik.http.services."+router+".loadbalancer.server.port"] = strconv.Itoa(port)
+	}
+	return labels
+}
+
+var composeTopLevelKeys = []string{"version", "name", "services", "networks", "volumes", "configs", "secrets", "include"}
+
+// ParseComposeDocument parses a compose file written outside the panel and
+// validates the parts the panel relies on, keeping every key and its order
+// so the document can be rewritten without losing anything.
+func ParseComposeDocument(content []byte) (yaml.MapSlice, error) {
+	var doc yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()); err != nil {
+		return nil, fmt.Errorf("invalid YAML: %v", err)
+	}
+	for _, item := range doc {
+		key := fmt.Sprint(item.Key)
+		if !containsString(composeTopLevelKeys, key) && !strings.HasPrefix(key, "x-") {
+			return nil, fmt.Errorf("unknown top-level key %q", key)
+		}
+	}
+
+	services, ok := mapValue(doc, "services").(yaml.MapSlice)
+	if !ok || len(services) == 0 {
+		return nil, fmt.Errorf("compose file has no services")
+	}
+	names := map[string]bool{}
+	for _, svc := range services {
+		names[fmt.Sprint(svc.Key)] = true
+	}
+	networks, _ := mapValue(doc, "networks").(yaml.MapSlice)
+
+	for _, svc := range services {
+		name := fmt.Sprint(svc.Key)
+		if !composeNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid service name %q", name)
+		}
+		def, ok := svc.Value.(yaml.MapSlice)
+		if !ok {
+			return nil, fmt.Errorf("service %s must be a mapping", name)
+		}
+		if mapValue(def, "image") == nil && mapValue(def, "build") == nil && mapValue(def, "extends") == nil {
+			return nil, fmt.Errorf("service %s needs an image or a build", name)
+		}
+		if err := validateServiceDocument(def, names, networks); err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+	}
+	return doc, nil
+}
+
+func validateServiceDocument(def yaml.MapSlice, services map[string]bool, networks yaml.MapSlice) error {
+	if ports, ok := mapValue(def, "ports").([]interface{}); ok {
+		for _, p := range ports {
+			if err := validatePortEntry(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch env := mapValue(def, "environment").(type) {
+	case yaml.MapSlice:
+		for _, item := range env {
+			if k := fmt.Sprint(item.Key); !envKeyRe.MatchString(k) {
+				return fmt.Errorf("invalid environment variable name %q", k)
+			}
+		}
+	case []interface{}:
+		for _, e := range env {
+			k, _, _ := strings.Cut(fmt.Sprint(e), "=")
+			if !envKeyRe.MatchString(k) {
+				return fmt.Errorf("invalid environment variable name %q", k)
+			}
+		}
+	}
+
+	labels := map[string]string{}
+	switch l := mapValue(def, "labels").(type) {
+	case yaml.MapSlice:
+		for _, item := range l {
+			labels[fmt.Sprint(item.Key)] = fmt.Sprint(item.Value)
+		}
+	case []interface{}:
+		for _, e := range l {
+			k, v, _ := strings.Cut(fmt.Sprint(e), "=")
+			labels[k] = v
+		}
+	}
+	for k, v := range labels {
+		if !labelKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid label %q", k)
+		}
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("label %s cannot contain a newline", k)
+		}
+	}
+
+	var used []string
+	switch n := mapValue(def, "networks").(type) {
+	case yaml.MapSlice:
+		for _, item := range n {
+			used = append(used, fmt.Sprint(item.Key))
+		}
+	case []interface{}:
+		for _, item := range n {
+			used = append(used, fmt.Sprint(item))
+		}
+	}
+	for _, n := range used {
+		if n != "default" && !mapHasKey(networks, n) {
+			return fmt.Errorf("uses undeclared network %s", n)
+		}
+	}
+
+	var deps []string
+	switch d := mapValue(def, "depends_on").(type) {
+	case yaml.MapSlice:
+		for _, item := range d {
+			deps = append(deps, fmt.Sprint(item.Key))
+		}
+	case []interface{}:
+		for _, item := range d {
+			deps = append(deps, fmt.Sprint(item))
+		}
+	}
+	for _, d := range deps {
+		if !services[d] {
+			return fmt.Errorf("depends on unknown service %s", d)
+		}
+	}
+	return nil
+}
+
+// validatePortEntry accepts the short ("8080:80/tcp", ranges, variables) and
+// long port syntax
+func validatePortEntry(entry interface{}) error {
+	if long, ok := entry.(yaml.MapSlice); ok {
+		target, err := strconv.Atoi(fmt.Sprint(mapValue(long, "target")))
+		if err != nil {
+			return fmt.Errorf("port entry needs a numeric target")
+		}
+		p := ComposePort{Target: target}
+		if v := mapValue(long, "published"); v != nil {
+			p.Published = fmt.Sprint(v)
+		}
+		if v := mapValue(long, "host_ip"); v != nil {
+			p.HostIP = fmt.Sprint(v)
+		}
+		if v := mapValue(long, "protocol"); v != nil {
+			p.Protocol = fmt.Sprint(v)
+		}
+		if strings.Contains(p.Published, "-") || strings.Contains(p.Published, "$") {
+			p.Published = ""
+		}
+		return p.Validate()
+	}
+
+	s := fmt.Sprint(entry)
+	if strings.Contains(s, "$") {
+		return nil // resolved by compose from the .env file
+	}
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		switch s[i+1:] {
+		case "tcp", "udp", "sctp":
+		default:
+			return fmt.Errorf("invalid port protocol in %q", s)
+		}
+		s = s[:i]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) > 3 {
+		// IPv6 host addresses are written in brackets: [::1]:8080:80
+		if j := strings.LastIndex(s, "]:"); strings.HasPrefix(s, "[") && j > 0 {
+			parts = append([]string{s[1:j]}, strings.Split(s[j+2:], ":")...)
+		}
+	}
+	if len(parts) == 3 {
+		if net.ParseIP(strings.Trim(parts[0], "[]")) == nil {
+			return fmt.Errorf("invalid host ip in port %q", s)
+		}
+		parts = parts[1:]
+	}
+	if len(parts) > 2 {
+		return fmt.Errorf("invalid port mapping %q", s)
+	}
+	for _, part := range parts {
+		lo, hi, isRange := strings.Cut(part, "-")
+		if _, err := parsePortNumber(lo); err != nil {
+			return err
+		}
+		if isRange {
+			if _, err := parsePortNumber(hi); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mapHasKey(m yaml.MapSlice, key string) bool {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestGenerateComposeFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		app     App
+		env     map[string]string
+		secrets bool
+	}{
+		{
+			name: "basic",
+			app:  App{ID: "web", Image: "nginx:1.27", Ports: "8080:80"},
+		},
+		{
+			name: "env_escaping",
+			app:  App{ID: "notes", Image: "example/notes:latest", Env: []string{"MOTD", "GREETING", "PRICE", "EMPTY"}},
+			env: map[string]string{
+				"MOTD":     "line one\nline two\r\nline three",
+				"GREETING": `say "hi" and 'bye' # not a comment: {ok} [yes]`,
+				"PRICE":    "$5 or ${PRICE:-10} or $$",
+			},
+		},
+		{
+			name: "multi_port",
+			app:  App{ID: "dns", Image: "example/dns", Ports: " 53:53/udp, 127.0.0.1:8053:80 ,9000 ,"},
+		},
+		{
+			name: "domains",
+			app:  App{ID: "blog", Image: "ghost:5", Ports: "2368", Domains: []string{"blog.example.com", "www.example.com"}},
+		},
+		{
+			name:    "secrets",
+			app:     App{ID: "db", Image: "postgres:16", Env: []string{"POSTGRES_USER", "POSTGRES_PASSWORD"}},
+			env:     map[string]string{"POSTGRES_USER": "app", "POSTGRES_PASSWORD": "p@ss$word"},
+			secrets: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := generateComposeFile(tt.app, tt.env, tt.secrets)
+			if err != nil {
+				t.Fatalf("generateComposeFile: %v", err)
+			}
+			golden := filepath.Join("testdata", tt.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("compose file differs from %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+// The values must come back from the YAML exactly as compose needs them,
+// whatever characters they hold
+func TestGenerateComposeFileEnvRoundTrip(t *testing.T) {
+	env := map[string]string{
+		"MOTD":     "line one\nline two\r\n",
+		"GREETING": `"quoted" 'single' \backslash\ key: value`,
+		"PRICE":    "$5 ${HOME} $$",
+	}
+	app := App{ID: "roundtrip", Image: "busybox", Env: []string{"MOTD", "GREETING", "PRICE"}}
+	content, err := generateComposeFile(app, env, false)
+	if err != nil {
+		t.Fatalf("generateComposeFile: %v", err)
+	}
+	var file ComposeFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		t.Fatalf("generated file does not parse: %v\n%s", err, content)
+	}
+	svc := file.Services["roundtrip"]
+	if svc == nil {
+		t.Fatalf("service missing from\n%s", content)
+	}
+	for key, value := range env {
+		got := strings.ReplaceAll(svc.Environment[key], "$$", "$")
+		if got != value {
+			t.Errorf("%s = %q after compose unescaping, want %q", key, got, value)
+		}
+	}
+}
+
+func TestGenerateComposeFileRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		app  App
+		want string
+	}{
+		{"empty name", App{ID: "", Image: "nginx"}, "invalid service name"},
+		{"name with slash", App{ID: "../etc", Image: "nginx"}, "invalid service name"},
+		{"name with leading dash", App{ID: "-web", Image: "nginx"}, "invalid service name"},
+		{"name with space", App{ID: "my app", Image: "nginx"}, "invalid service name"},
+		{"env key", App{ID: "web", Image: "nginx", Env: []string{"BAD-KEY"}}, "invalid environment variable name"},
+		{"port zero", App{ID: "web", Image: "nginx", Ports: "0"}, "invalid port"},
+		{"port too large", App{ID: "web", Image: "nginx", Ports: "8080:70000"}, "invalid port"},
+		{"host port not a number", App{ID: "web", Image: "nginx", Ports: "http:80"}, "invalid port"},
+		{"too many parts", App{ID: "web", Image: "nginx", Ports: "1:2:3:4"}, "invalid port mapping"},
+		{"bad host ip", App{ID: "web", Image: "nginx", Ports: "300.0.0.1:80:80"}, "invalid host ip"},
+		{"bad protocol", App{ID: "web", Image: "nginx", Ports: "80/icmp"}, "invalid port protocol"},
+		{"bad domain", App{ID: "web", Image: "nginx", Domains: []string{"exa mple.com"}}, "invalid domain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, err := generateComposeFile(tt.app, nil, false)
+			if err == nil {
+				t.Fatalf("accepted, generated:\n%s", content)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+}
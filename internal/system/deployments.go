@@ -0,0 +1,242 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+)
+
+// RecordDeployment snapshots what a project runs right now: its compose
+// file, .env, git revision and the exact image of every service.
+func RecordDeployment(project, user, trigger, detail string) (database.Deployment, error) {
+	d := database.Deployment{Project: project, Trigger: trigger, User: user, Detail: detail}
+	if database.DB == nil {
+		return d, fmt.Errorf("database not initialized")
+	}
+
+	compose, err := os.ReadFile(projectComposePath(project))
+	if err != nil {
+		return d, err
+	}
+	d.Compose = string(compose)
+	if env, err := os.ReadFile(filepath.Join(ProjectsRoot, project, ".env")); err == nil {
+		if d.EnvEncrypted, err = security.EncryptString(string(env)); err != nil {
+			return d, err
+		}
+		d.HasEnv = true
+	}
+	d.Revision = headRevision(project)
+
+	if d.Images, err = runningImages(project); err != nil {
+		return d, err
+	}
+	return d, database.DB.Create(&d).Error
+}
+
+// recordDeploymentLogged records a deployment from a background flow where
+// a failure to record must not fail the deployment itself
+func recordDeploymentLogged(project, user, trigger, detail string) {
+	if _, err := RecordDeployment(project, user, trigger, detail); err != nil {
+		log.Printf("Failed to record deployment of %s: %v", project, err)
+	}
+}
+
+// runningImages maps each service of a project to the image it runs, with
+// the registry digest when the image came from a registry
+func runningImages(project string) (map[string]database.DeployedImage, error) {
+	containers, err := inspectProjectContainers(project)
+	if err != nil {
+		return nil, err
+	}
+	images := map[string]database.DeployedImage{}
+	for _, ct := range containers {
+		service := ct.Config.Labels[composeServiceLabel]
+		if service == "" {
+			continue
+		}
+		if _, done := images[service]; done {
+			continue
+		}
+		img := database.DeployedImage{Image: ct.Config.Image, ID: ct.Image}
+		out, err := runDocker("image", "inspect", "--format", "{{json .RepoDigests}}", ct.Image)
+		if err == nil {
+			var digests []string
+			json.Unmarshal([]byte(out), &digests)
+			for _, d := range digests {
+				if imageRepo(d) == imageRepo(ct.Config.Image) {
+					img.Digest = d
+					break
+				}
+			}
+			if img.Digest == "" && len(digests) > 0 {
+				img.Digest = digests[0]
+			}
+		}
+		images[service] = img
+	}
+	return images, nil
+}
+
+func ListDeployments(project string, limit int) ([]database.Deployment, error) {
+	deployments := []database.Deployment{}
+	if database.DB == nil {
+		return deployments, fmt.Errorf("database not initialized")
+	}
+	err := database.DB.Where("project = ?", project).Order("id desc").Limit(limit).Find(&deployments).Error
+	return deployments, err
+}
+
+// DeployProject applies the project's current compose file: pulls, recreates
+// what changed, waits for the services to be healthy and records the result.
+// Projects built from source (git or upload) are rebuilt first.
+func DeployProject(project, user string) (Job, error) {
+	if _, err := os.Stat(filepath.Join(ProjectsRoot, project)); err != nil || !composeNameRe.MatchString(project) {
+		return Job{}, fmt.Errorf("project %s not found", project)
+	}
+	fromSource := isSourceProject(getOrCreateProject(project))
+	if _, err := os.Stat(projectComposePath(project)); err != nil && !fromSource {
+		return Job{}, fmt.Errorf("project %s has no docker-compose.yml", project)
+	}
+	jobType := "deploy"
+	if fromSource {
+		jobType = "build"
+	}
+	return enqueueJob(jobType, project, user, struct{}{}, deployTask(project, user)), nil
+}
+
+// deployTask is the work of a deploy job, looked up again when it runs so a
+// job queued behind a change of source type still does the right thing
+func deployTask(project, user string) jobTask {
+	return func(ctx context.Context, logf JobLogger) error {
+		if isSourceProject(getOrCreateProject(project)) {
+			return deployFromSource(ctx, project, user, logf)
+		}
+		RecordProjectChange(project, user, "Deploy", "docker-compose.yml")
+		setJobProgress(ctx, 10, "Pulling images")
+		if err := streamCompose(ctx, project, pullProgress(ctx, logf, 10, 50), "pull", "--ignore-buildable"); err != nil {
+			return err
+		}
+		setJobProgress(ctx, 50, "Starting containers")
+		if err := composeUp(ctx, project, logf); err != nil {
+			return err
+		}
+		setJobProgress(ctx, 70, "Waiting for services to become healthy")
+		logf("Waiting for services to become healthy...")
+		if err := waitProjectHealthy(ctx, project, updateHealthTimeout); err != nil {
+			return fmt.Errorf("deployment is not healthy: %v", err)
+		}
+		syncProjectStatus(project)
+		d, err := RecordDeployment(project, user, "deploy", "")
+		if err != nil {
+			logf("Warning: failed to record deployment: " + err.Error())
+		} else {
+			logf(fmt.Sprintf("Deployment #%d recorded", d.ID))
+		}
+		return nil
+	}
+}
+
+// RollbackProject restores the compose file and .env of a recorded
+// deployment, puts back the exact images it ran and recreates the services.
+func RollbackProject(project string, id uint, user string) (Job, error) {
+	if database.DB == nil {
+		return Job{}, fmt.Errorf("database not initialized")
+	}
+	var target database.Deployment
+	if err := database.DB.Where("id = ? AND project = ?", id, project).First(&target).Error; err != nil {
+		return Job{}, fmt.Errorf("deployment #%d not found for project %s", id, project)
+	}
+	env := ""
+	if target.HasEnv {
+		var err error
+		if env, err = security.DecryptString(target.EnvEncrypted); err != nil {
+			return Job{}, fmt.Errorf("cannot decrypt the .env of deployment #%d: %v", id, err)
+		}
+	}
+	return StartJob("rollback", project, user, func(ctx context.Context, logf JobLogger) error {
+		// Images first: if one is gone for good, leave the project untouched
+		for service, img := range target.Images {
+			switch {
+			case img.Digest != "":
+				logf(fmt.Sprintf("Restoring %s of service %s from %s", img.Image, service, img.Digest))
+				if err := streamImagePull(img.Digest, logf); err != nil {
+					return fmt.Errorf("failed to pull %s: %v", img.Digest, err)
+				}
+				if _, err := runDocker("image", "tag", img.Digest, img.Image); err != nil {
+					return err
+				}
+			case img.ID != "":
+				logf(fmt.Sprintf("Restoring %s of service %s from local image %s", img.Image, service, shortID(img.ID)))
+				if _, err := runDocker("image", "tag", img.ID, img.Image); err != nil {
+					return fmt.Errorf("image of service %s is no longer available: %v", service, err)
+				}
+			}
+		}
+
+		dir := filepath.Join(ProjectsRoot, project)
+		if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(target.Compose), 0644); err != nil {
+			return err
+		}
+		envPath := filepath.Join(dir, ".env")
+		if target.HasEnv {
+			if err := os.WriteFile(envPath, []byte(env), 0600); err != nil {
+				return err
+			}
+		} else {
+			os.Remove(envPath)
+		}
+		RecordProjectChange(project, user, fmt.Sprintf("Rollback to deployment #%d", id), "docker-compose.yml")
+
+		// --pull never keeps the tags we just pointed at the old digests
+		if err := composeUp(ctx, project, logf, "--pull", "never"); err != nil {
+			return err
+		}
+		logf("Waiting for services to become healthy...")
+		if err := waitProjectHealthy(ctx, project, updateHealthTimeout); err != nil {
+			go SendAlert(fmt.Sprintf("Rollback of project *%s* to deployment #%d is not healthy: %v", project, id, err))
+			return fmt.Errorf("rollback is not healthy: %v", err)
+		}
+		syncProjectStatus(project)
+
+		// An auto-update would undo the rollback in the next window
+		p := getOrCreateProject(project)
+		if p.UpdatePolicy == UpdatePolicyAuto && database.DB != nil {
+			database.DB.Model(&p).Update("update_policy", UpdatePolicyPinned)
+			logf("Update policy switched from auto to pinned to keep the rolled back images")
+		}
+
+		d, err := RecordDeployment(project, user, "rollback", fmt.Sprintf("rolled back to deployment #%d", id))
+		if err != nil {
+			logf("Warning: failed to record deployment: " + err.Error())
+		} else {
+			logf(fmt.Sprintf("Rolled back to deployment #%d (recorded as #%d)", id, d.ID))
+		}
+		return nil
+	}), nil
+}
+
+// streamImagePull pulls an image with registry credentials, logging progress
+func streamImagePull(ref string, logf JobLogger) error {
+	return PullImage(ref, func(p PullProgress) {
+		// Layer lines repeat for every chunk; only keep the summary ones
+		if p.Layer == "" {
+			logf(p.Status)
+		}
+	})
+}
+
+func shortID(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,161 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// DiskUsageTotal is one row of `docker system df`
+type DiskUsageTotal struct {
+	Type        string `json:"type"`
+	TotalCount  string `json:"total_count"`
+	Active      string `json:"active"`
+	Size        string `json:"size"`
+	Reclaimable string `json:"reclaimable"`
+}
+
+// ProjectDiskUsage is the space attributed to one compose project
+type ProjectDiskUsage struct {
+	Project    string `json:"project"`
+	Images     int64  `json:"images"`
+	Containers int64  `json:"containers"`
+	Volumes    int64  `json:"volumes"`
+	Total      int64  `json:"total"`
+	TotalHuman string `json:"total_human"`
+}
+
+// DiskUsageReport is `docker system df -v` broken down per project
+type DiskUsageReport struct {
+	Totals     []DiskUsageTotal   `json:"totals"`
+	Projects   []ProjectDiskUsage `json:"projects"`
+	Unassigned ProjectDiskUsage   `json:"unassigned"`
+	BuildCache int64              `json:"build_cache"`
+}
+
+func GetDiskUsage() (DiskUsageReport, error) {
+	report := DiskUsageReport{Totals: []DiskUsageTotal{}, Projects: []ProjectDiskUsage{}}
+
+	output, err := runDocker("system", "df", "--format", "{{json .}}")
+	if err != nil {
+		return report, err
+	}
+	for _, line := range splitLines(output) {
+		var row struct {
+			Type        string `json:"Type"`
+			TotalCount  string `json:"TotalCount"`
+			Active      string `json:"Active"`
+			Size        string `json:"Size"`
+			Reclaimable string `json:"Reclaimable"`
+		}
+		if json.Unmarshal([]byte(line), &row) != nil {
+			continue
+		}
+		report.Totals = append(report.Totals, DiskUsageTotal(row))
+		if row.Type == "Build Cache" {
+			report.BuildCache = parseHumanSize(row.Size)
+		}
+	}
+
+	usage := map[string]*ProjectDiskUsage{}
+	get := func(project string) *ProjectDiskUsage {
+		if project == "" {
+			return &report.Unassigned
+		}
+		if usage[project] == nil {
+			usage[project] = &ProjectDiskUsage{Project: project}
+		}
+		return usage[project]
+	}
+
+	images, err := ListImages()
+	if err != nil {
+		return report, err
+	}
+	owners, err := imageOwners(images)
+	if err != nil {
+		return report, err
+	}
+	for _, img := range images {
+		get(owners[img.ID]).Images += img.Size
+	}
+
+	// Writable layer size of each container: "2B (virtual 187MB)"
+	output, err = runDocker("ps", "-a", "--size", "--format",
+		"{{.Label \""+composeProjectLabel+"\"}}|{{.Size}}")
+	if err != nil {
+		return report, err
+	}
+	for _, line := range splitLines(output) {
+		parts := strings.SplitN(line, "|", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		size := parts[1]
+		if idx := strings.Index(size, " ("); idx >= 0 {
+			size = size[:idx]
+		}
+		get(parts[0]).Containers += parseHumanSize(size)
+	}
+
+	volumes, err := ListVolumes()
+	if err != nil {
+		return report, err
+	}
+	for _, v := range volumes {
+		get(v.Project).Volumes += v.Size
+	}
+
+	for _, u := range usage {
+		u.Total = u.Images + u.Containers + u.Volumes
+		u.TotalHuman = formatBytes(u.Total)
+		report.Projects = append(report.Projects, *u)
+	}
+	report.Unassigned.Total = report.Unassigned.Images + report.Unassigned.Containers + report.Unassigned.Volumes
+	report.Unassigned.TotalHuman = formatBytes(report.Unassigned.Total)
+	sort.Slice(report.Projects, func(i, j int) bool { return report.Projects[i].Total > report.Projects[j].Total })
+	return report, nil
+}
+
+// imageOwners attributes every image to a project. Besides the compose label,
+// an image belongs to a project when it shares a repository with one of the
+// project's containers, which also catches old versions left untagged by a pull.
+func imageOwners(images []ImageInfo) (map[string]string, error) {
+	containers, err := inspectAllContainers()
+	if err != nil {
+		return nil, err
+	}
+	repoProject := map[string]string{}
+	for _, ct := range containers {
+		if p := ct.Config.Labels[composeProjectLabel]; p != "" {
+			repoProject[imageRepo(ct.Config.Image)] = p
+		}
+	}
+
+	owners := map[string]string{}
+	for _, img := range images {
+		if img.Project != "" {
+			owners[img.ID] = img.Project
+			continue
+		}
+		for _, ref := range append(append([]string{}, img.Tags...), img.Digests...) {
+			if p := repoProject[imageRepo(ref)]; p != "" {
+				owners[img.ID] = p
+				break
+			}
+		}
+	}
+	return owners, nil
+}
+
+// imageRepo strips the tag or digest from an image reference
+func imageRepo(ref string) string {
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		ref = ref[:idx]
+	}
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		ref = ref[:idx]
+	}
+	return ref
+}
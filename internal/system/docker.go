@@ -0,0 +1,218 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runDocker runs a docker CLI command and returns trimmed stdout. Stderr is
+// folded into the error so handlers can surface the real docker message.
+func runDocker(args ...string) (string, error) {
+	cmd := exec.Command("docker", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return strings.TrimSpace(string(output)), fmt.Errorf("docker %s: %s", args[0], msg)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// streamCommand runs cmd and hands every stdout/stderr line to onLine as it
+// is produced, for pull and compose output that is shown live.
+func streamCommand(cmd *exec.Cmd, onLine func(string)) error {
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+
+	done := make(chan struct{})
+	var lastLine string
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(pr)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				continue
+			}
+			lastLine = line
+			if onLine != nil {
+				onLine(line)
+			}
+		}
+		io.Copy(io.Discard, pr)
+	}()
+
+	err := cmd.Wait()
+	pw.Close()
+	<-done
+	if err != nil && lastLine != "" {
+		return fmt.Errorf("%v: %s", err, lastLine)
+	}
+	return err
+}
+
+// splitLines drops empty lines from CLI output
+func splitLines(s string) []string {
+	result := []string{}
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+const composeProjectLabel = "com.docker.compose.project"
+const composeServiceLabel = "com.docker.compose.service"
+const composeVolumeLabel = "com.docker.compose.volume"
+const composeWorkingDirLabel = "com.docker.compose.project.working_dir"
+
+// containerInspect is the subset of `docker container inspect` the panel reads
+type containerInspect struct {
+	ID           string `json:"Id"`
+	Name         string `json:"Name"`
+	Image        string `json:"Image"`
+	RestartCount int    `json:"RestartCount"`
+	State        struct {
+		Status    string `json:"Status"`
+		Running   bool   `json:"Running"`
+		StartedAt string `json:"StartedAt"`
+		Health    *struct {
+			Status        string `json:"Status"`
+			FailingStreak int    `json:"FailingStreak"`
+		} `json:"Health"`
+	} `json:"State"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	Mounts []struct {
+		Type        string `json:"Type"`
+		Name        string `json:"Name"`
+		Source      string `json:"Source"`
+		Destination string `json:"Destination"`
+	} `json:"Mounts"`
+}
+
+// inspectAllContainers returns every container on the host, running or not
+func inspectAllContainers() ([]containerInspect, error) {
+	return inspectContainers("ps", "-a", "-q", "--no-trunc")
+}
+
+// inspectProjectContainers returns the containers of one compose project
+func inspectProjectContainers(project string) ([]containerInspect, error) {
+	return inspectContainers("ps", "-a", "-q", "--no-trunc", "--filter", "label="+composeProjectLabel+"="+project)
+}
+
+func inspectContainers(psArgs ...string) ([]containerInspect, error) {
+	ids, err := runDocker(psArgs...)
+	if err != nil {
+		return nil, err
+	}
+	idList := splitLines(ids)
+	if len(idList) == 0 {
+		return []containerInspect{}, nil
+	}
+	output, err := runDocker(append([]string{"container", "inspect"}, idList...)...)
+	if err != nil {
+		return nil, err
+	}
+	var containers []containerInspect
+	if err := json.Unmarshal([]byte(output), &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// composeCmd builds a `docker compose` command running inside a project
+// directory. The project's secrets file is written first: compose fails on
+// a missing env file, and the file is gone after the panel is reinstalled.
+// The command is killed when ctx is done.
+func composeCmd(ctx context.Context, project string, args ...string) *exec.Cmd {
+	if err := syncSecretsEnv(project); err != nil {
+		log.Printf("Failed to write the secrets file of %s: %v", project, err)
+	}
+	cmd := exec.CommandContext(ctx, "docker", append([]string{"compose"}, args...)...)
+	cmd.Dir = filepath.Join(ProjectsRoot, project)
+	return cmd
+}
+
+// runCompose runs a compose command with registry credentials available
+func runCompose(project string, args ...string) (string, error) {
+	cmd := composeCmd(context.Background(), project, args...)
+	var output []byte
+	err := withRegistryAuth(cmd, func() error {
+		var err error
+		output, err = cmd.CombinedOutput()
+		return err
+	})
+	if err != nil {
+		return string(output), fmt.Errorf("docker compose %s failed: %v, output: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+	return string(output), nil
+}
+
+// parseHumanSize converts docker's decimal sizes ("1.5GB", "512kB") to bytes
+func parseHumanSize(s string) int64 {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"kB", 1e3}, {"KB", 1e3}, {"B", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+			if err != nil {
+				return 0
+			}
+			return int64(v * u.mult)
+		}
+	}
+	v, _ := strconv.ParseFloat(s, 64)
+	return int64(v)
+}
+
+// formatBytes renders a byte count the way docker does
+func formatBytes(n int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	v := float64(n)
+	i := 0
+	for v >= 1000 && i < len(units)-1 {
+		v /= 1000
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", v, units[i])
+}
+
+// validRef rejects empty names and anything the docker CLI would read as a flag
+func validRef(ref string) error {
+	if ref == "" || strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\n") {
+		return fmt.Errorf("invalid reference: %q", ref)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+)
+
+// DockerEvent is one line of `docker events --format '{{json .}}'`
+type DockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		ID         string            `json:"ID"`
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+	Time int64 `json:"time"`
+}
+
+const (
+	crashLoopWindow    = 5 * time.Minute
+	crashLoopThreshold = 3
+	alertCooldown      = 15 * time.Minute
+	recentEventsSize   = 200
+)
+
+// watchedEvents are the container actions the watcher subscribes to
+var watchedEvents = []string{"create", "start", "restart", "die", "stop", "kill", "oom", "pause", "unpause", "destroy", "health_status"}
+
+var (
+	eventsMu     sync.Mutex
+	recentEvents []string
+	crashTimes   = map[string][]time.Time{}
+	lastAlert    = map[string]time.Time{}
+	watcherOnce  sync.Once
+)
+
+// StartEventWatcher keeps a `docker events` subscription open for the
+// lifetime of the panel, reconnecting with backoff whenever it drops.
+func StartEventWatcher() {
+	watcherOnce.Do(func() {
+		go func() {
+			backoff := time.Second
+			for {
+				started := time.Now()
+				if err := watchEvents(); err != nil {
+					log.Printf("Docker event watcher stopped: %v", err)
+				}
+				if time.Since(started) > time.Minute {
+					backoff = time.Second
+				}
+				time.Sleep(backoff)
+				if backoff < time.Minute {
+					backoff *= 2
+				}
+			}
+		}()
+	})
+}
+
+func watchEvents() error {
+	args := []string{"events", "--format", "{{json .}}", "--filter", "type=container"}
+	for _, e := range watchedEvents {
+		args = append(args, "--filter", "event="+e)
+	}
+	cmd := exec.Command("docker", args...)
+	return streamCommand(cmd, func(line string) {
+		var ev DockerEvent
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			return
+		}
+		handleEvent(ev)
+	})
+}
+
+func handleEvent(ev DockerEvent) {
+	attrs := ev.Actor.Attributes
+	project := attrs[composeProjectLabel]
+	name := attrs["name"]
+	when := time.Unix(ev.Time, 0)
+
+	// health_status arrives as "health_status: unhealthy"
+	action, detail := ev.Action, ""
+	if idx := strings.Index(action, ": "); idx > 0 {
+		action, detail = action[:idx], action[idx+2:]
+	}
+
+	line := fmt.Sprintf("%s container %s %s", when.Format("2006-01-02 15:04:05"), name, ev.Action)
+	if code := attrs["exitCode"]; code != "" {
+		line += " (exit " + code + ")"
+	}
+	if project != "" {
+		line += " [" + project + "]"
+	}
+	eventsMu.Lock()
+	recentEvents = append(recentEvents, line)
+	if len(recentEvents) > recentEventsSize {
+		recentEvents = recentEvents[len(recentEvents)-recentEventsSize:]
+	}
+	if action == "destroy" {
+		// A removed container never crashes again; its name may be reused
+		delete(crashTimes, name)
+		delete(lastAlert, "oom:"+name)
+		delete(lastAlert, "crashloop:"+name)
+	}
+	eventsMu.Unlock()
+
+	if project == "" {
+		return
+	}
+
+	switch action {
+	case "die", "oom", "restart", "health_status":
+		recordProjectEvent(database.ProjectEvent{
+			Project:   project,
+			Container: name,
+			Service:   attrs[composeServiceLabel],
+			Action:    action,
+			ExitCode:  attrs["exitCode"],
+			Detail:    detail,
+			Time:      when,
+		})
+	}
+
+	switch action {
+	case "oom":
+		alertOnce("oom:"+name, fmt.Sprintf("Container *%s* of project *%s* was OOM-killed.", name, project))
+	case "die":
+		if code := attrs["exitCode"]; code != "" && code != "0" && trackCrash(name, when) {
+			alertOnce("crashloop:"+name, fmt.Sprintf("Container *%s* of project *%s* is crash-looping (%d exits in %s, last exit code %s).",
+				name, project, crashLoopThreshold, crashLoopWindow, code))
+		}
+	}
+
+	if action != "create" {
+		syncProjectStatus(project)
+	}
+}
+
+// trackCrash records a non-zero exit and reports whether the container has
+// crossed the crash-loop threshold inside the window. Containers whose last
+// crash left the window are forgotten.
+func trackCrash(container string, at time.Time) bool {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+
+	for name, times := range crashTimes {
+		if len(times) == 0 || at.Sub(times[len(times)-1]) > crashLoopWindow {
+			delete(crashTimes, name)
+		}
+	}
+	times := []time.Time{}
+	for _, t := range crashTimes[container] {
+		if at.Sub(t) <= crashLoopWindow {
+			times = append(times, t)
+		}
+	}
+	times = append(times, at)
+	crashTimes[container] = times
+	return len(times) >= crashLoopThreshold
+}
+
+// alertOnce sends an alert unless the same key fired within the cooldown
+func alertOnce(key, message string) {
+	eventsMu.Lock()
+	if t, ok := lastAlert[key]; ok && time.Since(t) < alertCooldown {
+		eventsMu.Unlock()
+		return
+	}
+	lastAlert[key] = time.Now()
+	eventsMu.Unlock()
+
+	log.Printf("Alert: %s", message)
+	go SendAlert(message)
+}
+
+func recordProjectEvent(ev database.ProjectEvent) {
+	if database.DB == nil {
+		return
+	}
+	if err := database.DB.Create(&ev).Error; err != nil {
+		log.Printf("Failed to record event for %s: %v", ev.Project, err)
+	}
+}
+
+// ProjectStatus derives a project's status from the state of its containers
+func ProjectStatus(project string) string {
+	output, err := runDocker("ps", "-a", "--filter", "label="+composeProjectLabel+"="+project,
+		"--format", "{{.State}}|{{.Status}}")
+	if err != nil {
+		return "unknown"
+	}
+	lines := splitLines(output)
+	if len(lines) == 0 {
+		return "stopped"
+	}
+
+	running, unhealthy, restarting := 0, 0, 0
+	for _, l := range lines {
+		parts := strings.SplitN(l, "|", 2)
+		switch parts[0] {
+		case "running":
+			running++
+			if len(parts) > 1 && strings.Contains(parts[1], "(unhealthy)") {
+				unhealthy++
+			}
+		case "restarting":
+			restarting++
+		}
+	}
+	switch {
+	case restarting > 0:
+		return "restarting"
+	case unhealthy > 0:
+		return "unhealthy"
+	case running == len(lines):
+		return "running"
+	case running == 0:
+		return "stopped"
+	default:
+		return "partial"
+	}
+}
+
+// syncProjectStatus writes the live status of a panel-managed project to the database
+func syncProjectStatus(project string) {
+	if database.DB == nil {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(ProjectsRoot, project)); err != nil {
+		return
+	}
+	status := ProjectStatus(project)
+
+	p := getOrCreateProject(project)
+	if p.Status != status {
+		database.DB.Model(&p).Update("status", status)
+	}
+}
+
+// GetProjectEvents returns the most recent recorded events of a project
+func GetProjectEvents(project string, limit int) ([]database.ProjectEvent, error) {
+	events := []database.ProjectEvent{}
+	if database.DB == nil {
+		return events, fmt.Errorf("database not initialized")
+	}
+	err := database.DB.Where("project = ?", project).Order("time desc").Limit(limit).Find(&events).Error
+	return events, err
+}
+
+// recentDockerEvents returns the last n events seen by the watcher
+func recentDockerEvents(n int) []string {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	if n > len(recentEvents) {
+		n = len(recentEvents)
+	}
+	out := make([]string, n)
+	copy(out, recentEvents[len(recentEvents)-n:])
+	return out
+}
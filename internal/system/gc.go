@@ -0,0 +1,367 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+)
+
+// GCPolicy controls the scheduled docker garbage collection
+type GCPolicy struct {
+	Enabled            bool   `json:"enabled"`
+	IntervalHours      int    `json:"interval_hours"`
+	KeepImageVersions  int    `json:"keep_image_versions"`
+	PruneContainers    bool   `json:"prune_containers"`
+	PruneVolumes       bool   `json:"prune_volumes"`
+	PruneBuildCache    bool   `json:"prune_build_cache"`
+	BuildCacheMaxAge   string `json:"build_cache_max_age"` // e.g. "168h"
+	DryRun             bool   `json:"dry_run"`
+	NotifyOnCompletion bool   `json:"notify_on_completion"`
+	LastRun            string `json:"last_run"`
+}
+
+// GCItem is one object the collector removes (or would remove)
+type GCItem struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+	Error  string `json:"error,omitempty"`
+}
+
+// GCReport is the plan of a dry run, or the result of a real run
+type GCReport struct {
+	DryRun         bool     `json:"dry_run"`
+	Images         []GCItem `json:"images"`
+	Containers     []GCItem `json:"containers"`
+	Volumes        []GCItem `json:"volumes"`
+	BuildCache     int64    `json:"build_cache"`
+	EstimatedBytes int64    `json:"estimated_bytes"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	Reclaimed      string   `json:"reclaimed"`
+	StartedAt      string   `json:"started_at"`
+	FinishedAt     string   `json:"finished_at"`
+}
+
+const gcFile = "data/gc.json"
+
+var (
+	gcMu       sync.Mutex
+	gcLastRun  GCReport
+	gcSchedule sync.Once
+)
+
+func defaultGCPolicy() GCPolicy {
+	return GCPolicy{
+		IntervalHours:      24,
+		KeepImageVersions:  2,
+		PruneContainers:    true,
+		PruneBuildCache:    true,
+		BuildCacheMaxAge:   "168h",
+		DryRun:             true,
+		NotifyOnCompletion: true,
+	}
+}
+
+func GetGCPolicy() (GCPolicy, error) {
+	file, err := os.ReadFile(gcFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultGCPolicy(), nil
+		}
+		return GCPolicy{}, err
+	}
+	policy := defaultGCPolicy()
+	err = json.Unmarshal(file, &policy)
+	return policy, err
+}
+
+func SaveGCPolicy(policy GCPolicy) error {
+	if policy.IntervalHours < 1 {
+		return fmt.Errorf("interval_hours must be at least 1")
+	}
+	if policy.KeepImageVersions < 0 {
+		return fmt.Errorf("keep_image_versions cannot be negative")
+	}
+	if policy.BuildCacheMaxAge != "" {
+		if _, err := time.ParseDuration(policy.BuildCacheMaxAge); err != nil {
+			return fmt.Errorf("invalid build_cache_max_age: %v", err)
+		}
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(gcFile, data, 0644)
+}
+
+// LastGCReport returns the report of the most recent collection
+func LastGCReport() GCReport {
+	gcMu.Lock()
+	defer gcMu.Unlock()
+	return gcLastRun
+}
+
+// StartGCScheduler checks the policy every few minutes and runs the
+// collector once its interval has elapsed.
+func StartGCScheduler() {
+	gcSchedule.Do(func() {
+		go func() {
+			ticker := time.NewTicker(5 * time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				policy, err := GetGCPolicy()
+				if err != nil || !policy.Enabled {
+					continue
+				}
+				if last, err := time.Parse(time.RFC3339, policy.LastRun); err == nil &&
+					time.Since(last) < time.Duration(policy.IntervalHours)*time.Hour {
+					continue
+				}
+				report, err := RunGC(policy, policy.DryRun)
+				if err != nil {
+					log.Printf("Scheduled GC failed: %v", err)
+					SendAlert(fmt.Sprintf("Scheduled Docker cleanup failed: %v", err))
+				} else if policy.NotifyOnCompletion {
+					SendAlert(gcSummary(report))
+				}
+				policy.LastRun = time.Now().Format(time.RFC3339)
+				SaveGCPolicy(policy)
+			}
+		}()
+	})
+}
+
+// RunGC always builds the removal plan first; with dryRun set it only
+// returns that plan, otherwise it executes it and reports reclaimed space.
+func RunGC(policy GCPolicy, dryRun bool) (GCReport, error) {
+	gcMu.Lock()
+	defer gcMu.Unlock()
+
+	report, err := planGC(policy)
+	if err != nil {
+		return report, err
+	}
+	report.DryRun = dryRun
+	if !dryRun {
+		executeGC(policy, &report)
+	}
+	report.Reclaimed = formatBytes(report.ReclaimedBytes)
+	report.FinishedAt = time.Now().Format(time.RFC3339)
+	gcLastRun = report
+	return report, nil
+}
+
+func planGC(policy GCPolicy) (GCReport, error) {
+	report := GCReport{
+		Images:     []GCItem{},
+		Containers: []GCItem{},
+		Volumes:    []GCItem{},
+		StartedAt:  time.Now().Format(time.RFC3339),
+	}
+
+	// Images: per project keep the newest N unused versions, drop the rest;
+	// dangling images nobody owns always go.
+	images, err := ListImages()
+	if err != nil {
+		return report, err
+	}
+	owners, err := imageOwners(images)
+	if err != nil {
+		return report, err
+	}
+	byProject := map[string][]ImageInfo{}
+	for _, img := range images {
+		if img.InUse {
+			continue
+		}
+		if p := owners[img.ID]; p != "" {
+			byProject[p] = append(byProject[p], img)
+		} else if img.Dangling {
+			report.Images = append(report.Images, GCItem{ID: img.ID, Name: "<none>", Size: img.Size, Reason: "dangling"})
+		}
+	}
+	for project, imgs := range byProject {
+		sort.Slice(imgs, func(i, j int) bool { return imgs[i].Created > imgs[j].Created })
+		for i, img := range imgs {
+			if i < policy.KeepImageVersions {
+				continue
+			}
+			name := "<none>"
+			if len(img.Tags) > 0 {
+				name = strings.Join(img.Tags, ", ")
+			}
+			report.Images = append(report.Images, GCItem{
+				ID: img.ID, Name: name, Size: img.Size,
+				Reason: fmt.Sprintf("older than the %d kept versions of %s", policy.KeepImageVersions, project),
+			})
+		}
+	}
+
+	// Stopped containers of panel projects that were deleted
+	if policy.PruneContainers {
+		output, err := runDocker("ps", "-a", "--size", "--filter", "status=exited", "--filter", "status=created",
+			"--filter", "status=dead", "--format", "{{.ID}}|{{.Names}}|{{.Label \""+composeProjectLabel+"\"}}|{{.Label \""+composeWorkingDirLabel+"\"}}|{{.Size}}")
+		if err != nil {
+			return report, err
+		}
+		for _, line := range splitLines(output) {
+			parts := strings.SplitN(line, "|", 5)
+			if len(parts) != 5 || !projectGone(parts[2], parts[3]) {
+				continue
+			}
+			size := parts[4]
+			if idx := strings.Index(size, " ("); idx >= 0 {
+				size = size[:idx]
+			}
+			report.Containers = append(report.Containers, GCItem{
+				ID: parts[0], Name: parts[1], Size: parseHumanSize(size), Reason: "stopped, project " + parts[2] + " was deleted",
+			})
+		}
+	}
+
+	// Volumes that nothing mounts and whose project was deleted
+	if policy.PruneVolumes {
+		volumes, err := ListVolumes()
+		if err != nil {
+			return report, err
+		}
+		for _, v := range volumes {
+			if v.InUse || !projectGone(v.Project, "") {
+				continue
+			}
+			report.Volumes = append(report.Volumes, GCItem{ID: v.Name, Name: v.Name, Size: v.Size, Reason: "project " + v.Project + " was deleted"})
+		}
+	}
+
+	if policy.PruneBuildCache {
+		output, err := runDocker("system", "df", "--format", "{{json .}}")
+		if err == nil {
+			for _, line := range splitLines(output) {
+				var row struct {
+					Type        string `json:"Type"`
+					Reclaimable string `json:"Reclaimable"`
+				}
+				if json.Unmarshal([]byte(line), &row) == nil && row.Type == "Build Cache" {
+					// "1.2GB (100%)"
+					r := row.Reclaimable
+					if idx := strings.Index(r, " ("); idx >= 0 {
+						r = r[:idx]
+					}
+					report.BuildCache = parseHumanSize(r)
+				}
+			}
+		}
+	}
+
+	for _, list := range [][]GCItem{report.Images, report.Containers, report.Volumes} {
+		for _, it := range list {
+			report.EstimatedBytes += it.Size
+		}
+	}
+	report.EstimatedBytes += report.BuildCache
+	return report, nil
+}
+
+func executeGC(policy GCPolicy, report *GCReport) {
+	// Containers first so the images and volumes they held become removable
+	for i := range report.Containers {
+		it := &report.Containers[i]
+		if _, err := runDocker("rm", it.ID); err != nil {
+			it.Error = err.Error()
+			continue
+		}
+		report.ReclaimedBytes += it.Size
+	}
+	for i := range report.Images {
+		it := &report.Images[i]
+		if _, err := runDocker("image", "rm", it.ID); err != nil {
+			it.Error = err.Error()
+			continue
+		}
+		report.ReclaimedBytes += it.Size
+	}
+	for i := range report.Volumes {
+		it := &report.Volumes[i]
+		if _, err := runDocker("volume", "rm", it.ID); err != nil {
+			it.Error = err.Error()
+			continue
+		}
+		report.ReclaimedBytes += it.Size
+	}
+	if policy.PruneBuildCache {
+		args := []string{"builder", "prune", "-f"}
+		if policy.BuildCacheMaxAge != "" {
+			args = append(args, "--filter", "until="+policy.BuildCacheMaxAge)
+		}
+		if output, err := runDocker(args...); err == nil {
+			// Builder prune ends with "Total:\t1.2GB"
+			for _, line := range splitLines(output) {
+				if strings.HasPrefix(line, "Total:") {
+					report.ReclaimedBytes += parseHumanSize(strings.TrimPrefix(line, "Total:"))
+				}
+			}
+		} else {
+			log.Printf("Build cache prune failed: %v", err)
+		}
+	}
+}
+
+func projectExists(project string) bool {
+	if project == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(ProjectsRoot, project))
+	return err == nil
+}
+
+// projectGone reports whether a compose project label names a panel project
+// whose directory was deleted. Only projects the panel has a record of
+// count: containers and volumes without the label, like the panel's own
+// databases, and stacks run outside the panel are never the panel's to
+// collect, even when no folder of that name exists under ProjectsRoot.
+func projectGone(project, workingDir string) bool {
+	if project == "" || !composeNameRe.MatchString(project) || database.DB == nil {
+		return false
+	}
+	if workingDir != "" && filepath.Dir(filepath.Clean(workingDir)) != ProjectsRoot {
+		return false
+	}
+	if projectExists(project) {
+		return false
+	}
+	var count int64
+	database.DB.Model(&database.Project{}).Where("name = ?", project).Count(&count)
+	return count > 0
+}
+
+func gcSummary(r GCReport) string {
+	if r.DryRun {
+		return fmt.Sprintf("Docker cleanup (dry run): would remove %d images, %d containers, %d volumes and reclaim about %s.",
+			len(r.Images), len(r.Containers), len(r.Volumes), formatBytes(r.EstimatedBytes))
+	}
+	removed := func(items []GCItem) (ok int) {
+		for _, it := range items {
+			if it.Error == "" {
+				ok++
+			}
+		}
+		return ok
+	}
+	img, ct, vol := removed(r.Images), removed(r.Containers), removed(r.Volumes)
+	msg := fmt.Sprintf("Docker cleanup finished: removed %d images, %d containers, %d volumes, reclaimed %s.",
+		img, ct, vol, r.Reclaimed)
+	if failed := len(r.Images) + len(r.Containers) + len(r.Volumes) - img - ct - vol; failed > 0 {
+		msg += fmt.Sprintf(" %d item(s) could not be removed.", failed)
+	}
+	return msg
+}
@@ -0,0 +1,477 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+	"github.com/goccy/go-yaml"
+)
+
+// GitSource is the repository a git project is built from. The code is
+// cloned into ProjectsRoot/<name>/source; the project's own compose file
+// stays next to it so data volumes survive a fresh clone.
+type GitSource struct {
+	URL    string `json:"url"`
+	Branch string `json:"branch"` // empty: the repository's default branch
+	Subdir string `json:"subdir"`
+	// Dockerfile relative to Subdir. Empty uses the repository's compose
+	// file when it has one, and ./Dockerfile otherwise.
+	Dockerfile string `json:"dockerfile"`
+}
+
+const (
+	SourceCompose = "compose"
+	SourceGit     = "git"
+	SourceUpload  = "upload"
+
+	sourceDir = "source"
+)
+
+var (
+	gitBranchRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	scpURLRe    = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^-]`)
+)
+
+var repoComposeFiles = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+func (g GitSource) Validate() error {
+	switch {
+	case g.URL == "" || strings.HasPrefix(g.URL, "-"):
+		return fmt.Errorf("repository URL is required")
+	case strings.HasPrefix(g.URL, "/"), scpURLRe.MatchString(g.URL):
+	default:
+		u, err := url.Parse(g.URL)
+		if err != nil {
+			return fmt.Errorf("invalid repository URL: %v", err)
+		}
+		switch u.Scheme {
+		case "https", "http", "ssh", "git", "file":
+		default:
+			return fmt.Errorf("unsupported repository URL scheme %q", u.Scheme)
+		}
+	}
+	if g.Branch != "" && (!gitBranchRe.MatchString(g.Branch) || strings.Contains(g.Branch, "..")) {
+		return fmt.Errorf("invalid branch %q", g.Branch)
+	}
+	for _, p := range []string{g.Subdir, g.Dockerfile} {
+		if p != "" && (filepath.IsAbs(p) || strings.HasPrefix(filepath.Clean(p), "..")) {
+			return fmt.Errorf("path %q must stay inside the repository", p)
+		}
+	}
+	return nil
+}
+
+// redactURL hides credentials embedded in a repository URL for logs
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	u.User = url.User("***")
+	return u.String()
+}
+
+// splitGitCredentials takes the user info out of an http(s) repository URL.
+// The login of an ssh or scp-style URL is not a secret and stays in place.
+func splitGitCredentials(raw string) (string, string) {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return raw, ""
+	}
+	password, _ := u.User.Password()
+	creds := u.User.Username() + ":" + password
+	u.User = nil
+	return u.String(), creds
+}
+
+// setGitURL saves the repository URL of a project without its credentials,
+// which are stored encrypted
+func setGitURL(project, raw string) error {
+	clean, creds := splitGitCredentials(raw)
+	enc := ""
+	if creds != "" {
+		var err error
+		if enc, err = security.EncryptString(creds); err != nil {
+			return err
+		}
+	}
+	return database.DB.Model(&database.Project{}).Where("name = ?", project).
+		Updates(map[string]interface{}{"git_url": clean, "git_credentials_encrypted": enc}).Error
+}
+
+// gitAuthEnv hands the repository credentials of a project to git as an
+// Authorization header for the repository's host. Going through the
+// environment keeps them out of the checkout's .git/config, which the file
+// manager can read, and out of the process list.
+func gitAuthEnv(p database.Project) ([]string, error) {
+	if p.GitCredentialsEncrypted == "" {
+		return nil, nil
+	}
+	creds, err := security.DecryptString(p.GitCredentialsEncrypted)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt the repository credentials: %v", err)
+	}
+	u, err := url.Parse(p.GitURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository URL: %v", err)
+	}
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http." + u.Scheme + "://" + u.Host + "/.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(creds)),
+	}, nil
+}
+
+// MigrateGitCredentials moves the credentials that repository URLs saved
+// before they were kept apart still embed to encrypted storage, and takes
+// them out of the checkout's origin. It runs at startup.
+func MigrateGitCredentials() {
+	if database.DB == nil {
+		return
+	}
+	var projects []database.Project
+	database.DB.Where("source_type = ? AND git_url LIKE ?", SourceGit, "%@%").Find(&projects)
+	for _, p := range projects {
+		clean, creds := splitGitCredentials(p.GitURL)
+		if creds == "" {
+			continue
+		}
+		if err := setGitURL(p.Name, p.GitURL); err != nil {
+			log.Printf("Failed to migrate the repository credentials of %s: %v", p.Name, err)
+			continue
+		}
+		src := filepath.Join(ProjectsRoot, p.Name, sourceDir)
+		if _, err := os.Stat(filepath.Join(src, ".git")); err == nil {
+			if _, err := runGitIn(src, "remote", "set-url", "origin", clean); err != nil {
+				log.Printf("Failed to reset the origin of %s: %v", p.Name, err)
+			}
+		}
+		log.Printf("Moved the repository credentials of %s to encrypted storage", p.Name)
+	}
+}
+
+// validateSourceProject checks what every project built from source needs
+func validateSourceProject(name string, domains []string, port int) error {
+	if err := ValidateNewProjectName(name); err != nil {
+		return err
+	}
+	for _, d := range domains {
+		if err := ValidateDomain(d); err != nil {
+			return err
+		}
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	if database.DB == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	return nil
+}
+
+// CreateGitProject registers a project built from a git repository and
+// starts its first build and deploy
+func CreateGitProject(name string, src GitSource, domains []string, port int, user string) (Job, error) {
+	if err := validateSourceProject(name, domains, port); err != nil {
+		return Job{}, err
+	}
+	if err := src.Validate(); err != nil {
+		return Job{}, err
+	}
+	if err := os.MkdirAll(filepath.Join(ProjectsRoot, name), 0755); err != nil {
+		return Job{}, fmt.Errorf("failed to create project directory: %v", err)
+	}
+
+	p := getOrCreateProject(name)
+	database.DB.Model(&p).Updates(database.Project{
+		Status: "creating", SourceType: SourceGit, GitBranch: src.Branch,
+		GitSubdir: src.Subdir, Dockerfile: src.Dockerfile, AppPort: port, Domains: domains,
+	})
+	if err := setGitURL(name, src.URL); err != nil {
+		return Job{}, fmt.Errorf("failed to save the repository: %v", err)
+	}
+	return startFirstBuild(name, user)
+}
+
+// startFirstBuild builds and deploys a new source project, marking it as
+// failed if that does not work
+func startFirstBuild(name, user string) (Job, error) {
+	return StartJob("build", name, user, func(ctx context.Context, logf JobLogger) error {
+		err := deployFromSource(ctx, name, user, logf)
+		if err != nil {
+			database.DB.Model(&database.Project{}).Where("name = ?", name).Update("status", "error")
+		}
+		return err
+	}), nil
+}
+
+// deployFromSource rebuilds and deploys a project built from source
+func deployFromSource(ctx context.Context, project, user string, logf JobLogger) error {
+	if getOrCreateProject(project).SourceType == SourceUpload {
+		return deployFromUpload(ctx, project, user, logf)
+	}
+	return deployFromGit(ctx, project, user, logf)
+}
+
+// deployFromGit pulls the latest commit, builds it and deploys it
+func deployFromGit(ctx context.Context, project, user string, logf JobLogger) error {
+	p := getOrCreateProject(project)
+	commit, err := syncSource(filepath.Join(ProjectsRoot, project), p, logf)
+	if err != nil {
+		return err
+	}
+	logf("Building commit " + commit)
+	return buildAndDeploy(ctx, project, user, p, commit, "git", "commit "+commit, logf)
+}
+
+// buildAndDeploy builds the source checked out in the project, with the
+// source's compose file or a Dockerfile, and deploys it. commit tags the
+// built images; trigger and detail describe the recorded deployment.
+func buildAndDeploy(ctx context.Context, project, user string, p database.Project, commit, trigger, detail string, logf JobLogger) error {
+	buildDir := sourceContext(project, p)
+	previous, _ := os.ReadFile(projectComposePath(project))
+	var compose []byte
+	var err error
+
+	if repoCompose := findRepoCompose(buildDir); p.Dockerfile == "" && repoCompose != "" {
+		if compose, err = composeFromRepo(project, p, repoCompose, commit, previous); err != nil {
+			return err
+		}
+		if err := os.WriteFile(projectComposePath(project), compose, 0644); err != nil {
+			return err
+		}
+		if err := streamCompose(ctx, project, logf, "--progress", "plain", "build"); err != nil {
+			return fmt.Errorf("build failed: %v", err)
+		}
+	} else {
+		dockerfile, err := resolveDockerfile(project, user, p, buildDir, logf)
+		if err != nil || dockerfile == "" {
+			return err
+		}
+		tag := builtImageName(project, "app") + ":" + commit
+		if err := streamDocker(ctx, logf, "build", "--progress=plain", "-t", tag, "-f", dockerfile, buildDir); err != nil {
+			return fmt.Errorf("build failed: %v", err)
+		}
+		if compose, err = dockerfileCompose(project, p, tag, previous); err != nil {
+			return err
+		}
+		if err := os.WriteFile(projectComposePath(project), compose, 0644); err != nil {
+			return err
+		}
+	}
+	RecordProjectChange(project, user, "Deploy "+detail, "docker-compose.yml")
+
+	if len(p.Domains) > 0 {
+		if err := EnsureTraefikNetwork(); err != nil {
+			return fmt.Errorf("failed to prepare traefik network: %v", err)
+		}
+	}
+	if err := composeUp(ctx, project, logf); err != nil {
+		return err
+	}
+	logf("Waiting for services to become healthy...")
+	if err := waitProjectHealthy(ctx, project, updateHealthTimeout); err != nil {
+		return fmt.Errorf("deployment is not healthy: %v", err)
+	}
+	syncProjectStatus(project)
+	database.DB.Model(&database.Project{}).Where("name = ?", project).Update("git_commit", commit)
+
+	d, err := RecordDeployment(project, user, trigger, detail)
+	if err != nil {
+		logf("Warning: failed to record deployment: " + err.Error())
+	} else {
+		logf(fmt.Sprintf("Deployed %s (deployment #%d)", detail, d.ID))
+	}
+	return nil
+}
+
+// syncSource clones the repository on first use and afterwards resets it to
+// the latest commit of the branch. It returns the short commit hash.
+func syncSource(dir string, p database.Project, logf JobLogger) (string, error) {
+	src := filepath.Join(dir, sourceDir)
+	auth, err := gitAuthEnv(p)
+	if err != nil {
+		return "", err
+	}
+	run := func(workdir string, args ...string) error {
+		logf("$ git " + strings.ReplaceAll(strings.Join(args, " "), p.GitURL, redactURL(p.GitURL)))
+		cmd := gitCommand(workdir, args...)
+		cmd.Env = append(cmd.Env, auth...)
+		return streamCommand(cmd, logf)
+	}
+
+	if _, err := os.Stat(filepath.Join(src, ".git")); err != nil {
+		os.RemoveAll(src)
+		args := []string{"clone", "--depth", "1", "--single-branch"}
+		if p.GitBranch != "" {
+			args = append(args, "--branch", p.GitBranch)
+		}
+		if err := run(dir, append(args, "--", p.GitURL, sourceDir)...); err != nil {
+			return "", fmt.Errorf("clone failed: %v", err)
+		}
+	} else {
+		ref := p.GitBranch
+		if ref == "" {
+			ref = "HEAD"
+		}
+		if _, err := runGitIn(src, "remote", "set-url", "origin", p.GitURL); err != nil {
+			return "", err
+		}
+		if err := run(src, "fetch", "--depth", "1", "origin", ref); err != nil {
+			return "", fmt.Errorf("fetch failed: %v", err)
+		}
+		if err := run(src, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+		if err := run(src, "clean", "-ffdx"); err != nil {
+			return "", err
+		}
+	}
+
+	if p.GitBranch == "" {
+		if branch, err := runGitIn(src, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && database.DB != nil {
+			database.DB.Model(&database.Project{}).Where("name = ?", p.Name).Update("git_branch", strings.TrimSpace(branch))
+		}
+	}
+	commit, err := runGitIn(src, "rev-parse", "--short=12", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+func findRepoCompose(context string) string {
+	for _, name := range repoComposeFiles {
+		if _, err := os.Stat(filepath.Join(context, name)); err == nil {
+			return filepath.Join(context, name)
+		}
+	}
+	return ""
+}
+
+// builtImageName is the local image name for a service built by the panel
+func builtImageName(project, service string) string {
+	return strings.ToLower(project + "-" + service)
+}
+
+// composeFromRepo turns the repository's compose file into the project's:
+// build contexts and env files point into the checkout, built images are
+// tagged with the commit, domains are routed and the resource limits set
+// in the panel are carried over from the previous version.
+func composeFromRepo(project string, p database.Project, repoCompose, commit string, previous []byte) ([]byte, error) {
+	content, err := os.ReadFile(repoCompose)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := ParseComposeDocument(content)
+	if err != nil {
+		return nil, fmt.Errorf("repository compose file: %v", err)
+	}
+	base := "./" + filepath.ToSlash(filepath.Join(sourceDir, p.GitSubdir))
+	inSource := func(v interface{}) interface{} {
+		s := fmt.Sprint(v)
+		if filepath.IsAbs(s) || strings.Contains(s, "://") {
+			return s
+		}
+		return "./" + filepath.ToSlash(filepath.Join(strings.TrimPrefix(base, "./"), s))
+	}
+
+	var old yaml.MapSlice
+	if len(previous) > 0 {
+		yaml.UnmarshalWithOptions(previous, &old, yaml.UseOrderedMap())
+	}
+	oldServices, _ := mapValue(old, "services").(yaml.MapSlice)
+
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for i, svc := range services {
+		name := fmt.Sprint(svc.Key)
+		def, _ := svc.Value.(yaml.MapSlice)
+
+		switch b := mapValue(def, "build").(type) {
+		case nil:
+		case yaml.MapSlice:
+			ctx := mapValue(b, "context")
+			if ctx == nil {
+				ctx = "."
+			}
+			def = setMapValue(def, "build", setMapValue(b, "context", inSource(ctx)))
+			def = setMapValue(def, "image", builtImageName(project, name)+":"+commit)
+		default:
+			def = setMapValue(def, "build", inSource(b))
+			def = setMapValue(def, "image", builtImageName(project, name)+":"+commit)
+		}
+
+		switch e := mapValue(def, "env_file").(type) {
+		case nil:
+		case []interface{}:
+			for j := range e {
+				if _, isMap := e[j].(yaml.MapSlice); !isMap {
+					e[j] = inSource(e[j])
+				}
+			}
+		default:
+			def = setMapValue(def, "env_file", inSource(e))
+		}
+
+		if oldDef, ok := mapValue(oldServices, name).(yaml.MapSlice); ok {
+			for _, k := range resourceKeys {
+				if v := mapValue(oldDef, k); v != nil {
+					def = setMapValue(def, k, v)
+				}
+			}
+		}
+		services[i].Value = def
+	}
+	doc = setMapValue(doc, "services", services)
+
+	doc = isolateProjectNetwork(doc, project)
+	if len(p.Domains) > 0 {
+		if doc, err = routeDomains(doc, project, "", p.AppPort, p.Domains); err != nil {
+			return nil, err
+		}
+	}
+	return yaml.MarshalWithOptions(doc, yaml.IndentSequence(true))
+}
+
+// dockerfileCompose points the project's "app" service at a freshly built
+// image. The first deploy generates the compose file; later ones only
+// change the image so edits made in the panel are kept.
+func dockerfileCompose(project string, p database.Project, image string, previous []byte) ([]byte, error) {
+	if len(previous) > 0 {
+		var doc yaml.MapSlice
+		if err := yaml.UnmarshalWithOptions(previous, &doc, yaml.UseOrderedMap()); err == nil {
+			services, _ := mapValue(doc, "services").(yaml.MapSlice)
+			if def, ok := mapValue(services, "app").(yaml.MapSlice); ok {
+				services = setMapValue(services, "app", setMapValue(def, "image", image))
+				return yaml.MarshalWithOptions(setMapValue(doc, "services", services), yaml.IndentSequence(true))
+			}
+		}
+	}
+
+	svc := &ComposeService{Image: image, Restart: "always", Networks: []string{"default"}}
+	file := &ComposeFile{
+		Services: map[string]*ComposeService{"app": svc},
+		Networks: map[string]*ComposeNetwork{"default": {Name: projectNetworkName(project)}},
+	}
+	if len(p.Domains) > 0 {
+		if p.AppPort == 0 {
+			return nil, fmt.Errorf("set the port the app listens on to route its domains")
+		}
+		svc.Networks = append(svc.Networks, "traefik")
+		file.Networks["traefik"] = &ComposeNetwork{Name: TraefikNetwork, External: true}
+		svc.Labels = traefikLabels(project, p.Domains, p.AppPort)
+	} else if p.AppPort > 0 {
+		svc.Ports = []ComposePort{{Target: p.AppPort, Published: fmt.Sprint(p.AppPort)}}
+	}
+	return file.Marshal()
+}
@@ -0,0 +1,344 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+)
+
+// HealthPolicy controls auto-healing of a project's containers
+type HealthPolicy struct {
+	Enabled bool `json:"enabled"`
+	// Seconds a container may stay unhealthy before the panel acts
+	UnhealthySeconds int `json:"unhealthy_seconds"`
+	// Plain restarts tried before escalating to a recreate
+	MaxRestarts int `json:"max_restarts"`
+	// Seconds to wait after a heal action before judging it
+	CooldownSeconds int `json:"cooldown_seconds"`
+}
+
+// HealthSettings is the default policy plus per-project overrides
+type HealthSettings struct {
+	Default  HealthPolicy            `json:"default"`
+	Projects map[string]HealthPolicy `json:"projects"`
+}
+
+// ContainerHealth is the live health view of one project container
+type ContainerHealth struct {
+	Project        string `json:"project"`
+	Service        string `json:"service"`
+	Container      string `json:"container"`
+	State          string `json:"state"`
+	Health         string `json:"health"`
+	FailingStreak  int    `json:"failing_streak"`
+	RestartCount   int    `json:"restart_count"`
+	UnhealthySince string `json:"unhealthy_since,omitempty"`
+	HealAttempts   int    `json:"heal_attempts"`
+}
+
+// healState is what the monitor remembers about a container between polls
+type healState struct {
+	status         string
+	restartCount   int
+	unhealthySince time.Time
+	attempts       int
+	lastAction     time.Time
+	escalated      bool
+	exhausted      bool // manual intervention was asked for in this streak
+}
+
+const (
+	healthFile         = "data/health.json"
+	healthPollInterval = 15 * time.Second
+)
+
+var (
+	healthMu   sync.Mutex
+	healStates = map[string]*healState{}
+	healthLive = []ContainerHealth{}
+	healthOnce sync.Once
+)
+
+func defaultHealthSettings() HealthSettings {
+	return HealthSettings{
+		Default: HealthPolicy{
+			Enabled:          true,
+			UnhealthySeconds: 90,
+			MaxRestarts:      2,
+			CooldownSeconds:  120,
+		},
+		Projects: map[string]HealthPolicy{},
+	}
+}
+
+func GetHealthSettings() (HealthSettings, error) {
+	file, err := os.ReadFile(healthFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defaultHealthSettings(), nil
+		}
+		return HealthSettings{}, err
+	}
+	settings := defaultHealthSettings()
+	err = json.Unmarshal(file, &settings)
+	if settings.Projects == nil {
+		settings.Projects = map[string]HealthPolicy{}
+	}
+	return settings, err
+}
+
+func SaveHealthSettings(settings HealthSettings) error {
+	if err := validateHealthPolicy(settings.Default); err != nil {
+		return err
+	}
+	for name, p := range settings.Projects {
+		if err := validateHealthPolicy(p); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if settings.Projects == nil {
+		settings.Projects = map[string]HealthPolicy{}
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(healthFile, data, 0644)
+}
+
+// SetProjectHealthPolicy stores an override for one project; nil removes it
+func SetProjectHealthPolicy(project string, policy *HealthPolicy) error {
+	settings, err := GetHealthSettings()
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		delete(settings.Projects, project)
+	} else {
+		settings.Projects[project] = *policy
+	}
+	return SaveHealthSettings(settings)
+}
+
+func validateHealthPolicy(p HealthPolicy) error {
+	if p.UnhealthySeconds < 15 {
+		return fmt.Errorf("unhealthy_seconds must be at least 15")
+	}
+	if p.MaxRestarts < 0 {
+		return fmt.Errorf("max_restarts cannot be negative")
+	}
+	if p.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown_seconds cannot be negative")
+	}
+	return nil
+}
+
+func (s HealthSettings) policyFor(project string) HealthPolicy {
+	if p, ok := s.Projects[project]; ok {
+		return p
+	}
+	return s.Default
+}
+
+// StartHealthMonitor polls the health and restart count of every project
+// container and heals containers that stay unhealthy.
+func StartHealthMonitor() {
+	healthOnce.Do(func() {
+		go func() {
+			for {
+				checkHealth()
+				time.Sleep(healthPollInterval)
+			}
+		}()
+	})
+}
+
+// GetContainerHealth returns the latest poll, optionally for one project
+func GetContainerHealth(project string) []ContainerHealth {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	out := []ContainerHealth{}
+	for _, h := range healthLive {
+		if project == "" || h.Project == project {
+			out = append(out, h)
+		}
+	}
+	return out
+}
+
+// GetHealthHistory returns the health timeline of a project, newest first
+func GetHealthHistory(project string, limit int) ([]database.HealthRecord, error) {
+	records := []database.HealthRecord{}
+	if database.DB == nil {
+		return records, fmt.Errorf("database not initialized")
+	}
+	err := database.DB.Where("project = ?", project).Order("time desc").Limit(limit).Find(&records).Error
+	return records, err
+}
+
+func checkHealth() {
+	settings, err := GetHealthSettings()
+	if err != nil {
+		log.Printf("Health monitor: %v", err)
+		settings = defaultHealthSettings()
+	}
+	containers, err := inspectAllContainers()
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	live := []ContainerHealth{}
+	seen := map[string]bool{}
+
+	for _, ct := range containers {
+		project := ct.Config.Labels[composeProjectLabel]
+		if !projectExists(project) {
+			continue
+		}
+		name := strings.TrimPrefix(ct.Name, "/")
+		service := ct.Config.Labels[composeServiceLabel]
+		seen[name] = true
+
+		status := ct.State.Status
+		health := ""
+		streak := 0
+		if ct.State.Health != nil {
+			health = ct.State.Health.Status
+			streak = ct.State.Health.FailingStreak
+			if ct.State.Running {
+				status = health
+			}
+		}
+
+		healthMu.Lock()
+		st, known := healStates[name]
+		if !known {
+			st = &healState{status: status, restartCount: ct.RestartCount}
+			healStates[name] = st
+		}
+		healthMu.Unlock()
+
+		record := func(action, detail string) {
+			recordHealth(database.HealthRecord{
+				Project: project, Container: name, Service: service, Status: status,
+				RestartCount: ct.RestartCount, Action: action, Detail: detail, Time: now,
+			})
+		}
+		if known && st.status != status {
+			record("status_change", st.status+" -> "+status)
+		}
+		if known && ct.RestartCount > st.restartCount {
+			record("restart_detected", fmt.Sprintf("restart count %d -> %d", st.restartCount, ct.RestartCount))
+		}
+		st.status = status
+		st.restartCount = ct.RestartCount
+
+		if health == "unhealthy" && ct.State.Running {
+			if st.unhealthySince.IsZero() {
+				st.unhealthySince = now
+			}
+		} else if health == "healthy" {
+			if st.attempts > 0 {
+				record("recovered", fmt.Sprintf("healthy again after %d heal attempt(s)", st.attempts))
+			}
+			st.unhealthySince, st.attempts, st.escalated, st.exhausted = time.Time{}, 0, false, false
+		}
+
+		// An operation on the project is recreating or waiting for its
+		// containers: leave them alone and start counting again afterwards
+		busy := isProjectBusy(project)
+		if busy && !st.unhealthySince.IsZero() {
+			st.unhealthySince = now
+		}
+
+		policy := settings.policyFor(project)
+		if policy.Enabled && !busy && !st.unhealthySince.IsZero() &&
+			now.Sub(st.unhealthySince) >= time.Duration(policy.UnhealthySeconds)*time.Second &&
+			now.Sub(st.lastAction) >= time.Duration(policy.CooldownSeconds)*time.Second {
+			heal(project, service, name, ct.ID, policy, st, record)
+		}
+
+		h := ContainerHealth{
+			Project: project, Service: service, Container: name, State: ct.State.Status,
+			Health: health, FailingStreak: streak, RestartCount: ct.RestartCount, HealAttempts: st.attempts,
+		}
+		if !st.unhealthySince.IsZero() {
+			h.UnhealthySince = st.unhealthySince.Format(time.RFC3339)
+		}
+		live = append(live, h)
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].Project != live[j].Project {
+			return live[i].Project < live[j].Project
+		}
+		return live[i].Container < live[j].Container
+	})
+
+	healthMu.Lock()
+	healthLive = live
+	for name := range healStates {
+		if !seen[name] {
+			delete(healStates, name)
+		}
+	}
+	healthMu.Unlock()
+}
+
+// heal restarts an unhealthy container, escalates to recreating it from the
+// compose file once restarts stop helping, and alerts at every step.
+func heal(project, service, name, id string, policy HealthPolicy, st *healState, record func(string, string)) {
+	st.lastAction = time.Now()
+	unhealthyFor := time.Since(st.unhealthySince).Round(time.Second)
+
+	switch {
+	case st.attempts < policy.MaxRestarts:
+		st.attempts++
+		_, err := runDocker("restart", id)
+		detail := fmt.Sprintf("restart %d/%d after %s unhealthy", st.attempts, policy.MaxRestarts, unhealthyFor)
+		if err != nil {
+			detail += ": " + err.Error()
+		}
+		record("restart", detail)
+		go SendAlert(fmt.Sprintf("Container *%s* of project *%s* was unhealthy for %s and has been restarted (%d/%d).",
+			name, project, unhealthyFor, st.attempts, policy.MaxRestarts))
+
+	case !st.escalated && service != "":
+		st.attempts++
+		st.escalated = true
+		_, err := runCompose(project, "up", "-d", "--force-recreate", "--no-deps", service)
+		detail := "recreated service " + service
+		if err != nil {
+			detail += ": " + err.Error()
+		}
+		record("recreate", detail)
+		go SendAlert(fmt.Sprintf("Container *%s* of project *%s* stayed unhealthy after %d restart(s); service *%s* has been recreated.",
+			name, project, policy.MaxRestarts, service))
+
+	case !st.exhausted:
+		// Nothing left to try automatically; ask for help once per unhealthy
+		// streak, whatever the cooldown
+		st.exhausted = true
+		record("escalate", "auto-heal exhausted, manual intervention required")
+		go SendAlert(fmt.Sprintf("Container *%s* of project *%s* is still unhealthy after restart and recreate. Manual intervention required.",
+			name, project))
+	}
+}
+
+func recordHealth(r database.HealthRecord) {
+	if database.DB == nil {
+		return
+	}
+	if err := database.DB.Create(&r).Error; err != nil {
+		log.Printf("Failed to record health for %s: %v", r.Container, err)
+	}
+}
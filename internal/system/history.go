@@ -0,0 +1,293 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every project directory is a local git repository managed by the panel.
+// Only files changed through the panel are committed, so application data
+// living next to the compose file never ends up in the history.
+
+// Revision is one commit in a project's history
+type Revision struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+	Files   []string  `json:"files"`
+}
+
+const (
+	panelCommitter = "FoxDocker Panel"
+	panelEmail     = "panel@foxdocker.local"
+)
+
+var (
+	revisionRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9~^._/-]*$`)
+	historyMu  sync.Map // project -> *sync.Mutex
+)
+
+func projectLock(project string) *sync.Mutex {
+	mu, _ := historyMu.LoadOrStore(project, &sync.Mutex{})
+	return mu.(*sync.Mutex)
+}
+
+// runGit runs git inside a project directory
+func runGit(project string, args ...string) (string, error) {
+	return runGitIn(filepath.Join(ProjectsRoot, project), args...)
+}
+
+// gitCommand builds a git command for dir. The ext:: transport, which runs
+// arbitrary commands, is never allowed.
+func gitCommand(dir string, args ...string) *exec.Cmd {
+	base := []string{"-c", "safe.directory=*", "-c", "core.quotepath=off", "-c", "protocol.ext.allow=never",
+		"-c", "user.name=" + panelCommitter, "-c", "user.email=" + panelEmail}
+	cmd := exec.Command("git", append(base, args...)...)
+	cmd.Dir = dir
+	// Never wait for a password on a terminal nobody is watching
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	return cmd
+}
+
+func runGitIn(dir string, args ...string) (string, error) {
+	cmd := gitCommand(dir, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return string(output), fmt.Errorf("git %s: %s", args[0], msg)
+	}
+	return string(output), nil
+}
+
+// historyExcludes are never committed: .env holds passwords
+const historyExcludes = ".env\n"
+
+// ensureRepo initializes the project's repository on first use. The .git
+// directory is private because repositories created before .env was
+// excluded still keep old copies of it.
+func ensureRepo(project string) error {
+	if !composeNameRe.MatchString(project) {
+		return fmt.Errorf("invalid project %q", project)
+	}
+	dir := filepath.Join(ProjectsRoot, project)
+	exclude := filepath.Join(dir, ".git", "info", "exclude")
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		if content, _ := os.ReadFile(exclude); string(content) == historyExcludes {
+			return nil
+		}
+		return writeHistoryExcludes(exclude)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("project %s not found", project)
+	}
+	if _, err := runGit(project, "init", "-q"); err != nil {
+		return err
+	}
+	if err := os.Chmod(filepath.Join(dir, ".git"), 0700); err != nil {
+		return err
+	}
+	return writeHistoryExcludes(exclude)
+}
+
+func writeHistoryExcludes(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(historyExcludes), 0600)
+}
+
+// CommitProjectChange records the given project files in the history with
+// user as author. Unchanged files are ignored; a change with nothing new
+// makes no commit.
+func CommitProjectChange(project, user, message string, paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	mu := projectLock(project)
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := ensureRepo(project); err != nil {
+		return err
+	}
+	if user == "" {
+		user = "system"
+	}
+
+	args := []string{"add", "-A", "--"}
+	for _, p := range paths {
+		rel, err := cleanProjectPath(p)
+		if err != nil {
+			return err
+		}
+		if rel == ".env" {
+			// Older repositories tracked it: stop doing so
+			if tracked, _ := runGit(project, "ls-files", "--", rel); strings.TrimSpace(tracked) != "" {
+				if _, err := runGit(project, "rm", "-q", "--cached", "--", rel); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		// Skip files that neither exist nor were ever committed
+		if _, err := os.Stat(filepath.Join(ProjectsRoot, project, rel)); err != nil {
+			if tracked, _ := runGit(project, "ls-files", "--", rel); strings.TrimSpace(tracked) == "" {
+				continue
+			}
+		}
+		args = append(args, rel)
+	}
+	if len(args) > 3 {
+		if _, err := runGit(project, args...); err != nil {
+			return err
+		}
+	}
+	// Nothing staged means the content did not change
+	if _, err := runGit(project, "diff", "--cached", "--quiet"); err == nil {
+		return nil
+	}
+	author := fmt.Sprintf("%s <%s@foxdocker.local>", user, user)
+	_, err := runGit(project, "commit", "-q", "--no-verify", "--author", author, "-m", message)
+	return err
+}
+
+// RecordProjectChange commits a panel change and only logs on failure, so
+// history problems never block the change itself
+func RecordProjectChange(project, user, message string, paths ...string) {
+	if err := CommitProjectChange(project, user, message, paths...); err != nil {
+		log.Printf("Failed to record history for %s: %v", project, err)
+	}
+}
+
+// RecordFileSave commits a file saved through the file manager, whose paths
+// are relative to ProjectsRoot
+func RecordFileSave(path, user string) {
+	parts := strings.SplitN(strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+path)), "/"), "/", 2)
+	if len(parts) != 2 || !composeNameRe.MatchString(parts[0]) {
+		return
+	}
+	RecordProjectChange(parts[0], user, "Edit "+parts[1], parts[1])
+}
+
+// headRevision returns the current commit of a project, "" if none
+func headRevision(project string) string {
+	out, err := runGit(project, "rev-parse", "--verify", "-q", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// GetProjectHistory lists the commits of a project, newest first,
+// optionally only those touching one file
+func GetProjectHistory(project, path string, limit int) ([]Revision, error) {
+	revisions := []Revision{}
+	if err := ensureRepo(project); err != nil {
+		return revisions, err
+	}
+	if headRevision(project) == "" {
+		return revisions, nil // no commits yet
+	}
+
+	// Records are separated by \x1e, fields by \x1f
+	args := []string{"log", "--name-only", "--format=%x1e%H%x1f%an%x1f%aI%x1f%s%x1f", "-n", strconv.Itoa(limit)}
+	if path != "" {
+		rel, err := cleanProjectPath(path)
+		if err != nil {
+			return revisions, err
+		}
+		args = append(args, "--", rel)
+	}
+	output, err := runGit(project, args...)
+	if err != nil {
+		return revisions, err
+	}
+	for _, record := range strings.Split(output, "\x1e") {
+		fields := strings.Split(record, "\x1f")
+		if len(fields) < 5 {
+			continue
+		}
+		date, _ := time.Parse(time.RFC3339, fields[2])
+		revisions = append(revisions, Revision{
+			Hash:    fields[0],
+			Author:  fields[1],
+			Date:    date,
+			Message: fields[3],
+			Files:   splitLines(fields[4]),
+		})
+	}
+	return revisions, nil
+}
+
+// GetProjectDiff returns the unified diff between two revisions. An empty
+// from diffs against the parent of to; an empty to means the working tree.
+func GetProjectDiff(project, from, to, path string) (string, error) {
+	if err := ensureRepo(project); err != nil {
+		return "", err
+	}
+	for _, rev := range []string{from, to} {
+		if rev != "" && !revisionRe.MatchString(rev) {
+			return "", fmt.Errorf("invalid revision %q", rev)
+		}
+	}
+
+	var args []string
+	switch {
+	case from == "" && to != "":
+		args = []string{"show", "--format=", to}
+	case from != "" && to != "":
+		args = []string{"diff", from, to}
+	case from != "":
+		args = []string{"diff", from}
+	default:
+		args = []string{"diff", "HEAD"}
+	}
+	if path != "" {
+		rel, err := cleanProjectPath(path)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--", rel)
+	}
+	return runGit(project, args...)
+}
+
+// GetFileAtRevision returns the content of a project file at a revision
+func GetFileAtRevision(project, rev, path string) (string, error) {
+	if err := ensureRepo(project); err != nil {
+		return "", err
+	}
+	if !revisionRe.MatchString(rev) {
+		return "", fmt.Errorf("invalid revision %q", rev)
+	}
+	rel, err := cleanProjectPath(path)
+	if err != nil {
+		return "", err
+	}
+	return runGit(project, "show", rev+":"+rel)
+}
+
+// cleanProjectPath makes a path relative to the project directory and
+// refuses anything that would leave it or touch the repository itself
+func cleanProjectPath(p string) (string, error) {
+	rel := strings.TrimPrefix(filepath.ToSlash(filepath.Clean("/"+p)), "/")
+	if rel == "" || rel == ".git" || strings.HasPrefix(rel, ".git/") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return rel, nil
+}
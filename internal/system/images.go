@@ -0,0 +1,285 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ImageInfo describes a local image for the images view
+type ImageInfo struct {
+	ID         string   `json:"id"`
+	Tags       []string `json:"tags"`
+	Digests    []string `json:"digests"`
+	Size       int64    `json:"size"`
+	SizeHuman  string   `json:"size_human"`
+	Created    string   `json:"created"`
+	Dangling   bool     `json:"dangling"`
+	InUse      bool     `json:"in_use"`
+	Containers []string `json:"containers"`
+	Project    string   `json:"project"`
+}
+
+// PullProgress is one line of `docker pull` output, with layer counters
+type PullProgress struct {
+	Layer       string `json:"layer,omitempty"`
+	Status      string `json:"status"`
+	LayersTotal int    `json:"layers_total"`
+	LayersDone  int    `json:"layers_done"`
+}
+
+// PruneReport summarizes an image prune
+type PruneReport struct {
+	Deleted        []string `json:"deleted"`
+	Untagged       []string `json:"untagged"`
+	ReclaimedSpace string   `json:"reclaimed_space"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+type imageInspect struct {
+	ID          string   `json:"Id"`
+	RepoTags    []string `json:"RepoTags"`
+	RepoDigests []string `json:"RepoDigests"`
+	Size        int64    `json:"Size"`
+	Created     string   `json:"Created"`
+	Config      struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+}
+
+func ListImages() ([]ImageInfo, error) {
+	ids, err := runDocker("image", "ls", "-q", "--no-trunc")
+	if err != nil {
+		return nil, err
+	}
+	idList := uniqueStrings(splitLines(ids))
+	if len(idList) == 0 {
+		return []ImageInfo{}, nil
+	}
+
+	output, err := runDocker(append([]string{"image", "inspect"}, idList...)...)
+	if err != nil {
+		return nil, err
+	}
+	var inspected []imageInspect
+	if err := json.Unmarshal([]byte(output), &inspected); err != nil {
+		return nil, err
+	}
+
+	// Map image ID -> containers using it, and the compose project that created them
+	containers, err := inspectAllContainers()
+	if err != nil {
+		return nil, err
+	}
+	users := map[string][]string{}
+	projects := map[string]string{}
+	for _, ct := range containers {
+		users[ct.Image] = append(users[ct.Image], strings.TrimPrefix(ct.Name, "/"))
+		if p := ct.Config.Labels[composeProjectLabel]; p != "" && projects[ct.Image] == "" {
+			projects[ct.Image] = p
+		}
+	}
+
+	images := make([]ImageInfo, 0, len(inspected))
+	for _, img := range inspected {
+		tags := []string{}
+		for _, t := range img.RepoTags {
+			if t != "<none>:<none>" {
+				tags = append(tags, t)
+			}
+		}
+		project := img.Config.Labels[composeProjectLabel]
+		if project == "" {
+			project = projects[img.ID]
+		}
+		used := users[img.ID]
+		if used == nil {
+			used = []string{}
+		}
+		images = append(images, ImageInfo{
+			ID:         img.ID,
+			Tags:       tags,
+			Digests:    img.RepoDigests,
+			Size:       img.Size,
+			SizeHuman:  formatBytes(img.Size),
+			Created:    img.Created,
+			Dangling:   len(tags) == 0,
+			InUse:      len(used) > 0,
+			Containers: used,
+			Project:    project,
+		})
+	}
+
+	sort.Slice(images, func(i, j int) bool { return images[i].Created > images[j].Created })
+	return images, nil
+}
+
+// PullTracker turns the lines of `docker pull` into PullProgress, counting
+// the layers seen and done so far
+type PullTracker struct {
+	layers map[string]bool
+	done   int
+}
+
+func NewPullTracker() *PullTracker {
+	return &PullTracker{layers: map[string]bool{}}
+}
+
+// layerLineRe matches the layer lines of `docker pull`, "a2abf6c4d29d: Pull
+// complete", and of `docker compose pull`, " a2abf6c4d29d Pull complete"
+var layerLineRe = regexp.MustCompile(`^\s*([0-9a-f]{12}):? (.+?)\s*$`)
+
+// Track parses one output line of `docker pull` or `docker compose pull`
+func (t *PullTracker) Track(line string) PullProgress {
+	p := PullProgress{Status: line}
+	if m := layerLineRe.FindStringSubmatch(line); m != nil {
+		p.Layer = m[1]
+		p.Status = m[2]
+		if _, seen := t.layers[p.Layer]; !seen {
+			t.layers[p.Layer] = false
+		}
+		if !t.layers[p.Layer] && (p.Status == "Pull complete" || p.Status == "Already exists") {
+			t.layers[p.Layer] = true
+			t.done++
+		}
+	}
+	p.LayersTotal = len(t.layers)
+	p.LayersDone = t.done
+	return p
+}
+
+// PullImage pulls an image and reports each progress line to onProgress
+func PullImage(image string, onProgress func(PullProgress)) error {
+	return pullImage(context.Background(), image, func(line string, p PullProgress) {
+		if onProgress != nil {
+			onProgress(p)
+		}
+	})
+}
+
+func pullImage(ctx context.Context, image string, onLine func(line string, p PullProgress)) error {
+	if err := validRef(image); err != nil {
+		return err
+	}
+	tracker := NewPullTracker()
+	cmd := exec.CommandContext(ctx, "docker", "pull", image)
+	return withRegistryAuth(cmd, func() error {
+		return streamCommand(cmd, func(line string) {
+			onLine(line, tracker.Track(line))
+		})
+	})
+}
+
+// pullProgress wraps the logger of a pull so the job's progress moves from
+// `from` to `to` as image layers complete
+func pullProgress(ctx context.Context, logf JobLogger, from, to int) JobLogger {
+	tracker := NewPullTracker()
+	return func(line string) {
+		logf(line)
+		if p := tracker.Track(line); p.LayersTotal > 0 {
+			setJobProgress(ctx, from+(to-from)*p.LayersDone/p.LayersTotal, "")
+		}
+	}
+}
+
+// pullParams are what a pull job needs to run again after a restart
+type pullParams struct {
+	Image string `json:"image"`
+}
+
+// StartPull queues pulling an image
+func StartPull(image, user string) (Job, error) {
+	if err := validRef(image); err != nil {
+		return Job{}, err
+	}
+	return enqueueJob("pull", "", user, pullParams{Image: image}, pullTask(image)), nil
+}
+
+func pullTask(image string) jobTask {
+	return func(ctx context.Context, logf JobLogger) error {
+		setJobProgress(ctx, 0, "Pulling "+image)
+		logf = pullProgress(ctx, logf, 0, 100)
+		return pullImage(ctx, image, func(line string, _ PullProgress) { logf(line) })
+	}
+}
+
+func TagImage(source, target string) error {
+	if err := validRef(source); err != nil {
+		return err
+	}
+	if err := validRef(target); err != nil {
+		return err
+	}
+	_, err := runDocker("image", "tag", source, target)
+	return err
+}
+
+// RemoveImage deletes an image that no container (running or stopped) uses
+func RemoveImage(ref string, force bool) error {
+	if err := validRef(ref); err != nil {
+		return err
+	}
+	users, err := runDocker("ps", "-a", "-q", "--filter", "ancestor="+ref)
+	if err != nil {
+		return err
+	}
+	if n := len(splitLines(users)); n > 0 {
+		return fmt.Errorf("image %s is used by %d container(s)", ref, n)
+	}
+
+	args := []string{"image", "rm"}
+	if force {
+		// Only needed to drop an image referenced by several tags
+		args = append(args, "-f")
+	}
+	_, err = runDocker(append(args, ref)...)
+	return err
+}
+
+// PruneImages removes dangling images, or every unused image when all is set
+func PruneImages(all bool) (PruneReport, error) {
+	args := []string{"image", "prune", "-f"}
+	if all {
+		args = append(args, "-a")
+	}
+	output, err := runDocker(args...)
+	if err != nil {
+		return PruneReport{}, err
+	}
+	return parsePruneOutput(output), nil
+}
+
+// parsePruneOutput reads the "deleted:"/"untagged:" lines and the
+// "Total reclaimed space" footer that every `docker ... prune` prints
+func parsePruneOutput(output string) PruneReport {
+	report := PruneReport{Deleted: []string{}, Untagged: []string{}, ReclaimedSpace: "0B"}
+	for _, line := range splitLines(output) {
+		switch {
+		case strings.HasPrefix(line, "deleted: "):
+			report.Deleted = append(report.Deleted, strings.TrimPrefix(line, "deleted: "))
+		case strings.HasPrefix(line, "untagged: "):
+			report.Untagged = append(report.Untagged, strings.TrimPrefix(line, "untagged: "))
+		case strings.HasPrefix(line, "Total reclaimed space:"):
+			report.ReclaimedSpace = strings.TrimSpace(strings.TrimPrefix(line, "Total reclaimed space:"))
+			report.ReclaimedBytes = parseHumanSize(report.ReclaimedSpace)
+		}
+	}
+	return report
+}
+
+func uniqueStrings(in []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, s := range in {
+		if !seen[s] {
+			seen[s] = true
+			out = append(out, s)
+		}
+	}
+	return out
+}
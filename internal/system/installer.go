@@ -2,11 +2,12 @@
 package system
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
 )
 
 // App represents an application template
@@ -17,75 +18,159 @@ type App struct {
 	Ports   string   `json:"ports"`
 	Domains []string `json:"domains"`
 	Env     []string `json:"env"`
+
+	Resources *ServiceResources `json:"resources,omitempty"`
 }
 
-// InstallApp handles the installation of an app using Docker Compose
-func InstallApp(app App, envVars map[string]string) error {
-	appDir := filepath.Join(ProjectsRoot, app.ID)
-	if err := os.MkdirAll(appDir, 0755); err != nil {
-		return fmt.Errorf("failed to create app directory: %v", err)
-	}
+// installParams are what an install job needs to run again after a restart
+type installParams struct {
+	App     App               `json:"app"`
+	EnvVars map[string]string `json:"env_vars"`
+}
 
-	composeContent := generateComposeFile(app, envVars)
-	composePath := filepath.Join(appDir, "docker-compose.yml")
-	if err := os.WriteFile(composePath, []byte(composeContent), 0644); err != nil {
-		return fmt.Errorf("failed to write docker-compose.yml: %v", err)
+// InstallApp checks an app's settings and queues its installation using
+// Docker Compose
+func InstallApp(app App, envVars map[string]string, user string) (Job, error) {
+	if !composeNameRe.MatchString(app.ID) {
+		return Job{}, fmt.Errorf("invalid app id %q", app.ID)
 	}
-
-	// Execute docker compose up -d
-	cmd := exec.Command("docker", "compose", "-f", composePath, "up", "-d")
-	cmd.Dir = appDir
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("docker compose failed: %v, output: %s", err, string(output))
+	if app.Resources != nil {
+		if err := app.Resources.Validate(); err != nil {
+			return Job{}, err
+		}
 	}
+	for _, key := range app.Env {
+		if database.DB != nil && isSecretName(key) && envVars[key] != "" {
+			if err := validateSecret(key, envVars[key]); err != nil {
+				return Job{}, err
+			}
+		}
+	}
+	if _, err := generateComposeFile(app, envVars, false); err != nil {
+		return Job{}, err
+	}
+	return enqueueJob("install", app.ID, user, installParams{App: app, EnvVars: envVars}, installTask(app, envVars, user)), nil
+}
 
-	return nil
+// installTask writes the compose file of an app and starts it
+func installTask(app App, envVars map[string]string, user string) jobTask {
+	return func(ctx context.Context, logf JobLogger) error {
+		// Passwords and keys go to the secrets store, not into the compose file
+		secrets := map[string]string{}
+		for _, key := range app.Env {
+			if database.DB != nil && isSecretName(key) && envVars[key] != "" {
+				secrets[key] = envVars[key]
+			}
+		}
+
+		setJobProgress(ctx, 5, "Writing docker-compose.yml")
+		composeContent, err := generateComposeFile(app, envVars, len(secrets) > 0)
+		if err != nil {
+			return err
+		}
+
+		appDir := filepath.Join(ProjectsRoot, app.ID)
+		if err := os.MkdirAll(appDir, 0755); err != nil {
+			return fmt.Errorf("failed to create app directory: %v", err)
+		}
+		if len(secrets) > 0 {
+			if err := storeSecrets(app.ID, secrets); err != nil {
+				return fmt.Errorf("failed to store secrets: %v", err)
+			}
+		}
+
+		if len(app.Domains) > 0 {
+			if err := EnsureTraefikNetwork(); err != nil {
+				return fmt.Errorf("failed to prepare traefik network: %v", err)
+			}
+		}
+
+		composePath := filepath.Join(appDir, "docker-compose.yml")
+		if err := os.WriteFile(composePath, composeContent, 0644); err != nil {
+			return fmt.Errorf("failed to write docker-compose.yml: %v", err)
+		}
+		RecordProjectChange(app.ID, user, "Install app "+app.Name, "docker-compose.yml")
+
+		setJobProgress(ctx, 10, "Pulling "+app.Image)
+		if err := streamCompose(ctx, app.ID, pullProgress(ctx, logf, 10, 60), "pull"); err != nil {
+			return fmt.Errorf("failed to pull %s: %v", app.Image, err)
+		}
+
+		// A reinstall replaces the running app with the project's deploy strategy
+		setJobProgress(ctx, 60, "Starting "+app.Name)
+		if err := composeUp(ctx, app.ID, logf); err != nil {
+			return fmt.Errorf("docker compose failed: %v", err)
+		}
+		setJobProgress(ctx, 75, "Waiting for services to become healthy")
+		if err := waitProjectHealthy(ctx, app.ID, updateHealthTimeout); err != nil {
+			return fmt.Errorf("%s is not healthy: %v", app.Name, err)
+		}
+		syncProjectStatus(app.ID)
+		if _, err := RecordDeployment(app.ID, user, "install", app.Name); err != nil {
+			logf("Warning: failed to record deployment: " + err.Error())
+		}
+		logf(app.Name + " installed")
+		return nil
+	}
 }
 
-func generateComposeFile(app App, envVars map[string]string) string {
-	var sb strings.Builder
-	sb.WriteString("version: '3.8'\n")
-	sb.WriteString("services:\n")
-	sb.WriteString(fmt.Sprintf("  %s:\n", app.ID))
-	sb.WriteString(fmt.Sprintf("    image: %s\n", app.Image))
-	
-	if app.Ports != "" {
-		sb.WriteString("    ports:\n")
-		// Simplified port mapping: mapping single port to itself
-		sb.WriteString(fmt.Sprintf("      - \"%s:%s\"\n", app.Ports, app.Ports))
+// generateComposeFile builds the single-service compose file of an app.
+// With secrets, the variables named like secrets are read from the
+// project's secrets file instead of being written in.
+func generateComposeFile(app App, envVars map[string]string, secrets bool) ([]byte, error) {
+	ports, err := ParsePorts(app.Ports)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range app.Domains {
+		if err := ValidateDomain(d); err != nil {
+			return nil, err
+		}
 	}
 
+	svc := &ComposeService{
+		Image:   app.Image,
+		Ports:   ports,
+		Restart: "always",
+	}
 	if len(app.Env) > 0 {
-		sb.WriteString("    environment:\n")
+		svc.Environment = map[string]string{}
 		for _, key := range app.Env {
-			val := envVars[key]
-			sb.WriteString(fmt.Sprintf("      - %s=%s\n", key, val))
+			if secrets && isSecretName(key) && envVars[key] != "" {
+				continue
+			}
+			svc.Environment[key] = escapeComposeValue(envVars[key])
+		}
+		if secrets {
+			svc.EnvFile = []string{secretsEnvPath(app.ID)}
 		}
 	}
+	if app.Resources != nil {
+		svc.CPUs = app.Resources.CPUs
+		svc.MemLimit = app.Resources.Memory
+		svc.MemReservation = app.Resources.MemoryReservation
+		svc.PidsLimit = app.Resources.PidsLimit
+	}
 
-	sb.WriteString("    restart: always\n")
-
+	// Every service joins the project's private network; only web-facing
+	// services are also attached to the shared Traefik network.
+	svc.Networks = []string{"default"}
+	networks := map[string]*ComposeNetwork{
+		"default": {Name: projectNetworkName(app.ID)},
+	}
 	if len(app.Domains) > 0 {
-		hostRule := ""
-		for i, d := range app.Domains {
-			if i > 0 {
-				hostRule += " || "
-			}
-			hostRule += fmt.Sprintf("Host(`%s`)", d)
-		}
-		sb.WriteString("    labels:\n")
-		sb.WriteString("      - \"traefik.enable=true\"\n")
-		sb.WriteString(fmt.Sprintf("      - \"traefik.http.routers.%s.rule=%s\"\n", app.ID, hostRule))
-		sb.WriteString(fmt.Sprintf("      - \"traefik.http.routers.%s.entrypoints=websecure\"\n", app.ID))
-		sb.WriteString(fmt.Sprintf("      - \"traefik.http.routers.%s.tls.certresolver=myresolver\"\n", app.ID))
-		if app.Ports != "" {
-			sb.WriteString(fmt.Sprintf("      - \"traefik.http.services.%s.loadbalancer.server.port=%s\"\n", app.ID, app.Ports))
+		svc.Networks = append(svc.Networks, "traefik")
+		networks["traefik"] = &ComposeNetwork{Name: TraefikNetwork, External: true}
+		port := 0
+		if len(ports) > 0 {
+			port = ports[0].Target
 		}
+		svc.Labels = traefikLabels(app.ID, app.Domains, port)
 	}
-	sb.WriteString("networks:\n")
-	sb.WriteString("  default:\n")
-	sb.WriteString("    name: foxdocker-network\n")
-	sb.WriteString("    external: true\n")
 
-	return sb.String()
+	file := &ComposeFile{
+		Services: map[string]*ComposeService{app.ID: svc},
+		Networks: networks,
+	}
+	return file.Marshal()
 }
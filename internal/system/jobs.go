@@ -0,0 +1,786 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Job is a long-running panel operation whose output can be followed.
+// Jobs wait in a queue, run at most one at a time per project and are
+// kept in the database so their history survives a panel restart.
+type Job struct {
+	ID           string     `json:"id"`
+	Type         string     `json:"type"` // create, install, deploy, backup, pull, ...
+	Project      string     `json:"project"`
+	User         string     `json:"user"`
+	Status       string     `json:"status"`
+	Progress     int        `json:"progress"` // 0-100
+	Step         string     `json:"step,omitempty"`
+	Output       []string   `json:"output"`
+	DroppedLines int        `json:"dropped_lines,omitempty"` // older lines no longer kept
+	Error        string     `json:"error,omitempty"`
+	ErrorLine    string     `json:"error_line,omitempty"` // output line that best explains a failure
+	CreatedAt    time.Time  `json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobFilter selects jobs in ListJobs; empty fields match everything
+type JobFilter struct {
+	Project string
+	Status  string
+	Type    string
+	Limit   int
+}
+
+// JobEvent is a change of a job sent to the clients following it
+type JobEvent struct {
+	Type     string `json:"type"`           // line, progress, state or done
+	Line     int    `json:"line,omitempty"` // number of the output line, from 1
+	Text     string `json:"text,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Progress int    `json:"progress"`
+	Step     string `json:"step,omitempty"`
+	Job      *Job   `json:"job,omitempty"` // final state, with done
+}
+
+// JobLogger appends a line to a job's output
+type JobLogger func(line string)
+
+// jobTask is the work of a job; ctx is canceled when the job is
+type jobTask func(ctx context.Context, logf JobLogger) error
+
+type jobEntry struct {
+	Job
+	params     string // encrypted JSON to run the job again, empty if it cannot be
+	task       jobTask
+	ctx        context.Context
+	cancel     context.CancelFunc
+	canceledBy string
+	held       bool // its caller already holds the project's operation lock
+	dirty      bool
+	subs       map[chan JobEvent]bool
+}
+
+const (
+	maxJobs          = 200  // finished jobs kept in memory
+	maxJobOutput     = 5000 // output lines kept per job
+	maxRunningJobs   = 4
+	jobEventBuffer   = 256
+	jobPingInterval  = 15 * time.Second
+	defaultJobsLimit = 50
+	jobFlushInterval = 2 * time.Second
+)
+
+type jobIDKey struct{}
+
+var errorLineRe = regexp.MustCompile(`(?i)error|failed|failure|denied|unauthorized|not found|no such|invalid|unhealthy|exited|cannot|timed? ?out`)
+
+var (
+	jobsMu    sync.Mutex
+	jobs      = map[string]*jobEntry{}
+	jobSaveMu sync.Mutex
+	queueOnce sync.Once
+)
+
+// StartJob queues fn to run in the background and records its output and
+// outcome. A job of a project waits until no other operation runs on it.
+func StartJob(jobType, project, user string, task jobTask) Job {
+	return enqueueJob(jobType, project, user, nil, task)
+}
+
+// enqueueJob queues a task. With params, the job is run again from the
+// start if a panel restart interrupts it (see resumeTask).
+func enqueueJob(jobType, project, user string, params interface{}, task jobTask) Job {
+	e := newJobEntry(jobType, project, user, task)
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err == nil {
+			e.params, err = security.EncryptString(string(raw))
+		}
+		if err != nil {
+			log.Printf("Job %s of %s will not resume after a restart: %v", jobType, project, err)
+		}
+	}
+	return addJob(e)
+}
+
+// startHeldJob runs fn at once for a caller that already took the project's
+// operation lock; the lock is released when the job ends
+func startHeldJob(jobType, project, user string, task jobTask) Job {
+	e := newJobEntry(jobType, project, user, task)
+	e.held = true
+	return addJob(e)
+}
+
+func newJobEntry(jobType, project, user string, task jobTask) *jobEntry {
+	e := &jobEntry{
+		Job: Job{
+			ID:        newJobID(),
+			Type:      jobType,
+			Project:   project,
+			User:      user,
+			Status:    JobQueued,
+			Output:    []string{},
+			CreatedAt: time.Now(),
+		},
+		task: task,
+	}
+	e.ctx, e.cancel = context.WithCancel(context.WithValue(context.Background(), jobIDKey{}, e.ID))
+	return e
+}
+
+func addJob(e *jobEntry) Job {
+	jobsMu.Lock()
+	jobs[e.ID] = e
+	pruneJobs()
+	jobsMu.Unlock()
+
+	saveJob(e)
+	scheduleJobs()
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return e.snapshot(true)
+}
+
+// scheduleJobs starts the queued jobs that can run: oldest first, at most
+// maxRunningJobs at a time and one at a time per project
+func scheduleJobs() {
+	jobsMu.Lock()
+	queued := []*jobEntry{}
+	running := 0
+	for _, e := range jobs {
+		switch {
+		case e.Status == JobQueued:
+			queued = append(queued, e)
+		case e.Status == JobRunning && !e.held:
+			running++
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool { return queued[i].CreatedAt.Before(queued[j].CreatedAt) })
+
+	started := []*jobEntry{}
+	for _, e := range queued {
+		if !e.held {
+			if running >= maxRunningJobs {
+				continue
+			}
+			if e.Project != "" && !beginProjectOperation(e.Project) {
+				continue
+			}
+			running++
+		}
+		now := time.Now()
+		e.Status = JobRunning
+		e.StartedAt = &now
+		e.publish(JobEvent{Type: "state", Status: JobRunning, Progress: e.Progress, Step: e.Step})
+		started = append(started, e)
+	}
+	jobsMu.Unlock()
+
+	for _, e := range started {
+		saveJob(e)
+		go runJob(e)
+	}
+}
+
+func runJob(e *jobEntry) {
+	err := e.task(e.ctx, e.log)
+
+	now := time.Now()
+	jobsMu.Lock()
+	e.FinishedAt = &now
+	switch {
+	case err != nil && e.ctx.Err() != nil:
+		e.Status = JobCanceled
+		e.Error = "canceled by " + e.canceledBy
+	case err != nil:
+		e.Status = JobFailed
+		e.Error = err.Error()
+		e.ErrorLine = errorLine(e.Output)
+	default:
+		e.Status = JobSucceeded
+		e.Progress = 100
+	}
+	e.cancel()
+	e.finish()
+	jobsMu.Unlock()
+	saveJob(e)
+
+	if e.Project != "" {
+		endProjectOperation(e.Project)
+	} else {
+		scheduleJobs()
+	}
+}
+
+// log appends a line, keeping only the last maxJobOutput lines
+func (e *jobEntry) log(line string) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	e.appendLine(line)
+}
+
+// appendLine is log for callers holding jobsMu
+func (e *jobEntry) appendLine(line string) {
+	e.Output = append(e.Output, line)
+	if drop := len(e.Output) - maxJobOutput; drop > 0 {
+		e.Output = append([]string{}, e.Output[drop:]...)
+		e.DroppedLines += drop
+	}
+	e.dirty = true
+	e.publish(JobEvent{Type: "line", Line: e.DroppedLines + len(e.Output), Text: line})
+}
+
+// publish sends an event to the followers of a job; callers hold jobsMu.
+// A follower too slow to keep up is dropped: its channel is closed and it
+// subscribes again from the last line it got.
+func (e *jobEntry) publish(ev JobEvent) {
+	for ch := range e.subs {
+		select {
+		case ch <- ev:
+		default:
+			delete(e.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// finish sends the done event and closes the followers; callers hold jobsMu
+func (e *jobEntry) finish() {
+	job := e.snapshot(false)
+	e.publish(JobEvent{Type: "done", Status: e.Status, Progress: e.Progress, Step: e.Step, Job: &job})
+	for ch := range e.subs {
+		close(ch)
+	}
+	e.subs = nil
+}
+
+// errorLine picks the output line that best explains a failure: the last
+// one that reads like an error, else the last one
+func errorLine(output []string) string {
+	last := ""
+	for i := len(output) - 1; i >= 0 && i >= len(output)-200; i-- {
+		line := strings.TrimSpace(output[i])
+		if line == "" || strings.HasPrefix(line, "$ ") {
+			continue
+		}
+		if last == "" {
+			last = line
+		}
+		if errorLineRe.MatchString(line) {
+			return line
+		}
+	}
+	return last
+}
+
+// snapshot copies the job; callers hold jobsMu
+func (e *jobEntry) snapshot(withOutput bool) Job {
+	job := e.Job
+	if withOutput {
+		job.Output = append([]string{}, e.Output...)
+	} else {
+		job.Output = nil
+	}
+	return job
+}
+
+// hasPendingJob reports whether a job of that type is queued or running on
+// the project
+func hasPendingJob(project, jobType string) bool {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, e := range jobs {
+		if e.Project == project && e.Type == jobType && (e.Status == JobQueued || e.Status == JobRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+// setJobProgress updates the progress of the job ctx belongs to
+func setJobProgress(ctx context.Context, percent int, step string) {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	if id == "" {
+		return
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	e, ok := jobs[id]
+	if !ok || e.Status != JobRunning || (percent <= e.Progress && (step == "" || step == e.Step)) {
+		return
+	}
+	if percent > e.Progress {
+		e.Progress = percent
+	}
+	if step != "" {
+		e.Step = step
+	}
+	e.dirty = true
+	e.publish(JobEvent{Type: "progress", Progress: e.Progress, Step: e.Step})
+}
+
+// jobLog appends a line to the output of the job ctx belongs to
+func jobLog(ctx context.Context, line string) {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	if id == "" {
+		return
+	}
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	if e, ok := jobs[id]; ok && e.Status == JobRunning {
+		e.appendLine(line)
+	}
+}
+
+// CancelJob drops a queued job or stops a running one
+func CancelJob(id, user string) (Job, error) {
+	jobsMu.Lock()
+	e, ok := jobs[id]
+	if !ok || (e.Status != JobQueued && e.Status != JobRunning) {
+		jobsMu.Unlock()
+		return Job{}, fmt.Errorf("job %s is not queued or running", id)
+	}
+	e.canceledBy = user
+	if e.Status == JobQueued {
+		now := time.Now()
+		e.Status = JobCanceled
+		e.Error = "canceled by " + user
+		e.FinishedAt = &now
+		e.cancel()
+		e.finish()
+	} else {
+		e.appendLine("Cancel requested by " + user)
+		e.cancel()
+	}
+	job := e.snapshot(false)
+	jobsMu.Unlock()
+	saveJob(e)
+	return job, nil
+}
+
+func GetJob(id string) (Job, error) {
+	jobsMu.Lock()
+	if e, ok := jobs[id]; ok {
+		defer jobsMu.Unlock()
+		return e.snapshot(true), nil
+	}
+	jobsMu.Unlock()
+
+	if database.DB != nil {
+		var records []database.Job
+		database.DB.Where("id = ?", id).Limit(1).Find(&records)
+		if len(records) > 0 {
+			return jobFromRecord(records[0]), nil
+		}
+	}
+	return Job{}, fmt.Errorf("job %s not found", id)
+}
+
+// ListJobs returns jobs newest first, without their output
+func ListJobs(filter JobFilter) []Job {
+	if filter.Limit <= 0 || filter.Limit > maxJobs {
+		filter.Limit = defaultJobsLimit
+	}
+	list := []Job{}
+
+	if database.DB != nil {
+		query := database.DB.Omit("output").Order("created_at desc").Limit(filter.Limit)
+		if filter.Project != "" {
+			query = query.Where("project = ?", filter.Project)
+		}
+		if filter.Status != "" {
+			query = query.Where("status = ?", filter.Status)
+		}
+		if filter.Type != "" {
+			query = query.Where("type = ?", filter.Type)
+		}
+		var records []database.Job
+		if err := query.Find(&records).Error; err == nil {
+			// Jobs still running are fresher in memory than in the database
+			jobsMu.Lock()
+			defer jobsMu.Unlock()
+			for _, r := range records {
+				if e, ok := jobs[r.ID]; ok {
+					list = append(list, e.snapshot(false))
+				} else {
+					job := jobFromRecord(r)
+					job.Output = nil
+					list = append(list, job)
+				}
+			}
+			return list
+		}
+	}
+
+	jobsMu.Lock()
+	for _, e := range jobs {
+		if (filter.Project == "" || e.Project == filter.Project) &&
+			(filter.Status == "" || e.Status == filter.Status) &&
+			(filter.Type == "" || e.Type == filter.Type) {
+			list = append(list, e.snapshot(false))
+		}
+	}
+	jobsMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	if len(list) > filter.Limit {
+		list = list[:filter.Limit]
+	}
+	return list
+}
+
+// SubscribeJob returns the events a client following a job has missed,
+// from the output line after `after` on, and a channel of the next ones.
+// The channel is nil when the job is over (the backlog then ends with its
+// done event), and is closed after the done event or if the client falls
+// behind. stop must be called once the client is gone.
+func SubscribeJob(id string, after int) ([]JobEvent, <-chan JobEvent, func(), error) {
+	jobsMu.Lock()
+	e, ok := jobs[id]
+	if !ok {
+		jobsMu.Unlock()
+		job, err := GetJob(id)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return jobBacklog(job, after), nil, func() {}, nil
+	}
+	defer jobsMu.Unlock()
+
+	backlog := jobBacklog(e.snapshot(true), after)
+	if e.Status != JobQueued && e.Status != JobRunning {
+		return backlog, nil, func() {}, nil
+	}
+	ch := make(chan JobEvent, jobEventBuffer)
+	if e.subs == nil {
+		e.subs = map[chan JobEvent]bool{}
+	}
+	e.subs[ch] = true
+	stop := func() {
+		jobsMu.Lock()
+		defer jobsMu.Unlock()
+		if e.subs[ch] {
+			delete(e.subs, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, stop, nil
+}
+
+// jobBacklog lists the output lines of a job after line `after`, then its
+// current state
+func jobBacklog(job Job, after int) []JobEvent {
+	events := []JobEvent{}
+	for i, line := range job.Output {
+		if n := job.DroppedLines + i + 1; n > after {
+			events = append(events, JobEvent{Type: "line", Line: n, Text: line})
+		}
+	}
+	switch job.Status {
+	case JobQueued, JobRunning:
+		events = append(events, JobEvent{Type: "state", Status: job.Status, Progress: job.Progress, Step: job.Step})
+	default:
+		job.Output = nil
+		events = append(events, JobEvent{Type: "done", Status: job.Status, Progress: job.Progress, Step: job.Step, Job: &job})
+	}
+	return events
+}
+
+// StreamJob sends the events of a job after output line `after` to send,
+// until the job is over or ctx is done. While nothing happens it sends a
+// ping event every jobPingInterval so idle connections stay open.
+func StreamJob(ctx context.Context, id string, after int, send func(JobEvent)) error {
+	ping := time.NewTicker(jobPingInterval)
+	defer ping.Stop()
+	for {
+		backlog, events, stop, err := SubscribeJob(id, after)
+		if err != nil {
+			return err
+		}
+		handle := func(ev JobEvent) bool {
+			if ev.Type == "line" {
+				after = ev.Line
+			}
+			send(ev)
+			return ev.Type == "done"
+		}
+		for _, ev := range backlog {
+			if handle(ev) {
+				stop()
+				return nil
+			}
+		}
+
+		lagged := false
+		for !lagged {
+			select {
+			case <-ctx.Done():
+				stop()
+				return ctx.Err()
+			case <-ping.C:
+				send(JobEvent{Type: "ping"})
+			case ev, ok := <-events:
+				if !ok {
+					// Fell behind: catch up from the last line sent
+					lagged = true
+					break
+				}
+				if handle(ev) {
+					stop()
+					return nil
+				}
+			}
+		}
+		stop()
+	}
+}
+
+// FollowJob calls onLine with every output line of a job, from the start,
+// until the job ends or ctx is done, and returns the job's last state
+func FollowJob(ctx context.Context, id string, onLine func(line string)) (Job, error) {
+	var final Job
+	err := StreamJob(ctx, id, 0, func(ev JobEvent) {
+		switch {
+		case ev.Type == "line":
+			onLine(ev.Text)
+		case ev.Job != nil:
+			final = *ev.Job
+		}
+	})
+	if err != nil {
+		final, _ = GetJob(id)
+	}
+	return final, err
+}
+
+// StartJobQueue picks up the jobs a previous run of the panel left queued
+// or running, then keeps the database copy of running jobs up to date
+func StartJobQueue() {
+	queueOnce.Do(func() {
+		resumeJobs()
+		go func() {
+			for range time.Tick(jobFlushInterval) {
+				flushJobs()
+			}
+		}()
+		scheduleJobs()
+	})
+}
+
+func resumeJobs() {
+	if database.DB == nil {
+		return
+	}
+	var records []database.Job
+	database.DB.Where("status IN ?", []string{JobQueued, JobRunning}).Order("created_at").Find(&records)
+	for _, r := range records {
+		job := jobFromRecord(r)
+		var task jobTask
+		if r.ParamsEncrypted != "" {
+			if raw, err := security.DecryptString(r.ParamsEncrypted); err == nil {
+				task = resumeTask(job, []byte(raw))
+			}
+		}
+
+		e := newJobEntry(job.Type, job.Project, job.User, task)
+		e.Job = job
+		e.ctx, e.cancel = context.WithCancel(context.WithValue(context.Background(), jobIDKey{}, job.ID))
+		e.params = r.ParamsEncrypted
+		if task == nil {
+			now := time.Now()
+			e.Status = JobFailed
+			e.Error = "interrupted by a panel restart"
+			e.FinishedAt = &now
+			e.cancel()
+		} else {
+			e.Status = JobQueued
+			e.Progress = 0
+			e.Step = ""
+			e.StartedAt = nil
+			e.Output = append(e.Output, "--- Panel restarted, job queued again ---")
+		}
+		jobsMu.Lock()
+		jobs[e.ID] = e
+		jobsMu.Unlock()
+		saveJob(e)
+	}
+	jobsMu.Lock()
+	pruneJobs()
+	jobsMu.Unlock()
+}
+
+// resumeTask rebuilds the work of a job interrupted by a panel restart.
+// Only jobs that are safe to run again from the start have params.
+func resumeTask(job Job, params []byte) jobTask {
+	switch job.Type {
+	case "install":
+		var p installParams
+		if json.Unmarshal(params, &p) == nil {
+			return installTask(p.App, p.EnvVars, job.User)
+		}
+	case "deploy", "build":
+		return deployTask(job.Project, job.User)
+	case "update":
+		var p updateParams
+		if json.Unmarshal(params, &p) == nil {
+			return updateTask(job.Project, job.User, p.Auto)
+		}
+	case "backup":
+		return backupTask(job.Project)
+	case "restore":
+		var p restoreParams
+		if json.Unmarshal(params, &p) == nil {
+			return restoreTask(job.Project, p.File, job.User)
+		}
+	case "pull":
+		var p pullParams
+		if json.Unmarshal(params, &p) == nil {
+			return pullTask(p.Image)
+		}
+	}
+	return nil
+}
+
+// flushJobs saves the output and progress of running jobs
+func flushJobs() {
+	jobsMu.Lock()
+	dirty := []*jobEntry{}
+	for _, e := range jobs {
+		if e.dirty {
+			dirty = append(dirty, e)
+		}
+	}
+	jobsMu.Unlock()
+	for _, e := range dirty {
+		saveJob(e)
+	}
+}
+
+// saveJob writes the current state of a job to the database. Saves are
+// serialized and take their snapshot inside the lock, so an older state
+// never overwrites a newer one.
+func saveJob(e *jobEntry) {
+	if database.DB == nil {
+		return
+	}
+	jobSaveMu.Lock()
+	defer jobSaveMu.Unlock()
+
+	jobsMu.Lock()
+	job := e.snapshot(true)
+	e.dirty = false
+	jobsMu.Unlock()
+
+	record := database.Job{
+		ID:              job.ID,
+		Type:            job.Type,
+		Project:         job.Project,
+		User:            job.User,
+		Status:          job.Status,
+		Progress:        job.Progress,
+		Step:            job.Step,
+		ParamsEncrypted: e.params,
+		Output:          job.Output,
+		DroppedLines:    job.DroppedLines,
+		Error:           job.Error,
+		ErrorLine:       job.ErrorLine,
+		CreatedAt:       job.CreatedAt,
+		StartedAt:       job.StartedAt,
+		FinishedAt:      job.FinishedAt,
+	}
+	if err := database.DB.Save(&record).Error; err != nil {
+		log.Printf("Failed to save job %s: %v", job.ID, err)
+	}
+}
+
+func jobFromRecord(r database.Job) Job {
+	output := r.Output
+	if output == nil {
+		output = []string{}
+	}
+	return Job{
+		ID:           r.ID,
+		Type:         r.Type,
+		Project:      r.Project,
+		User:         r.User,
+		Status:       r.Status,
+		Progress:     r.Progress,
+		Step:         r.Step,
+		Output:       output,
+		DroppedLines: r.DroppedLines,
+		Error:        r.Error,
+		ErrorLine:    r.ErrorLine,
+		CreatedAt:    r.CreatedAt,
+		StartedAt:    r.StartedAt,
+		FinishedAt:   r.FinishedAt,
+	}
+}
+
+// pruneJobs drops the oldest finished jobs from memory; they stay in the
+// database. Callers hold jobsMu.
+func pruneJobs() {
+	for len(jobs) > maxJobs {
+		var oldest *jobEntry
+		for _, e := range jobs {
+			finished := e.Status != JobQueued && e.Status != JobRunning
+			if finished && (oldest == nil || e.CreatedAt.Before(oldest.CreatedAt)) {
+				oldest = e
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		delete(jobs, oldest.ID)
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// streamCompose runs a compose command of a project until it ends or ctx
+// is done, sending its output to logf
+func streamCompose(ctx context.Context, project string, logf JobLogger, args ...string) error {
+	logf("$ docker compose " + strings.Join(args, " "))
+	cmd := composeCmd(ctx, project, args...)
+	return withRegistryAuth(cmd, func() error {
+		return streamCommand(cmd, logf)
+	})
+}
+
+// streamDocker runs a docker command until it ends or ctx is done, sending
+// its output to logf
+func streamDocker(ctx context.Context, logf JobLogger, args ...string) error {
+	logf("$ docker " + strings.Join(args, " "))
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	return withRegistryAuth(cmd, func() error {
+		return streamCommand(cmd, logf)
+	})
+}
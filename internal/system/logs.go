@@ -34,8 +34,8 @@ func GetSystemLogs(logType string, lines int) ([]string, error) {
 	case "foxdocker":
 		cmd = exec.Command("tail", "-n", fmt.Sprintf("%d", lines), "data/foxdocker.log")
 	case "docker":
-		// Snapshot of recent events to avoid blocking SSE
-		cmd = exec.Command("docker", "events", "--since", "5m", "--until", "0s")
+		// Served from the event watcher's buffer instead of spawning docker events
+		return recentDockerEvents(lines), nil
 	default:
 		return nil, fmt.Errorf("unknown log type: %s", logType)
 	}
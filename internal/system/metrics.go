@@ -0,0 +1,138 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// HostStats is the latest host reading served by /api/system/stats
+type HostStats struct {
+	CPU       float64 `json:"cpu"`
+	RAM       float64 `json:"ram"`
+	Disk      float64 `json:"disk"`
+	Uptime    string  `json:"uptime"`
+	SampledAt string  `json:"sampled_at"`
+}
+
+// ContainerStat keeps the field names of `docker stats --format json`
+type ContainerStat struct {
+	ID       string `json:"ID"`
+	Name     string `json:"Name"`
+	CPUPerc  string `json:"CPUPerc"`
+	MemUsage string `json:"MemUsage"`
+	MemPerc  string `json:"MemPerc"`
+	NetIO    string `json:"NetIO"`
+	BlockIO  string `json:"BlockIO"`
+	PIDs     string `json:"PIDs"`
+}
+
+var (
+	metricsMu      sync.RWMutex
+	hostStats      HostStats
+	containerStats = []ContainerStat{}
+	samplerOnce    sync.Once
+)
+
+// StartMetricsSampler launches the background loops that refresh host and
+// container readings. Handlers only read the cached values, so polling the
+// dashboard never blocks on cpu.Percent or `docker stats`.
+func StartMetricsSampler(hostInterval, containerInterval time.Duration) {
+	samplerOnce.Do(func() {
+		go sampleHostLoop(hostInterval)
+		go sampleContainersLoop(containerInterval)
+	})
+}
+
+func GetHostStats() HostStats {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return hostStats
+}
+
+func GetContainerStats() []ContainerStat {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	out := make([]ContainerStat, len(containerStats))
+	copy(out, containerStats)
+	return out
+}
+
+func sampleHostLoop(interval time.Duration) {
+	for {
+		// cpu.Percent blocks for the whole interval and reports usage over it,
+		// which doubles as the loop delay.
+		c, err := cpu.Percent(interval, false)
+		if err != nil {
+			time.Sleep(interval)
+		}
+
+		stats := HostStats{SampledAt: time.Now().Format(time.RFC3339)}
+		if len(c) > 0 {
+			stats.CPU = c[0]
+		}
+		if vm, err := mem.VirtualMemory(); err == nil {
+			stats.RAM = vm.UsedPercent
+		}
+		if d, err := disk.Usage("/"); err == nil {
+			stats.Disk = d.UsedPercent
+		}
+		if up, err := host.Uptime(); err == nil {
+			stats.Uptime = formatUptime(time.Duration(up) * time.Second)
+		}
+
+		metricsMu.Lock()
+		hostStats = stats
+		metricsMu.Unlock()
+	}
+}
+
+func sampleContainersLoop(interval time.Duration) {
+	for {
+		stats, err := readContainerStats()
+		if err != nil {
+			log.Printf("Container stats sampling failed: %v", err)
+		} else {
+			metricsMu.Lock()
+			containerStats = stats
+			metricsMu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+func readContainerStats() ([]ContainerStat, error) {
+	cmd := exec.Command("docker", "stats", "--no-stream", "--format", "json")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []ContainerStat{}
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var s ContainerStat
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			continue
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+func formatUptime(d time.Duration) string {
+	return fmt.Sprintf("%dd %dh %dm", int(d.Hours())/24, int(d.Hours())%24, int(d.Minutes())%60)
+}
@@ -0,0 +1,226 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// TraefikNetwork is the shared network Traefik uses to reach web-facing services
+const TraefikNetwork = "foxdocker-network"
+
+// NetworkInfo describes a docker network and its attached containers
+type NetworkInfo struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Scope      string            `json:"scope"`
+	Internal   bool              `json:"internal"`
+	Subnets    []string          `json:"subnets"`
+	Labels     map[string]string `json:"labels"`
+	Containers []string          `json:"containers"`
+	Project    string            `json:"project"`
+	System     bool              `json:"system"`
+}
+
+var networkNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// protectedNetworks can never be removed from the panel
+var protectedNetworks = map[string]bool{"bridge": true, "host": true, "none": true, TraefikNetwork: true}
+
+type networkInspect struct {
+	ID       string            `json:"Id"`
+	Name     string            `json:"Name"`
+	Driver   string            `json:"Driver"`
+	Scope    string            `json:"Scope"`
+	Internal bool              `json:"Internal"`
+	Labels   map[string]string `json:"Labels"`
+	IPAM     struct {
+		Config []struct {
+			Subnet string `json:"Subnet"`
+		} `json:"Config"`
+	} `json:"IPAM"`
+	Containers map[string]struct {
+		Name string `json:"Name"`
+	} `json:"Containers"`
+}
+
+func inspectNetworks(names ...string) ([]networkInspect, error) {
+	output, err := runDocker(append([]string{"network", "inspect"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	var networks []networkInspect
+	if err := json.Unmarshal([]byte(output), &networks); err != nil {
+		return nil, err
+	}
+	return networks, nil
+}
+
+func toNetworkInfo(n networkInspect) NetworkInfo {
+	info := NetworkInfo{
+		ID:         n.ID,
+		Name:       n.Name,
+		Driver:     n.Driver,
+		Scope:      n.Scope,
+		Internal:   n.Internal,
+		Subnets:    []string{},
+		Labels:     n.Labels,
+		Containers: []string{},
+		Project:    n.Labels[composeProjectLabel],
+		System:     protectedNetworks[n.Name],
+	}
+	for _, cfg := range n.IPAM.Config {
+		info.Subnets = append(info.Subnets, cfg.Subnet)
+	}
+	for _, ct := range n.Containers {
+		info.Containers = append(info.Containers, ct.Name)
+	}
+	sort.Strings(info.Containers)
+	return info
+}
+
+func ListNetworks() ([]NetworkInfo, error) {
+	ids, err := runDocker("network", "ls", "-q", "--no-trunc")
+	if err != nil {
+		return nil, err
+	}
+	idList := splitLines(ids)
+	if len(idList) == 0 {
+		return []NetworkInfo{}, nil
+	}
+	inspected, err := inspectNetworks(idList...)
+	if err != nil {
+		return nil, err
+	}
+	networks := make([]NetworkInfo, 0, len(inspected))
+	for _, n := range inspected {
+		networks = append(networks, toNetworkInfo(n))
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Name < networks[j].Name })
+	return networks, nil
+}
+
+func GetNetwork(name string) (NetworkInfo, error) {
+	if err := validRef(name); err != nil {
+		return NetworkInfo{}, err
+	}
+	inspected, err := inspectNetworks(name)
+	if err != nil {
+		return NetworkInfo{}, err
+	}
+	if len(inspected) == 0 {
+		return NetworkInfo{}, fmt.Errorf("network %s not found", name)
+	}
+	return toNetworkInfo(inspected[0]), nil
+}
+
+func CreateNetwork(name, driver string, internal bool, labels map[string]string) error {
+	if !networkNameRe.MatchString(name) {
+		return fmt.Errorf("invalid network name: %q", name)
+	}
+	if driver == "" {
+		driver = "bridge"
+	}
+	args := []string{"network", "create", "--driver", driver}
+	if internal {
+		args = append(args, "--internal")
+	}
+	for k, v := range labels {
+		args = append(args, "--label", k+"="+v)
+	}
+	_, err := runDocker(append(args, name)...)
+	return err
+}
+
+// RemoveNetwork deletes a network that has no attached containers
+func RemoveNetwork(name string) error {
+	if protectedNetworks[name] {
+		return fmt.Errorf("network %s is managed by the system", name)
+	}
+	n, err := GetNetwork(name)
+	if err != nil {
+		return err
+	}
+	if len(n.Containers) > 0 {
+		return fmt.Errorf("network %s still has containers attached: %s", name, strings.Join(n.Containers, ", "))
+	}
+	_, err = runDocker("network", "rm", name)
+	return err
+}
+
+func ConnectNetwork(network, container string) error {
+	if err := validRef(network); err != nil {
+		return err
+	}
+	if err := validRef(container); err != nil {
+		return err
+	}
+	_, err := runDocker("network", "connect", network, container)
+	return err
+}
+
+func DisconnectNetwork(network, container string) error {
+	if err := validRef(network); err != nil {
+		return err
+	}
+	if err := validRef(container); err != nil {
+		return err
+	}
+	_, err := runDocker("network", "disconnect", network, container)
+	return err
+}
+
+// EnsureTraefikNetwork creates the shared Traefik network when it is missing,
+// since project compose files declare it as external.
+func EnsureTraefikNetwork() error {
+	if _, err := runDocker("network", "inspect", TraefikNetwork); err == nil {
+		return nil
+	}
+	return CreateNetwork(TraefikNetwork, "bridge", false, nil)
+}
+
+// panelContainer is the container name the deploy files give the panel
+const panelContainer = "fox-admin"
+
+// AttachTraefikNetwork connects the running Traefik and panel containers to
+// TraefikNetwork. Installs from before the deploy files declared it only
+// have them on fox-net, where Traefik cannot reach the routed projects.
+func AttachTraefikNetwork() {
+	if err := EnsureTraefikNetwork(); err != nil {
+		log.Printf("Failed to create the %s network: %v", TraefikNetwork, err)
+		return
+	}
+	output, err := runDocker("ps", "--format", "{{.ID}}|{{.Names}}|{{.Image}}|{{.Networks}}")
+	if err != nil {
+		return
+	}
+	for _, line := range splitLines(output) {
+		parts := strings.SplitN(line, "|", 4)
+		if len(parts) != 4 || (parts[1] != panelContainer && path.Base(imageRepo(parts[2])) != "traefik") {
+			continue
+		}
+		attached := false
+		for _, n := range strings.Split(parts[3], ",") {
+			attached = attached || n == TraefikNetwork
+		}
+		if attached {
+			continue
+		}
+		if err := ConnectNetwork(TraefikNetwork, parts[0]); err != nil {
+			log.Printf("Failed to connect %s to %s: %v", parts[1], TraefikNetwork, err)
+			continue
+		}
+		log.Printf("Connected %s to %s", parts[1], TraefikNetwork)
+	}
+}
+
+// projectNetworkName is the private network every service of a project joins
+func projectNetworkName(project string) string {
+	return project + "-private"
+}
@@ -0,0 +1,372 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/goccy/go-yaml"
+)
+
+// Compose project names: lowercase letters, digits, dashes and underscores
+var projectNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+const maxComposeSize = 1 << 20
+
+// ProjectSpec describes a project created from a compose file
+type ProjectSpec struct {
+	Name    string   `json:"name"`
+	Compose string   `json:"compose"`
+	Env     string   `json:"env"` // optional .env used for compose interpolation
+	Domains []string `json:"domains"`
+	// Service exposed on the domains; defaults to the first one with a port
+	Service string `json:"service"`
+	// Container port Traefik forwards to; defaults to the service's first port
+	Port int `json:"port"`
+}
+
+// ValidateNewProjectName checks a name is usable and not taken
+func ValidateNewProjectName(name string) error {
+	if !projectNameRe.MatchString(name) {
+		return fmt.Errorf("invalid project name %q: use lowercase letters, digits, - and _", name)
+	}
+	if _, err := os.Stat(filepath.Join(ProjectsRoot, name)); err == nil {
+		return fmt.Errorf("project %s already exists", name)
+	}
+	return nil
+}
+
+// IsProjectDir reports whether an entry of ProjectsRoot is a project, and
+// not one of the panel's scratch directories
+func IsProjectDir(entry os.DirEntry) bool {
+	return entry.IsDir() && !strings.HasPrefix(entry.Name(), ".")
+}
+
+// projectTempDir creates a scratch directory inside ProjectsRoot, so its
+// content becomes a project directory with a rename on the same filesystem
+func projectTempDir(kind string) (string, error) {
+	if err := os.MkdirAll(ProjectsRoot, 0755); err != nil {
+		return "", err
+	}
+	return os.MkdirTemp(ProjectsRoot, "."+kind+"-*")
+}
+
+// CreateProject validates a compose file, routes the requested domains to
+// it through Traefik, stores it under ProjectsRoot/<name>, registers the
+// project and brings it up as a job.
+func CreateProject(spec ProjectSpec, user string) (Job, error) {
+	if err := ValidateNewProjectName(spec.Name); err != nil {
+		return Job{}, err
+	}
+	if len(spec.Compose) > maxComposeSize {
+		return Job{}, fmt.Errorf("compose file is larger than 1MB")
+	}
+	doc, err := ParseComposeDocument([]byte(spec.Compose))
+	if err != nil {
+		return Job{}, err
+	}
+	if err := validateEnvFile(spec.Env); err != nil {
+		return Job{}, err
+	}
+	for _, d := range spec.Domains {
+		if err := ValidateDomain(d); err != nil {
+			return Job{}, err
+		}
+	}
+
+	doc = isolateProjectNetwork(doc, spec.Name)
+	if len(spec.Domains) > 0 {
+		if doc, err = routeDomains(doc, spec.Name, spec.Service, spec.Port, spec.Domains); err != nil {
+			return Job{}, err
+		}
+	}
+	content, err := yaml.MarshalWithOptions(doc, yaml.IndentSequence(true))
+	if err != nil {
+		return Job{}, err
+	}
+
+	dir := filepath.Join(ProjectsRoot, spec.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Job{}, fmt.Errorf("failed to create project directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), content, 0644); err != nil {
+		os.RemoveAll(dir)
+		return Job{}, fmt.Errorf("failed to write docker-compose.yml: %v", err)
+	}
+	if spec.Env != "" {
+		// .env usually holds passwords: keep it private
+		if err := os.WriteFile(filepath.Join(dir, ".env"), []byte(spec.Env), 0600); err != nil {
+			os.RemoveAll(dir)
+			return Job{}, fmt.Errorf("failed to write .env: %v", err)
+		}
+	}
+
+	RecordProjectChange(spec.Name, user, "Create project", "docker-compose.yml")
+
+	if database.DB != nil {
+		p := getOrCreateProject(spec.Name)
+		database.DB.Model(&p).Updates(map[string]interface{}{
+			"image":  firstServiceImage(doc),
+			"status": "creating",
+		})
+	}
+
+	name := spec.Name
+	return StartJob("create", name, user, func(ctx context.Context, logf JobLogger) error {
+		if usesTraefikNetwork(doc) {
+			if err := EnsureTraefikNetwork(); err != nil {
+				return fmt.Errorf("failed to prepare traefik network: %v", err)
+			}
+		}
+		if err := streamCompose(ctx, name, logf, "up", "-d"); err != nil {
+			if database.DB != nil {
+				database.DB.Model(&database.Project{}).Where("name = ?", name).Update("status", "error")
+			}
+			return err
+		}
+		syncProjectStatus(name)
+		recordDeploymentLogged(name, user, "create", "")
+		return nil
+	}), nil
+}
+
+// StopProject stops the containers of a project
+func StopProject(project string) error {
+	if !composeNameRe.MatchString(project) || !projectExists(project) {
+		return fmt.Errorf("project %s not found", project)
+	}
+	_, err := runCompose(project, "stop")
+	return err
+}
+
+// RemoveProject takes a project down with its volumes, then deletes its
+// directory and secrets. A failing `compose down` is logged, not fatal, so
+// a broken project can still be removed.
+func RemoveProject(project string) error {
+	if !composeNameRe.MatchString(project) {
+		return fmt.Errorf("invalid project name %q", project)
+	}
+	if _, err := runCompose(project, "down", "-v"); err != nil {
+		log.Printf("Failed to take down project %s before removing it: %v", project, err)
+	}
+	// The record stays behind so GC knows leftovers of this name are the panel's
+	if projectExists(project) {
+		getOrCreateProject(project)
+	}
+	if err := os.RemoveAll(filepath.Join(ProjectsRoot, project)); err != nil {
+		return err
+	}
+	DeleteProjectSecrets(project)
+	return nil
+}
+
+// validateEnvFile accepts KEY=VALUE lines, comments and blank lines
+func validateEnvFile(content string) error {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, _, found := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+		if !found || !envKeyRe.MatchString(strings.TrimSpace(key)) {
+			return fmt.Errorf(".env line %d is not KEY=VALUE", line)
+		}
+	}
+	return scanner.Err()
+}
+
+// isolateProjectNetwork names the project's default network <name>-private
+// unless the file configures it itself
+func isolateProjectNetwork(doc yaml.MapSlice, project string) yaml.MapSlice {
+	networks, _ := mapValue(doc, "networks").(yaml.MapSlice)
+	if mapHasKey(networks, "default") {
+		return doc
+	}
+	networks = append(yaml.MapSlice{{Key: "default", Value: yaml.MapSlice{{Key: "name", Value: projectNetworkName(project)}}}}, networks...)
+	return setMapValue(doc, "networks", networks)
+}
+
+// routeDomains attaches a service to the Traefik network and adds the
+// router labels for the domains
+func routeDomains(doc yaml.MapSlice, project, service string, port int, domains []string) (yaml.MapSlice, error) {
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	if service == "" {
+		service = defaultWebService(services)
+	}
+	def, ok := mapValue(services, service).(yaml.MapSlice)
+	if !ok {
+		return nil, fmt.Errorf("service %s not found in compose file", service)
+	}
+	if port == 0 {
+		port = serviceContainerPort(def)
+	}
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("cannot tell which port service %s listens on, set it explicitly", service)
+	}
+
+	// Networks: keep the ones declared, make sure default and traefik are in
+	switch n := mapValue(def, "networks").(type) {
+	case yaml.MapSlice:
+		if !mapHasKey(n, "traefik") {
+			n = append(n, yaml.MapItem{Key: "traefik", Value: yaml.MapSlice{}})
+		}
+		def = setMapValue(def, "networks", n)
+	case []interface{}:
+		if !containsValue(n, "traefik") {
+			n = append(n, "traefik")
+		}
+		def = setMapValue(def, "networks", n)
+	default:
+		def = setMapValue(def, "networks", []interface{}{"default", "traefik"})
+	}
+
+	// Labels: replace any Traefik labels the file had with ours
+	labels := traefikLabels(project, domains, port)
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	switch l := mapValue(def, "labels").(type) {
+	case []interface{}:
+		kept := []interface{}{}
+		for _, e := range l {
+			if !strings.HasPrefix(fmt.Sprint(e), "traefik.") {
+				kept = append(kept, e)
+			}
+		}
+		for _, k := range keys {
+			kept = append(kept, k+"="+labels[k])
+		}
+		def = setMapValue(def, "labels", kept)
+	default:
+		kept, _ := l.(yaml.MapSlice)
+		merged := yaml.MapSlice{}
+		for _, item := range kept {
+			if !strings.HasPrefix(fmt.Sprint(item.Key), "traefik.") {
+				merged = append(merged, item)
+			}
+		}
+		for _, k := range keys {
+			merged = append(merged, yaml.MapItem{Key: k, Value: labels[k]})
+		}
+		def = setMapValue(def, "labels", merged)
+	}
+
+	services = setMapValue(services, service, def)
+	doc = setMapValue(doc, "services", services)
+
+	networks, _ := mapValue(doc, "networks").(yaml.MapSlice)
+	networks = setMapValue(networks, "traefik", yaml.MapSlice{
+		{Key: "name", Value: TraefikNetwork},
+		{Key: "external", Value: true},
+	})
+	return setMapValue(doc, "networks", networks), nil
+}
+
+// defaultWebService picks the first service that publishes or exposes a port
+func defaultWebService(services yaml.MapSlice) string {
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		if serviceContainerPort(def) > 0 {
+			return fmt.Sprint(svc.Key)
+		}
+	}
+	if len(services) > 0 {
+		return fmt.Sprint(services[0].Key)
+	}
+	return ""
+}
+
+// serviceContainerPort returns the first container port of a service, from
+// expose or ports
+func serviceContainerPort(def yaml.MapSlice) int {
+	if expose, ok := mapValue(def, "expose").([]interface{}); ok && len(expose) > 0 {
+		s, _, _ := strings.Cut(fmt.Sprint(expose[0]), "/")
+		if n, err := strconv.Atoi(s); err == nil {
+			return n
+		}
+	}
+	ports, _ := mapValue(def, "ports").([]interface{})
+	for _, p := range ports {
+		if long, ok := p.(yaml.MapSlice); ok {
+			if n, err := strconv.Atoi(fmt.Sprint(mapValue(long, "target"))); err == nil {
+				return n
+			}
+			continue
+		}
+		s, _, _ := strings.Cut(fmt.Sprint(p), "/")
+		parts := strings.Split(s, ":")
+		if n, err := strconv.Atoi(parts[len(parts)-1]); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// setMapValue replaces a key in place, or appends it
+func setMapValue(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
+
+// deleteMapKey removes a key, keeping the order of the others
+func deleteMapKey(m yaml.MapSlice, key string) yaml.MapSlice {
+	kept := yaml.MapSlice{}
+	for _, item := range m {
+		if fmt.Sprint(item.Key) != key {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func containsValue(list []interface{}, s string) bool {
+	for _, v := range list {
+		if fmt.Sprint(v) == s {
+			return true
+		}
+	}
+	return false
+}
+
+func firstServiceImage(doc yaml.MapSlice) string {
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		if img := mapValue(def, "image"); img != nil {
+			return fmt.Sprint(img)
+		}
+	}
+	return ""
+}
+
+// usesTraefikNetwork reports whether the document declares the shared
+// Traefik network as external
+func usesTraefikNetwork(doc yaml.MapSlice) bool {
+	networks, _ := mapValue(doc, "networks").(yaml.MapSlice)
+	for _, n := range networks {
+		def, _ := n.Value.(yaml.MapSlice)
+		if fmt.Sprint(mapValue(def, "name")) == TraefikNetwork {
+			return true
+		}
+	}
+	return false
+}
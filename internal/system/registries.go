@@ -0,0 +1,311 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+)
+
+// RegistryCredential is a stored login for Docker Hub, GHCR or a self-hosted
+// registry. Password is encrypted on disk and never returned by the API.
+type RegistryCredential struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Server    string `json:"server"` // e.g. docker.io, ghcr.io, localhost:5000
+	Username  string `json:"username"`
+	Password  string `json:"password,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+const registriesFile = "data/registries.json"
+
+// dockerHubAuthKey is the key Docker Hub credentials use in config.json
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+var registriesMu sync.Mutex
+
+func loadRegistries() ([]RegistryCredential, error) {
+	file, err := os.ReadFile(registriesFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []RegistryCredential{}, nil
+		}
+		return nil, err
+	}
+	var creds []RegistryCredential
+	err = json.Unmarshal(file, &creds)
+	return creds, err
+}
+
+func saveRegistries(creds []RegistryCredential) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(registriesFile, data, 0600)
+}
+
+// ListRegistries returns the stored credentials without passwords
+func ListRegistries() ([]RegistryCredential, error) {
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+
+	creds, err := loadRegistries()
+	if err != nil {
+		return nil, err
+	}
+	for i := range creds {
+		creds[i].Password = ""
+	}
+	return creds, nil
+}
+
+// SaveRegistry adds a credential, or updates the one with the same server.
+// An empty password on update keeps the stored one.
+func SaveRegistry(cred RegistryCredential) error {
+	cred.Server = normalizeRegistry(cred.Server)
+	if cred.Server == "" || cred.Username == "" {
+		return fmt.Errorf("server and username are required")
+	}
+
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+
+	creds, err := loadRegistries()
+	if err != nil {
+		return err
+	}
+
+	idx := -1
+	for i, c := range creds {
+		if c.Server == cred.Server {
+			idx = i
+		}
+	}
+	if cred.Password != "" {
+		enc, err := security.EncryptString(cred.Password)
+		if err != nil {
+			return err
+		}
+		cred.Password = enc
+	} else if idx >= 0 {
+		cred.Password = creds[idx].Password
+	} else {
+		return fmt.Errorf("password is required")
+	}
+
+	if cred.Name == "" {
+		cred.Name = cred.Server
+	}
+	if idx >= 0 {
+		cred.ID = creds[idx].ID
+		cred.CreatedAt = creds[idx].CreatedAt
+		creds[idx] = cred
+	} else {
+		cred.ID = fmt.Sprintf("%d", time.Now().UnixNano())
+		cred.CreatedAt = time.Now().Format("2006-01-02 15:04:05")
+		creds = append(creds, cred)
+	}
+	return saveRegistries(creds)
+}
+
+func DeleteRegistry(id string) error {
+	registriesMu.Lock()
+	defer registriesMu.Unlock()
+
+	creds, err := loadRegistries()
+	if err != nil {
+		return err
+	}
+	kept := []RegistryCredential{}
+	for _, c := range creds {
+		if c.ID != id {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == len(creds) {
+		return fmt.Errorf("registry %s not found", id)
+	}
+	return saveRegistries(kept)
+}
+
+// TestRegistryLogin runs `docker login` in a throwaway config directory, so
+// checking credentials never touches the host's docker config. When the
+// password is empty the stored one for that server is used.
+func TestRegistryLogin(server, username, password string) error {
+	server = normalizeRegistry(server)
+	if password == "" {
+		registriesMu.Lock()
+		creds, err := loadRegistries()
+		registriesMu.Unlock()
+		if err != nil {
+			return err
+		}
+		for _, c := range creds {
+			if c.Server == server {
+				if username == "" {
+					username = c.Username
+				}
+				if password, err = security.DecryptString(c.Password); err != nil {
+					return fmt.Errorf("failed to decrypt stored password: %v", err)
+				}
+			}
+		}
+	}
+	if server == "" || username == "" || password == "" {
+		return fmt.Errorf("server, username and password are required")
+	}
+
+	dir, err := os.MkdirTemp("", "foxdocker-login-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command("docker", "login", loginServer(server), "-u", username, "--password-stdin")
+	cmd.Env = append(os.Environ(), "DOCKER_CONFIG="+dir)
+	cmd.Stdin = strings.NewReader(password)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("login failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// registryAuthEnv writes every stored credential into a temporary docker
+// config and returns the environment that points docker at it. Pulls and
+// compose runs use it so private images work without a host-wide login.
+// The temporary config is a copy of the host's one, so its logins, credential
+// helpers and CLI plugins (compose, buildx) keep working. cleanup must always
+// be called.
+func registryAuthEnv() (env []string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	registriesMu.Lock()
+	creds, err := loadRegistries()
+	registriesMu.Unlock()
+	if err != nil || len(creds) == 0 {
+		return nil, cleanup, err
+	}
+
+	base := dockerConfigDir()
+	config := map[string]interface{}{}
+	if data, err := os.ReadFile(filepath.Join(base, "config.json")); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, cleanup, fmt.Errorf("failed to read %s: %v", filepath.Join(base, "config.json"), err)
+		}
+	}
+	auths, _ := config["auths"].(map[string]interface{})
+	if auths == nil {
+		auths = map[string]interface{}{}
+	}
+	helpers, _ := config["credHelpers"].(map[string]interface{})
+	if helpers == nil {
+		helpers = map[string]interface{}{}
+	}
+	// A credentials store answers for every registry, so it would hide the
+	// panel's credentials: keep it only for the registries it holds
+	if store, _ := config["credsStore"].(string); store != "" {
+		for server := range auths {
+			if _, ok := helpers[server]; !ok {
+				helpers[server] = store
+			}
+		}
+		delete(config, "credsStore")
+	}
+	for _, c := range creds {
+		password, err := security.DecryptString(c.Password)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("failed to decrypt credentials for %s: %v", c.Server, err)
+		}
+		server := loginServer(c.Server)
+		auths[server] = map[string]string{
+			"auth": base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + password)),
+		}
+		delete(helpers, server)
+	}
+	config["auths"] = auths
+	if len(helpers) > 0 {
+		config["credHelpers"] = helpers
+	} else {
+		delete(config, "credHelpers")
+	}
+
+	dir, err := os.MkdirTemp("", "foxdocker-auth-")
+	if err != nil {
+		return nil, cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	// Everything else in the config directory is shared: cli-plugins,
+	// contexts, buildx builders
+	if entries, err := os.ReadDir(base); err == nil {
+		for _, e := range entries {
+			if e.Name() != "config.json" {
+				os.Symlink(filepath.Join(base, e.Name()), filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	data, _ := json.Marshal(config)
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0600); err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	return []string{"DOCKER_CONFIG=" + dir}, cleanup, nil
+}
+
+// dockerConfigDir is the docker client configuration commands use by default
+func dockerConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".docker"
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// withRegistryAuth runs fn with cmd configured to use the stored credentials
+func withRegistryAuth(cmd *exec.Cmd, fn func() error) error {
+	env, cleanup, err := registryAuthEnv()
+	defer cleanup()
+	if err != nil {
+		return err
+	}
+	if len(env) > 0 {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, env...)
+	}
+	return fn()
+}
+
+func normalizeRegistry(server string) string {
+	server = strings.TrimSpace(server)
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server = strings.TrimSuffix(server, "/")
+	switch server {
+	case "index.docker.io", "index.docker.io/v1", "registry-1.docker.io", "hub.docker.com":
+		return "docker.io"
+	}
+	return server
+}
+
+// loginServer maps a normalized registry to the key docker uses for it
+func loginServer(server string) string {
+	if server == "docker.io" {
+		return dockerHubAuthKey
+	}
+	return server
+}
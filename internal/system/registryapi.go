@@ -0,0 +1,216 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+)
+
+// imageRef is an image reference split the way the registry API needs it
+type imageRef struct {
+	Registry   string // normalized, e.g. docker.io, ghcr.io, localhost:5000
+	Repository string // e.g. library/redis
+	Tag        string
+	Digest     string
+}
+
+var manifestAccept = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}, ", ")
+
+var registryClient = &http.Client{Timeout: 30 * time.Second}
+
+func parseImageRef(ref string) imageRef {
+	r := imageRef{Registry: "docker.io"}
+	if idx := strings.Index(ref, "@"); idx >= 0 {
+		r.Digest = ref[idx+1:]
+		ref = ref[:idx]
+	}
+	if idx := strings.LastIndex(ref, ":"); idx > strings.LastIndex(ref, "/") {
+		r.Tag = ref[idx+1:]
+		ref = ref[:idx]
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+
+	// The first path component is a registry host only if it looks like one
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.Registry = normalizeRegistry(parts[0])
+		ref = parts[1]
+	}
+	if r.Registry == "docker.io" && !strings.Contains(ref, "/") {
+		ref = "library/" + ref
+	}
+	r.Repository = ref
+	return r
+}
+
+// apiHost is the host that serves the registry v2 API
+func (r imageRef) apiHost() string {
+	if r.Registry == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return r.Registry
+}
+
+// RemoteDigest asks the registry for the current manifest digest of a tag,
+// handling the anonymous or credentialed bearer-token handshake.
+func RemoteDigest(ref string) (string, error) {
+	r := parseImageRef(ref)
+	if r.Digest != "" {
+		return r.Digest, nil
+	}
+
+	schemes := []string{"https"}
+	host := r.apiHost()
+	if strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		// Local test registries usually run without TLS
+		schemes = append(schemes, "http")
+	}
+
+	var lastErr error
+	for _, scheme := range schemes {
+		u := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, r.Repository, r.Tag)
+		digest, err := headManifest(u, r)
+		if err == nil {
+			return digest, nil
+		}
+		lastErr = err
+	}
+	return "", lastErr
+}
+
+func headManifest(u string, r imageRef) (string, error) {
+	username, password := registryCredentialFor(r.Registry)
+
+	do := func(auth string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodHead, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", manifestAccept)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		return registryClient.Do(req)
+	}
+
+	resp, err := do("")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		var auth string
+		switch {
+		case strings.HasPrefix(challenge, "Bearer "):
+			token, err := fetchRegistryToken(challenge, username, password)
+			if err != nil {
+				return "", err
+			}
+			auth = "Bearer " + token
+		case strings.HasPrefix(challenge, "Basic ") && username != "":
+			req, _ := http.NewRequest(http.MethodGet, u, nil)
+			req.SetBasicAuth(username, password)
+			auth = req.Header.Get("Authorization")
+		default:
+			return "", fmt.Errorf("registry %s requires authentication", r.Registry)
+		}
+		if resp, err = do(auth); err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry returned %s for %s:%s", resp.Status, r.Repository, r.Tag)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("registry did not return a digest for %s:%s", r.Repository, r.Tag)
+	}
+	return digest, nil
+}
+
+// fetchRegistryToken answers a `Bearer realm=...,service=...,scope=...` challenge
+func fetchRegistryToken(challenge, username, password string) (string, error) {
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("invalid auth challenge: %s", challenge)
+	}
+
+	q := url.Values{}
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		q.Set("scope", params["scope"])
+	}
+	req, err := http.NewRequest(http.MethodGet, realm+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// registryCredentialFor returns the decrypted stored login for a registry, if any
+func registryCredentialFor(server string) (string, string) {
+	registriesMu.Lock()
+	creds, err := loadRegistries()
+	registriesMu.Unlock()
+	if err != nil {
+		return "", ""
+	}
+	for _, c := range creds {
+		if c.Server == server {
+			password, err := security.DecryptString(c.Password)
+			if err != nil {
+				return "", ""
+			}
+			return c.Username, password
+		}
+	}
+	return "", ""
+}
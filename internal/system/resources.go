@@ -0,0 +1,264 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+// ServiceResources are the compose resource limits of one service.
+// Zero values mean "no limit".
+type ServiceResources struct {
+	CPUs              float64 `json:"cpus"`
+	Memory            string  `json:"memory"`             // e.g. "512m", "1g"
+	MemoryReservation string  `json:"memory_reservation"` // soft limit
+	PidsLimit         int     `json:"pids_limit"`
+}
+
+var memoryRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([bkmgBKMG]?)$`)
+
+// parseMemory converts a docker memory string to bytes (binary units)
+func parseMemory(s string) (int64, error) {
+	m := memoryRe.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, fmt.Errorf("invalid memory value %q, expected e.g. 512m or 1g", s)
+	}
+	v, _ := strconv.ParseFloat(m[1], 64)
+	switch strings.ToLower(m[2]) {
+	case "k":
+		v *= 1 << 10
+	case "m":
+		v *= 1 << 20
+	case "g":
+		v *= 1 << 30
+	}
+	return int64(v), nil
+}
+
+// Validate checks the limits are well-formed and fit on this host
+func (r ServiceResources) Validate() error {
+	if r.CPUs < 0 {
+		return fmt.Errorf("cpus cannot be negative")
+	}
+	if r.CPUs > 0 {
+		if cores, err := cpu.Counts(true); err == nil && r.CPUs > float64(cores) {
+			return fmt.Errorf("cpus %.2f exceeds the %d available cores", r.CPUs, cores)
+		}
+	}
+	var limit, reservation int64
+	var err error
+	if r.Memory != "" {
+		if limit, err = parseMemory(r.Memory); err != nil {
+			return err
+		}
+		if limit < 6<<20 {
+			return fmt.Errorf("memory limit must be at least 6m")
+		}
+	}
+	if r.MemoryReservation != "" {
+		if reservation, err = parseMemory(r.MemoryReservation); err != nil {
+			return err
+		}
+	}
+	if limit > 0 && reservation > limit {
+		return fmt.Errorf("memory_reservation cannot exceed memory")
+	}
+	if r.PidsLimit < 0 {
+		return fmt.Errorf("pids_limit cannot be negative")
+	}
+	return nil
+}
+
+// composeKeys maps the limits onto compose service keys; absent entries are removed
+func (r ServiceResources) composeKeys() map[string]interface{} {
+	keys := map[string]interface{}{}
+	if r.CPUs > 0 {
+		keys["cpus"] = r.CPUs
+	}
+	if r.Memory != "" {
+		keys["mem_limit"] = r.Memory
+	}
+	if r.MemoryReservation != "" {
+		keys["mem_reservation"] = r.MemoryReservation
+	}
+	if r.PidsLimit > 0 {
+		keys["pids_limit"] = r.PidsLimit
+	}
+	return keys
+}
+
+var resourceKeys = []string{"cpus", "mem_limit", "mem_reservation", "pids_limit"}
+
+func projectComposePath(project string) string {
+	return filepath.Join(ProjectsRoot, project, "docker-compose.yml")
+}
+
+// GetProjectResources reads the limits of every service from the compose file
+func GetProjectResources(project string) (map[string]ServiceResources, error) {
+	if !composeNameRe.MatchString(project) || !projectExists(project) {
+		return nil, fmt.Errorf("project %s not found", project)
+	}
+	content, err := os.ReadFile(projectComposePath(project))
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %v", err)
+	}
+
+	result := map[string]ServiceResources{}
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		var r ServiceResources
+		if v := mapValue(def, "cpus"); v != nil {
+			r.CPUs, _ = strconv.ParseFloat(fmt.Sprint(v), 64)
+		}
+		if v := mapValue(def, "mem_limit"); v != nil {
+			r.Memory = fmt.Sprint(v)
+		}
+		if v := mapValue(def, "mem_reservation"); v != nil {
+			r.MemoryReservation = fmt.Sprint(v)
+		}
+		if v := mapValue(def, "pids_limit"); v != nil {
+			r.PidsLimit, _ = strconv.Atoi(fmt.Sprint(v))
+		}
+		result[fmt.Sprint(svc.Key)] = r
+	}
+	return result, nil
+}
+
+// SetServiceResources writes new limits for a service into the project's
+// compose file and applies them to the running containers. Limits that can
+// be changed in place go through `docker update`; removing a limit needs the
+// service to be recreated.
+func SetServiceResources(project, service string, res ServiceResources) (string, error) {
+	if !composeNameRe.MatchString(project) || !projectExists(project) {
+		return "", fmt.Errorf("project %s not found", project)
+	}
+	if err := res.Validate(); err != nil {
+		return "", err
+	}
+
+	current, err := GetProjectResources(project)
+	if err != nil {
+		return "", err
+	}
+	old, ok := current[service]
+	if !ok {
+		return "", fmt.Errorf("service %s not found in project %s", service, project)
+	}
+
+	path := projectComposePath(project)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	updated, err := setComposeServiceKeys(content, service, res.composeKeys(), resourceKeys)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, updated, 0644); err != nil {
+		return "", err
+	}
+
+	removed := (old.CPUs > 0 && res.CPUs == 0) || (old.Memory != "" && res.Memory == "") ||
+		(old.MemoryReservation != "" && res.MemoryReservation == "") || (old.PidsLimit > 0 && res.PidsLimit == 0)
+	if removed {
+		if _, err := runCompose(project, "up", "-d", "--no-deps", service); err != nil {
+			return "", err
+		}
+		return "recreated", nil
+	}
+
+	args := []string{"update"}
+	if res.CPUs > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(res.CPUs, 'f', -1, 64))
+	}
+	if res.Memory != "" {
+		// Keep docker's default of swap = 2x memory so lowering the limit never
+		// conflicts with a previously set swap limit.
+		limit, _ := parseMemory(res.Memory)
+		args = append(args, "--memory", res.Memory, "--memory-swap", strconv.FormatInt(limit*2, 10))
+	}
+	if res.MemoryReservation != "" {
+		args = append(args, "--memory-reservation", res.MemoryReservation)
+	}
+	if res.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(res.PidsLimit))
+	}
+	if len(args) == 1 {
+		return "unchanged", nil
+	}
+
+	ids, err := runDocker("ps", "-q", "--filter", "label="+composeProjectLabel+"="+project,
+		"--filter", "label="+composeServiceLabel+"="+service)
+	if err != nil {
+		return "", err
+	}
+	for _, id := range splitLines(ids) {
+		if _, err := runDocker(append(args, id)...); err != nil {
+			return "", err
+		}
+	}
+	return "updated", nil
+}
+
+// setComposeServiceKeys sets keys on one service of a compose document,
+// deleting the managed keys that are not in values, and keeps the order of
+// everything else.
+func setComposeServiceKeys(content []byte, service string, values map[string]interface{}, managed []string) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %v", err)
+	}
+
+	found := false
+	for i, top := range doc {
+		if fmt.Sprint(top.Key) != "services" {
+			continue
+		}
+		services, _ := top.Value.(yaml.MapSlice)
+		for j, svc := range services {
+			if fmt.Sprint(svc.Key) != service {
+				continue
+			}
+			found = true
+			def, _ := svc.Value.(yaml.MapSlice)
+			kept := yaml.MapSlice{}
+			for _, item := range def {
+				if !containsString(managed, fmt.Sprint(item.Key)) {
+					kept = append(kept, item)
+				}
+			}
+			for _, k := range managed {
+				if v, ok := values[k]; ok {
+					kept = append(kept, yaml.MapItem{Key: k, Value: v})
+				}
+			}
+			services[j].Value = kept
+		}
+		doc[i].Value = services
+	}
+	if !found {
+		return nil, fmt.Errorf("service %s not found", service)
+	}
+	return yaml.MarshalWithOptions(doc, yaml.IndentSequence(true))
+}
+
+func mapValue(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if fmt.Sprint(item.Key) == key {
+			return item.Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,548 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+	"github.com/goccy/go-yaml"
+)
+
+// Secrets are environment variables kept out of the project directory,
+// which the file manager serves. Their values are stored encrypted in the
+// panel database and written for compose, at deploy time, to
+// SecretsRoot/<project>.env, readable by root only. Services receive them
+// through an env_file entry pointing there.
+
+const SecretsRoot = "/opt/foxdocker/secrets"
+
+const (
+	maxSecretSize        = 4096
+	generatedSecretBytes = 24
+	secretMask           = "********"
+	secretsFileHeader    = "# Managed by FoxDocker: edit these secrets in the panel\n"
+)
+
+// Variables an app template asks for that are stored as secrets
+var secretNameRe = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY|PRIVATE_?KEY)`)
+
+// Secret is a project secret as the API shows it, value masked
+type Secret struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func secretsEnvPath(project string) string {
+	return filepath.Join(SecretsRoot, project+".env")
+}
+
+func isSecretName(key string) bool {
+	return secretNameRe.MatchString(key)
+}
+
+func validateSecret(key, value string) error {
+	if !envKeyRe.MatchString(key) {
+		return fmt.Errorf("invalid secret name %q", key)
+	}
+	switch {
+	case value == "":
+		return fmt.Errorf("secret %s has no value", key)
+	case len(value) > maxSecretSize:
+		return fmt.Errorf("secret %s is longer than %d bytes", key, maxSecretSize)
+	case strings.ContainsRune(value, 0):
+		return fmt.Errorf("secret %s cannot contain NUL bytes", key)
+	}
+	return nil
+}
+
+// quoteSecret writes a value double-quoted for compose's env file parser,
+// escaping what it would otherwise interpret: quotes, backslashes, line
+// breaks and $ interpolation
+func quoteSecret(value string) string {
+	return `"` + secretEscaper.Replace(value) + `"`
+}
+
+var secretEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "\n", `\n`, "\r", `\r`)
+
+// unquoteSecret reads a value written by quoteSecret, or single-quoted by
+// older versions of the panel
+func unquoteSecret(raw string) string {
+	if len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'' {
+		return raw[1 : len(raw)-1]
+	}
+	if len(raw) < 2 || raw[0] != '"' || raw[len(raw)-1] != '"' {
+		return raw
+	}
+	raw = raw[1 : len(raw)-1]
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' || i == len(raw)-1 {
+			b.WriteByte(raw[i])
+			continue
+		}
+		i++
+		switch raw[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			b.WriteByte(raw[i])
+		}
+	}
+	return b.String()
+}
+
+// ListSecrets lists the secrets of a project without their values
+func ListSecrets(project string) ([]Secret, error) {
+	if database.DB == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	var rows []database.ProjectSecret
+	if err := database.DB.Where("project = ?", project).Order("key").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	secrets := make([]Secret, len(rows))
+	for i, r := range rows {
+		secrets[i] = Secret{Key: r.Key, Value: secretMask, UpdatedAt: r.UpdatedAt}
+	}
+	return secrets, nil
+}
+
+// SetSecret stores a secret and gives it to the project's services. It
+// takes effect on the next deploy.
+func SetSecret(project, key, value, user string) error {
+	if !projectExists(project) {
+		return fmt.Errorf("project %s not found", project)
+	}
+	if err := validateSecret(key, value); err != nil {
+		return err
+	}
+	if err := storeSecrets(project, map[string]string{key: value}); err != nil {
+		return err
+	}
+	if err := attachSecrets(project, user, key); err != nil {
+		return err
+	}
+	return writeSecretsEnv(project)
+}
+
+// RotateSecret replaces a secret, with a random value when value is empty,
+// and redeploys the project so its containers receive it
+func RotateSecret(project, key, value, user string) (Job, error) {
+	if value == "" {
+		value = randomHex(generatedSecretBytes)
+	}
+	if !beginProjectOperation(project) {
+		return Job{}, fmt.Errorf("another deployment is already running for this project")
+	}
+	if err := SetSecret(project, key, value, user); err != nil {
+		endProjectOperation(project)
+		return Job{}, err
+	}
+	return startHeldJob("secret", project, user, func(ctx context.Context, logf JobLogger) error {
+		logf("Rotated secret " + key + ", redeploying...")
+		if db := secretDatabaseService(project); db != "" {
+			logf(fmt.Sprintf("Warning: service %s is a database, which reads its credentials only when first initialized: change the password inside it as well", db))
+		}
+		if err := composeUp(ctx, project, logf); err != nil {
+			return err
+		}
+		logf("Waiting for services to become healthy...")
+		if err := waitProjectHealthy(ctx, project, updateHealthTimeout); err != nil {
+			return fmt.Errorf("deployment is not healthy: %v", err)
+		}
+		syncProjectStatus(project)
+		recordDeploymentLogged(project, user, "secret", "rotate "+key)
+		return nil
+	}), nil
+}
+
+// DeleteSecret removes a secret; containers keep it until the next deploy
+func DeleteSecret(project, key string) error {
+	if database.DB == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	res := database.DB.Where("project = ? AND key = ?", project, key).Delete(&database.ProjectSecret{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("secret %s not found", key)
+	}
+	return writeSecretsEnv(project)
+}
+
+// DeleteProjectSecrets forgets every secret of a deleted project
+func DeleteProjectSecrets(project string) {
+	if database.DB != nil {
+		database.DB.Where("project = ?", project).Delete(&database.ProjectSecret{})
+	}
+	os.Remove(secretsEnvPath(project))
+}
+
+// projectSecrets decrypts the secrets of a project
+func projectSecrets(project string) (map[string]string, error) {
+	if database.DB == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+	var rows []database.ProjectSecret
+	if err := database.DB.Where("project = ?", project).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(rows))
+	for _, r := range rows {
+		v, err := security.DecryptString(r.ValueEncrypted)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt secret %s: %v", r.Key, err)
+		}
+		values[r.Key] = v
+	}
+	return values, nil
+}
+
+// storeSecrets encrypts and saves secrets, replacing the ones with the same name
+func storeSecrets(project string, values map[string]string) error {
+	if database.DB == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	for key, value := range values {
+		enc, err := security.EncryptString(value)
+		if err != nil {
+			return err
+		}
+		var row database.ProjectSecret
+		database.DB.Where("project = ? AND key = ?", project, key).Limit(1).Find(&row)
+		row.Project, row.Key, row.ValueEncrypted = project, key, enc
+		if err := database.DB.Save(&row).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copySecrets gives a project a copy of another project's secrets
+func copySecrets(from, to string) error {
+	values, err := projectSecrets(from)
+	if err != nil {
+		return err
+	}
+	if err := storeSecrets(to, values); err != nil {
+		return err
+	}
+	return syncSecretsEnv(to)
+}
+
+// writeSecretsEnv writes the env file compose reads the secrets from
+func writeSecretsEnv(project string) error {
+	values, err := projectSecrets(project)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString(secretsFileHeader)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", k, quoteSecret(values[k]))
+	}
+	if current, err := os.ReadFile(secretsEnvPath(project)); err == nil && string(current) == b.String() {
+		return nil
+	}
+
+	if err := os.MkdirAll(SecretsRoot, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(SecretsRoot, project+".env.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), secretsEnvPath(project))
+}
+
+// syncSecretsEnv rewrites a project's secrets file before compose runs, when
+// it has secrets or its compose file reads them. Compose reads env files for
+// any command, so the file must exist even to stop or remove the project.
+func syncSecretsEnv(project string) error {
+	if database.DB == nil {
+		return nil
+	}
+	var count int64
+	database.DB.Model(&database.ProjectSecret{}).Where("project = ?", project).Count(&count)
+	if count == 0 {
+		content, _ := os.ReadFile(projectComposePath(project))
+		if !bytes.Contains(content, []byte(secretsEnvPath(project))) {
+			return nil
+		}
+	}
+	return writeSecretsEnv(project)
+}
+
+// MigratePlaintextSecrets moves secret-named variables that compose files
+// still hold in plain text, like those of apps installed before the secrets
+// store existed, into the store. It runs at startup and does nothing once
+// a project is migrated.
+func MigratePlaintextSecrets() {
+	if database.DB == nil {
+		return
+	}
+	entries, err := os.ReadDir(ProjectsRoot)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		project := entry.Name()
+		if !IsProjectDir(entry) || !composeNameRe.MatchString(project) {
+			continue
+		}
+		values := plaintextSecrets(project)
+		if len(values) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if err := storeSecrets(project, values); err != nil {
+			log.Printf("Failed to migrate the secrets of %s: %v", project, err)
+			continue
+		}
+		if err := attachSecrets(project, "system", keys...); err != nil {
+			log.Printf("Failed to migrate the secrets of %s: %v", project, err)
+			continue
+		}
+		if err := writeSecretsEnv(project); err != nil {
+			log.Printf("Failed to write the secrets file of %s: %v", project, err)
+		}
+		log.Printf("Moved plain-text secrets %s of %s to the secrets store", strings.Join(keys, ", "), project)
+	}
+}
+
+// plaintextSecrets returns the literal values of the secret-named variables
+// in a project's compose file. A name set to different values by two
+// services is left alone, since a project has a single secrets file.
+func plaintextSecrets(project string) map[string]string {
+	content, err := os.ReadFile(projectComposePath(project))
+	if err != nil {
+		return nil
+	}
+	var doc yaml.MapSlice
+	if yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()) != nil {
+		return nil
+	}
+	values := map[string]string{}
+	conflicts := map[string]bool{}
+	add := func(key, raw string) {
+		value, literal := composeLiteral(raw)
+		if !isSecretName(key) || !literal || validateSecret(key, value) != nil {
+			return
+		}
+		if prev, seen := values[key]; seen && prev != value {
+			conflicts[key] = true
+		}
+		values[key] = value
+	}
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		switch env := mapValue(def, "environment").(type) {
+		case yaml.MapSlice:
+			for _, item := range env {
+				if item.Value != nil {
+					add(fmt.Sprint(item.Key), fmt.Sprint(item.Value))
+				}
+			}
+		case []interface{}:
+			for _, item := range env {
+				if k, v, ok := strings.Cut(fmt.Sprint(item), "="); ok {
+					add(k, v)
+				}
+			}
+		}
+	}
+	for key := range conflicts {
+		delete(values, key)
+	}
+	return values
+}
+
+// composeLiteral undoes compose's $$ escaping of a value; values that
+// interpolate variables are not literals
+func composeLiteral(v string) (string, bool) {
+	if strings.Contains(strings.ReplaceAll(v, "$$", ""), "$") {
+		return "", false
+	}
+	return strings.ReplaceAll(v, "$$", "$"), true
+}
+
+// attachSecrets makes the project's services read its secrets file, every
+// service when none does yet, and drops the variables being set from their
+// plain environment, which would take precedence
+func attachSecrets(project, user string, keys ...string) error {
+	path := projectComposePath(project)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()); err != nil {
+		return fmt.Errorf("invalid compose file: %v", err)
+	}
+	envFile := secretsEnvPath(project)
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	attachAll := true
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		if readsEnvFile(def, envFile) {
+			attachAll = false
+		}
+	}
+
+	changed := false
+	for i, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		if attachAll {
+			switch e := mapValue(def, "env_file").(type) {
+			case nil:
+				def = setMapValue(def, "env_file", []interface{}{envFile})
+			case []interface{}:
+				def = setMapValue(def, "env_file", append(e, envFile))
+			default:
+				def = setMapValue(def, "env_file", []interface{}{e, envFile})
+			}
+			changed = true
+		} else if !readsEnvFile(def, envFile) {
+			continue
+		}
+		switch env := mapValue(def, "environment").(type) {
+		case yaml.MapSlice:
+			for _, k := range keys {
+				if mapHasKey(env, k) {
+					env = deleteMapKey(env, k)
+					changed = true
+				}
+			}
+			if len(env) == 0 {
+				def = deleteMapKey(def, "environment")
+			} else {
+				def = setMapValue(def, "environment", env)
+			}
+		case []interface{}:
+			kept := []interface{}{}
+			for _, e := range env {
+				if k, _, _ := strings.Cut(fmt.Sprint(e), "="); containsString(keys, k) {
+					changed = true
+					continue
+				}
+				kept = append(kept, e)
+			}
+			if len(kept) == 0 {
+				def = deleteMapKey(def, "environment")
+			} else {
+				def = setMapValue(def, "environment", kept)
+			}
+		}
+		services[i].Value = def
+	}
+	if !changed {
+		return nil
+	}
+	out, err := yaml.MarshalWithOptions(setMapValue(doc, "services", services), yaml.IndentSequence(true))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, out, 0644); err != nil {
+		return err
+	}
+	RecordProjectChange(project, user, "Read secrets "+strings.Join(keys, ", ")+" from the secrets store", "docker-compose.yml")
+	return nil
+}
+
+// readsEnvFile reports whether a service definition loads an env file
+func readsEnvFile(def yaml.MapSlice, envFile string) bool {
+	switch e := mapValue(def, "env_file").(type) {
+	case []interface{}:
+		for _, item := range e {
+			if long, ok := item.(yaml.MapSlice); ok {
+				item = mapValue(long, "path")
+			}
+			if fmt.Sprint(item) == envFile {
+				return true
+			}
+		}
+	case nil:
+	default:
+		return fmt.Sprint(e) == envFile
+	}
+	return false
+}
+
+// retargetSecrets points the env_file entries reading one project's secrets
+// at another project's
+func retargetSecrets(doc yaml.MapSlice, from, to string) yaml.MapSlice {
+	old, target := secretsEnvPath(from), secretsEnvPath(to)
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for i, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		switch e := mapValue(def, "env_file").(type) {
+		case []interface{}:
+			for j, item := range e {
+				if long, ok := item.(yaml.MapSlice); ok && fmt.Sprint(mapValue(long, "path")) == old {
+					e[j] = setMapValue(long, "path", target)
+				} else if fmt.Sprint(item) == old {
+					e[j] = target
+				}
+			}
+		case nil:
+		default:
+			if fmt.Sprint(e) == old {
+				services[i].Value = setMapValue(def, "env_file", target)
+			}
+		}
+	}
+	return doc
+}
+
+// secretDatabaseService returns a database service of the project that
+// reads the secrets file, if any
+func secretDatabaseService(project string) string {
+	content, err := os.ReadFile(projectComposePath(project))
+	if err != nil {
+		return ""
+	}
+	var doc yaml.MapSlice
+	if yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()) != nil {
+		return ""
+	}
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		if readsEnvFile(def, secretsEnvPath(project)) && detectDatabaseEngine(fmt.Sprint(mapValue(def, "image"))) != nil {
+			return fmt.Sprint(svc.Key)
+		}
+	}
+	return ""
+}
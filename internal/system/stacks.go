@@ -0,0 +1,632 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+)
+
+// Projects built from source code without a Dockerfile get one generated
+// from the stack detected in the code. It lives in the project directory,
+// outside the checkout, so a fresh clone keeps it and the user can review
+// and edit it before the first build.
+
+const (
+	StackPHP    = "php"
+	StackNode   = "node"
+	StackPython = "python"
+	StackGo     = "go"
+	StackStatic = "static"
+
+	generatedDockerfile = "Dockerfile.generated"
+	// BuildKit reads <Dockerfile>.dockerignore next to the Dockerfile
+	generatedDockerignore = generatedDockerfile + ".dockerignore"
+
+	maxDockerfileSize = 64 << 10
+
+	defaultNodeVersion   = "20"
+	defaultPHPVersion    = "8.3"
+	defaultPythonVersion = "3.12"
+	defaultGoVersion     = "1.23"
+)
+
+// BuildPlan is a generated Dockerfile with what was detected to write it
+type BuildPlan struct {
+	Stack        string   `json:"stack"`
+	Port         int      `json:"port"`
+	Dockerfile   string   `json:"dockerfile"`
+	Dockerignore string   `json:"dockerignore"`
+	Notes        []string `json:"notes"`
+	Saved        bool     `json:"saved"` // false: detected now, not written yet
+}
+
+var (
+	goVersionRe        = regexp.MustCompile(`(?m)^go (\d+\.\d+)`)
+	versionRe          = regexp.MustCompile(`(\d+)(?:\.(\d+))?`)
+	generatedRe        = regexp.MustCompile(`(?m)^# Generated by FoxDocker for a (\w+) project`)
+	exposeRe           = regexp.MustCompile(`(?m)^EXPOSE (\d+)`)
+	commonDockerignore = []string{".git", ".env", ".env.*", "Dockerfile*", "docker-compose*.yml", "compose*.yaml"}
+)
+
+// dockerfileWriter assembles a Dockerfile line by line
+type dockerfileWriter struct {
+	strings.Builder
+}
+
+func (w *dockerfileWriter) line(format string, args ...interface{}) {
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+func newDockerfile(stack string) *dockerfileWriter {
+	w := &dockerfileWriter{}
+	w.line("# syntax=docker/dockerfile:1")
+	w.line("# Generated by FoxDocker for a %s project. Edit it freely: it is kept", stack)
+	w.line("# across deploys and only regenerated when removed.")
+	return w
+}
+
+// healthcheck answers as soon as the app accepts connections, whatever the
+// status of / is, so apps without a home page still report healthy
+func (w *dockerfileWriter) healthcheck(cmd string) {
+	w.line("HEALTHCHECK --interval=30s --timeout=5s --start-period=30s --retries=3 CMD %s", cmd)
+}
+
+// DetectBuildPlan looks at the source in dir and generates a Dockerfile
+// for the stack it finds
+func DetectBuildPlan(dir string) (BuildPlan, error) {
+	has := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	switch {
+	case has("composer.json") || has("index.php"):
+		return phpPlan(dir, has), nil
+	case has("go.mod"):
+		return goPlan(dir, has), nil
+	case has("requirements.txt") || has("pyproject.toml"):
+		return pythonPlan(dir, has), nil
+	case has("package.json"):
+		return nodePlan(dir, has)
+	case has("index.html"):
+		return staticPlan(), nil
+	}
+	return BuildPlan{}, fmt.Errorf("cannot detect the stack: no composer.json, package.json, requirements.txt, pyproject.toml, go.mod or index.html found")
+}
+
+// existing keeps the files that exist in dir, for COPY lines that must not
+// fail on an optional lock file
+func existing(has func(string) bool, names ...string) []string {
+	var out []string
+	for _, n := range names {
+		if has(n) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func dockerignore(extra ...string) string {
+	return strings.Join(append(append([]string{}, commonDockerignore...), extra...), "\n") + "\n"
+}
+
+// nodeTool is how a package manager installs, builds and prunes
+type nodeTool struct {
+	lock, install, run, prune, cache string
+}
+
+func detectNodeTool(has func(string) bool) (nodeTool, string) {
+	switch {
+	case has("pnpm-lock.yaml"):
+		return nodeTool{"pnpm-lock.yaml", "corepack enable && pnpm install --frozen-lockfile", "pnpm run", "pnpm prune --prod", "/root/.local/share/pnpm/store"}, ""
+	case has("yarn.lock"):
+		return nodeTool{"yarn.lock", "yarn install --frozen-lockfile", "yarn run", "yarn install --production --frozen-lockfile --ignore-scripts --prefer-offline", "/usr/local/share/.cache/yarn"}, ""
+	case has("package-lock.json"):
+		return nodeTool{"package-lock.json", "npm ci", "npm run", "npm prune --omit=dev", "/root/.npm"}, ""
+	}
+	return nodeTool{"", "npm install", "npm run", "npm prune --omit=dev", "/root/.npm"},
+		"No lock file found: dependency versions are not pinned"
+}
+
+// installNode writes the cached dependency install, before the sources are
+// copied so it is only redone when the manifests change
+func (w *dockerfileWriter) installNode(tool nodeTool) {
+	manifests := "package.json"
+	if tool.lock != "" {
+		manifests += " " + tool.lock
+	}
+	w.line("COPY %s ./", manifests)
+	w.line("RUN --mount=type=cache,target=%s %s", tool.cache, tool.install)
+}
+
+type packageJSON struct {
+	Main    string            `json:"main"`
+	Scripts map[string]string `json:"scripts"`
+	Engines struct {
+		Node string `json:"node"`
+	} `json:"engines"`
+	Dependencies    map[string]string `json:"dependencies"`
+	DevDependencies map[string]string `json:"devDependencies"`
+}
+
+func (p packageJSON) uses(dep string) bool {
+	_, a := p.Dependencies[dep]
+	_, b := p.DevDependencies[dep]
+	return a || b
+}
+
+func readPackageJSON(dir string) (packageJSON, error) {
+	var pkg packageJSON
+	data, err := os.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return pkg, err
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return pkg, fmt.Errorf("invalid package.json: %v", err)
+	}
+	return pkg, nil
+}
+
+// nodeVersion takes the major version from engines.node
+func nodeVersion(constraint string) string {
+	if m := versionRe.FindStringSubmatch(constraint); m != nil && !strings.HasPrefix(strings.TrimSpace(constraint), ">") {
+		return m[1]
+	}
+	return defaultNodeVersion
+}
+
+func nodePlan(dir string, has func(string) bool) (BuildPlan, error) {
+	pkg, err := readPackageJSON(dir)
+	if err != nil {
+		return BuildPlan{}, err
+	}
+	tool, note := detectNodeTool(has)
+	plan := BuildPlan{Stack: StackNode}
+	if note != "" {
+		plan.Notes = append(plan.Notes, note)
+	}
+	version := nodeVersion(pkg.Engines.Node)
+	start := pkg.Scripts["start"]
+	build := pkg.Scripts["build"] != ""
+
+	// Single page apps only build static files: their start script, if any,
+	// is a development server
+	spa := build && (start == "" && pkg.Main == "" || pkg.uses("react-scripts") || strings.HasPrefix(start, "vite"))
+	if spa {
+		out := "dist"
+		if pkg.uses("react-scripts") {
+			out = "build"
+		}
+		plan.Notes = append(plan.Notes, fmt.Sprintf("Single page app: the build output in %s/ is served by nginx", out))
+		w := newDockerfile(StackNode)
+		w.line("FROM node:%s-alpine AS build", version)
+		w.line("WORKDIR /app")
+		w.installNode(tool)
+		w.line("COPY . .")
+		w.line("RUN %s build", tool.run)
+		w.line("")
+		w.nginxStage("/app/"+out, true)
+		plan.Port = 80
+		plan.Dockerfile = w.String()
+		plan.Dockerignore = dockerignore("node_modules", "npm-debug.log*", out)
+		return plan, nil
+	}
+
+	cmd := `["npm", "start"]`
+	switch {
+	case start != "":
+	case pkg.Main != "":
+		cmd = fmt.Sprintf(`["node", %q]`, pkg.Main)
+	case has("server.js"):
+		cmd = `["node", "server.js"]`
+	default:
+		cmd = `["node", "index.js"]`
+		plan.Notes = append(plan.Notes, "No start script or main in package.json: running index.js")
+	}
+
+	plan.Port = 3000
+	w := newDockerfile(StackNode)
+	w.line("FROM node:%s-alpine", version)
+	w.line("WORKDIR /app")
+	w.installNode(tool)
+	w.line("COPY . .")
+	if build {
+		w.line("RUN %s build", tool.run)
+	}
+	w.line("RUN %s", tool.prune)
+	w.line("ENV NODE_ENV=production PORT=%d", plan.Port)
+	w.line("EXPOSE %d", plan.Port)
+	w.healthcheck(fmt.Sprintf(`node -e "require('net').connect(%d, '127.0.0.1').on('connect', () => process.exit(0)).on('error', () => process.exit(1))"`, plan.Port))
+	w.line("CMD %s", cmd)
+	plan.Dockerfile = w.String()
+	plan.Dockerignore = dockerignore("node_modules", "npm-debug.log*")
+	return plan, nil
+}
+
+// nginxStage serves static files from root, falling back to index.html for
+// client side routes when spa is set
+func (w *dockerfileWriter) nginxStage(root string, spa bool) {
+	w.line("FROM nginx:1.27-alpine")
+	if spa {
+		w.line(`COPY <<"EOF" /etc/nginx/conf.d/default.conf`)
+		w.line("server {")
+		w.line("    listen 80;")
+		w.line("    root /usr/share/nginx/html;")
+		w.line("    location / {")
+		w.line("        try_files $uri $uri/ /index.html;")
+		w.line("    }")
+		w.line(`    location ~* \.(?:js|css|png|jpe?g|gif|svg|ico|woff2?)$ {`)
+		w.line("        expires 7d;")
+		w.line("    }")
+		w.line("}")
+		w.line("EOF")
+		w.line("COPY --from=build %s /usr/share/nginx/html", root)
+	} else {
+		w.line("COPY %s /usr/share/nginx/html", root)
+	}
+	w.line("EXPOSE 80")
+	// busybox wget fails on 4xx/5xx too; any status line means nginx answers
+	w.healthcheck("wget -q -S -O /dev/null http://127.0.0.1/ 2>&1 | grep -q HTTP/")
+}
+
+func staticPlan() BuildPlan {
+	w := newDockerfile(StackStatic)
+	w.nginxStage(".", false)
+	return BuildPlan{Stack: StackStatic, Port: 80, Dockerfile: w.String(), Dockerignore: dockerignore()}
+}
+
+// phpVersion picks the image version from composer's require.php: open
+// constraints get the current default, pinned ones their version
+func phpVersion(constraint string) string {
+	c := strings.TrimSpace(constraint)
+	m := versionRe.FindStringSubmatch(c)
+	if m == nil || m[2] == "" || strings.HasPrefix(c, ">") || strings.HasPrefix(c, "^8") {
+		return defaultPHPVersion
+	}
+	return m[1] + "." + m[2]
+}
+
+func phpPlan(dir string, has func(string) bool) BuildPlan {
+	plan := BuildPlan{Stack: StackPHP, Port: 80}
+	var composer struct {
+		Require map[string]string `json:"require"`
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "composer.json")); err == nil {
+		if err := json.Unmarshal(data, &composer); err != nil {
+			plan.Notes = append(plan.Notes, "composer.json is not valid JSON: dependencies are not installed")
+		}
+	}
+	hasComposer := has("composer.json") && composer.Require != nil
+
+	// What most frameworks need, then what composer.json asks for
+	defaultExtensions := []string{"opcache", "pdo_mysql", "pdo_pgsql", "zip", "intl", "bcmath"}
+	var requiredExtensions []string
+	for dep := range composer.Require {
+		if ext := strings.TrimPrefix(dep, "ext-"); ext != dep && !containsString(defaultExtensions, ext) {
+			requiredExtensions = append(requiredExtensions, ext)
+		}
+	}
+	sort.Strings(requiredExtensions)
+	extensions := append(defaultExtensions, requiredExtensions...)
+
+	// Laravel, Symfony and most frameworks serve from public/
+	docroot := "/var/www/html"
+	if info, err := os.Stat(filepath.Join(dir, "public")); err == nil && info.IsDir() {
+		docroot += "/public"
+	}
+
+	w := newDockerfile(StackPHP)
+	var assets bool
+	if pkg, err := readPackageJSON(dir); err == nil && pkg.Scripts["build"] != "" {
+		assets = true
+		tool, _ := detectNodeTool(has)
+		w.line("FROM node:%s-alpine AS assets", nodeVersion(pkg.Engines.Node))
+		w.line("WORKDIR /app")
+		w.installNode(tool)
+		w.line("COPY . .")
+		w.line("RUN %s build", tool.run)
+		w.line("")
+		plan.Notes = append(plan.Notes, "Front-end assets are built with the build script of package.json")
+	}
+	if hasComposer {
+		w.line("FROM composer:2 AS vendor")
+		w.line("WORKDIR /app")
+		w.line("COPY %s ./", strings.Join(existing(has, "composer.json", "composer.lock"), " "))
+		w.line("RUN --mount=type=cache,target=/tmp/cache composer install --no-dev --no-interaction --no-scripts --no-autoloader --prefer-dist --ignore-platform-reqs")
+		w.line("COPY . .")
+		if assets {
+			w.line("COPY --from=assets /app/public ./public")
+		}
+		w.line("RUN composer dump-autoload --no-dev --no-scripts --optimize")
+		w.line("")
+		if !has("composer.lock") {
+			plan.Notes = append(plan.Notes, "No composer.lock found: dependency versions are not pinned")
+		}
+	}
+	w.line("FROM php:%s-apache", phpVersion(composer.Require["php"]))
+	w.line("COPY --from=mlocati/php-extension-installer /usr/bin/install-php-extensions /usr/local/bin/")
+	w.line("RUN install-php-extensions %s", strings.Join(extensions, " "))
+	w.line(`RUN cp "$PHP_INI_DIR/php.ini-production" "$PHP_INI_DIR/php.ini" && a2enmod rewrite headers`)
+	if docroot != "/var/www/html" {
+		w.line("ENV APACHE_DOCUMENT_ROOT=%s", docroot)
+		w.line(`RUN sed -ri -e 's!/var/www/html!${APACHE_DOCUMENT_ROOT}!g' /etc/apache2/sites-available/*.conf`)
+	}
+	// .htaccess rewrites (front controllers) need AllowOverride
+	w.line(`RUN sed -ri -e '/<Directory \/var\/www\/>/,/<\/Directory>/ s/AllowOverride None/AllowOverride All/' /etc/apache2/apache2.conf`)
+	switch {
+	case hasComposer:
+		w.line("COPY --from=vendor --chown=www-data:www-data /app /var/www/html")
+	case assets:
+		w.line("COPY --from=assets --chown=www-data:www-data /app /var/www/html")
+	default:
+		w.line("COPY --chown=www-data:www-data . /var/www/html")
+	}
+	w.line("EXPOSE 80")
+	w.healthcheck("curl -s -o /dev/null http://127.0.0.1/ || exit 1")
+	plan.Dockerfile = w.String()
+	plan.Dockerignore = dockerignore("vendor", "node_modules")
+	return plan
+}
+
+// pythonServer guesses how to serve a Python app and whether the server
+// package has to be installed on top of the requirements
+func pythonServer(dir string, has func(string) bool, deps string, port int) (cmd []string, extra, note string) {
+	bind := fmt.Sprintf("0.0.0.0:%d", port)
+	module := func(candidates ...string) string {
+		for _, c := range candidates {
+			if has(c) {
+				return strings.ReplaceAll(strings.TrimSuffix(c, ".py"), "/", ".")
+			}
+		}
+		return strings.TrimSuffix(candidates[0], ".py")
+	}
+	needs := func(pkg string) string {
+		if strings.Contains(deps, pkg) {
+			return ""
+		}
+		return pkg
+	}
+
+	switch {
+	case strings.Contains(deps, "django") && has("manage.py"):
+		wsgi, _ := filepath.Glob(filepath.Join(dir, "*", "wsgi.py"))
+		if len(wsgi) == 0 {
+			break
+		}
+		pkg := filepath.Base(filepath.Dir(wsgi[0]))
+		return []string{"gunicorn", pkg + ".wsgi:application", "--bind", bind}, needs("gunicorn"),
+			"Django: run migrations and collectstatic from the project terminal"
+	case strings.Contains(deps, "fastapi"):
+		mod := module("main.py", "app/main.py", "app.py")
+		return []string{"uvicorn", mod + ":app", "--host", "0.0.0.0", "--port", strconv.Itoa(port)}, needs("uvicorn"),
+			"FastAPI: serving " + mod + ":app with uvicorn"
+	case strings.Contains(deps, "flask"):
+		mod := module("app.py", "wsgi.py", "main.py")
+		return []string{"gunicorn", mod + ":app", "--bind", bind}, needs("gunicorn"),
+			"Flask: serving " + mod + ":app with gunicorn"
+	}
+	script := "main.py"
+	if has("app.py") {
+		script = "app.py"
+	}
+	return []string{"python", script}, "", "No web framework detected: running " + script
+}
+
+func pythonPlan(dir string, has func(string) bool) BuildPlan {
+	plan := BuildPlan{Stack: StackPython, Port: 8000}
+	version := defaultPythonVersion
+	if data, err := os.ReadFile(filepath.Join(dir, ".python-version")); err == nil {
+		if m := versionRe.FindStringSubmatch(string(data)); m != nil && m[2] != "" {
+			version = m[1] + "." + m[2]
+		}
+	}
+	var deps string
+	for _, f := range []string{"requirements.txt", "pyproject.toml"} {
+		if data, err := os.ReadFile(filepath.Join(dir, f)); err == nil {
+			deps += strings.ToLower(string(data))
+		}
+	}
+	cmd, extra, note := pythonServer(dir, has, deps, plan.Port)
+	plan.Notes = append(plan.Notes, note)
+	quoted := make([]string, len(cmd))
+	for i, c := range cmd {
+		quoted[i] = strconv.Quote(c)
+	}
+
+	w := newDockerfile(StackPython)
+	w.line("FROM python:%s-slim", version)
+	w.line("ENV PYTHONDONTWRITEBYTECODE=1 PYTHONUNBUFFERED=1 PIP_DISABLE_PIP_VERSION_CHECK=1")
+	w.line("WORKDIR /app")
+	if has("requirements.txt") {
+		w.line("COPY requirements.txt ./")
+		w.line("RUN --mount=type=cache,target=/root/.cache/pip pip install -r requirements.txt %s", extra)
+		w.line("COPY . .")
+	} else {
+		// pyproject only: the package itself has to be copied to install it
+		w.line("COPY . .")
+		w.line("RUN --mount=type=cache,target=/root/.cache/pip pip install . %s", extra)
+	}
+	w.line("RUN useradd --create-home --uid 1000 app && chown -R app /app")
+	w.line("USER app")
+	w.line("EXPOSE %d", plan.Port)
+	w.healthcheck(fmt.Sprintf(`python -c "import socket; socket.create_connection(('127.0.0.1', %d), 4)"`, plan.Port))
+	w.line("CMD [%s]", strings.Join(quoted, ", "))
+	plan.Dockerfile = strings.ReplaceAll(w.String(), " \n", "\n")
+	plan.Dockerignore = dockerignore("__pycache__", "*.pyc", ".venv", "venv")
+	return plan
+}
+
+func goPlan(dir string, has func(string) bool) BuildPlan {
+	plan := BuildPlan{Stack: StackGo, Port: 8080}
+	version := defaultGoVersion
+	if data, err := os.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+		if m := goVersionRe.FindSubmatch(data); m != nil {
+			version = string(m[1])
+		}
+	}
+	pkg := "."
+	if !has("main.go") {
+		if mains, _ := filepath.Glob(filepath.Join(dir, "cmd", "*", "main.go")); len(mains) > 0 {
+			rel, _ := filepath.Rel(dir, filepath.Dir(mains[0]))
+			pkg = "./" + filepath.ToSlash(rel)
+			if len(mains) > 1 {
+				plan.Notes = append(plan.Notes, fmt.Sprintf("Several commands found, building %s", pkg))
+			}
+		}
+	}
+
+	w := newDockerfile(StackGo)
+	w.line("FROM golang:%s-alpine AS build", version)
+	w.line("WORKDIR /src")
+	w.line("COPY %s ./", strings.Join(existing(has, "go.mod", "go.sum"), " "))
+	w.line("RUN --mount=type=cache,target=/go/pkg/mod go mod download")
+	w.line("COPY . .")
+	w.line("RUN --mount=type=cache,target=/go/pkg/mod --mount=type=cache,target=/root/.cache/go-build \\")
+	w.line(`    CGO_ENABLED=0 go build -trimpath -ldflags="-s -w" -o /out/app %s`, pkg)
+	w.line("")
+	w.line("FROM alpine:3.20")
+	w.line("RUN apk add --no-cache ca-certificates tzdata curl && adduser -D -H app")
+	w.line("COPY --from=build /out/app /usr/local/bin/app")
+	w.line("USER app")
+	w.line("ENV PORT=%d", plan.Port)
+	w.line("EXPOSE %d", plan.Port)
+	w.healthcheck(fmt.Sprintf("curl -s -o /dev/null http://127.0.0.1:%d/ || exit 1", plan.Port))
+	w.line(`CMD ["app"]`)
+	plan.Dockerfile = w.String()
+	plan.Dockerignore = dockerignore("bin")
+	plan.Notes = append(plan.Notes, "The app should listen on $PORT (8080)")
+	return plan
+}
+
+// sourceContext is the directory a project built from source is built in
+func sourceContext(project string, p database.Project) string {
+	return filepath.Join(ProjectsRoot, project, sourceDir, p.GitSubdir)
+}
+
+func isSourceProject(p database.Project) bool {
+	return p.SourceType == SourceGit || p.SourceType == SourceUpload
+}
+
+// GetBuildPlan returns the project's generated Dockerfile, or the one that
+// would be generated from its current source
+func GetBuildPlan(project string) (BuildPlan, error) {
+	if !projectExists(project) {
+		return BuildPlan{}, fmt.Errorf("project %s not found", project)
+	}
+	p := getOrCreateProject(project)
+	if !isSourceProject(p) {
+		return BuildPlan{}, fmt.Errorf("project %s is not built from source", project)
+	}
+	dir := filepath.Join(ProjectsRoot, project)
+	if data, err := os.ReadFile(filepath.Join(dir, generatedDockerfile)); err == nil {
+		ignore, _ := os.ReadFile(filepath.Join(dir, generatedDockerignore))
+		plan := BuildPlan{Dockerfile: string(data), Dockerignore: string(ignore), Port: p.AppPort, Saved: true}
+		if m := generatedRe.FindStringSubmatch(plan.Dockerfile); m != nil {
+			plan.Stack = m[1]
+		}
+		if m := exposeRe.FindStringSubmatch(plan.Dockerfile); m != nil && plan.Port == 0 {
+			plan.Port, _ = strconv.Atoi(m[1])
+		}
+		return plan, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, sourceDir)); err != nil {
+		return BuildPlan{}, fmt.Errorf("project %s has no source code yet", project)
+	}
+	return DetectBuildPlan(sourceContext(project, p))
+}
+
+// SaveBuildPlan stores an edited generated Dockerfile; the next deploy
+// builds with it
+func SaveBuildPlan(project, dockerfile, ignore, user string) error {
+	if !projectExists(project) {
+		return fmt.Errorf("project %s not found", project)
+	}
+	if !isSourceProject(getOrCreateProject(project)) {
+		return fmt.Errorf("project %s is not built from source", project)
+	}
+	if strings.TrimSpace(dockerfile) == "" || len(dockerfile) > maxDockerfileSize || len(ignore) > maxDockerfileSize {
+		return fmt.Errorf("dockerfile must be between 1 byte and 64KB")
+	}
+	if err := writeBuildPlan(project, dockerfile, ignore); err != nil {
+		return err
+	}
+	RecordProjectChange(project, user, "Edit generated Dockerfile", generatedDockerfile, generatedDockerignore)
+	return nil
+}
+
+// DeleteBuildPlan removes the generated Dockerfile so the next deploy
+// detects the stack again
+func DeleteBuildPlan(project, user string) error {
+	dir := filepath.Join(ProjectsRoot, project)
+	if !projectExists(project) {
+		return fmt.Errorf("project %s not found", project)
+	}
+	if err := os.Remove(filepath.Join(dir, generatedDockerfile)); err != nil {
+		return fmt.Errorf("project %s has no generated Dockerfile", project)
+	}
+	os.Remove(filepath.Join(dir, generatedDockerignore))
+	RecordProjectChange(project, user, "Remove generated Dockerfile", generatedDockerfile, generatedDockerignore)
+	return nil
+}
+
+func writeBuildPlan(project, dockerfile, ignore string) error {
+	dir := filepath.Join(ProjectsRoot, project)
+	if err := os.WriteFile(filepath.Join(dir, generatedDockerfile), []byte(dockerfile), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, generatedDockerignore), []byte(ignore), 0644)
+}
+
+// resolveDockerfile finds the Dockerfile to build: the one set on the
+// project, the repository's own, then the generated one. When there is
+// none it generates one, shows it in the job output and returns "" so the
+// user reviews it before the first build.
+func resolveDockerfile(project, user string, p database.Project, context string, logf JobLogger) (string, error) {
+	if p.Dockerfile != "" {
+		path := filepath.Join(context, p.Dockerfile)
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("no %s found in the source", p.Dockerfile)
+		}
+		return path, nil
+	}
+	for _, path := range []string{filepath.Join(context, "Dockerfile"), filepath.Join(ProjectsRoot, project, generatedDockerfile)} {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	logf("No Dockerfile or compose file in the source, detecting the stack...")
+	plan, err := DetectBuildPlan(context)
+	if err != nil {
+		return "", err
+	}
+	if err := writeBuildPlan(project, plan.Dockerfile, plan.Dockerignore); err != nil {
+		return "", err
+	}
+	RecordProjectChange(project, user, "Generate Dockerfile for a "+plan.Stack+" project", generatedDockerfile, generatedDockerignore)
+
+	updates := map[string]interface{}{"status": "review"}
+	if p.AppPort == 0 {
+		updates["app_port"] = plan.Port
+	}
+	if database.DB != nil {
+		database.DB.Model(&database.Project{}).Where("name = ?", project).Updates(updates)
+	}
+
+	logf(fmt.Sprintf("Detected a %s project, generated %s:", plan.Stack, generatedDockerfile))
+	for _, line := range strings.Split(strings.TrimRight(plan.Dockerfile, "\n"), "\n") {
+		logf("  " + line)
+	}
+	for _, note := range plan.Notes {
+		logf("Note: " + note)
+	}
+	logf("Review the generated Dockerfile, then deploy the project to build it")
+	return "", nil
+}
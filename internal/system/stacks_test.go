@@ -0,0 +1,135 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Each fixture in testdata/stacks is a source tree as a project would have it
+func TestDetectBuildPlan(t *testing.T) {
+	tests := []struct {
+		fixture string
+		stack   string
+		port    int
+		want    []string // lines the Dockerfile must contain
+	}{
+		{
+			fixture: "php_laravel",
+			stack:   StackPHP,
+			port:    80,
+			want: []string{
+				"FROM composer:2 AS vendor",
+				"COPY composer.json composer.lock ./",
+				"FROM php:8.3-apache",
+				"RUN install-php-extensions opcache pdo_mysql pdo_pgsql zip intl bcmath gd redis",
+				"ENV APACHE_DOCUMENT_ROOT=/var/www/html/public",
+				"COPY --from=vendor --chown=www-data:www-data /app /var/www/html",
+			},
+		},
+		{
+			fixture: "php_plain",
+			stack:   StackPHP,
+			port:    80,
+			want: []string{
+				"FROM php:8.3-apache",
+				"RUN install-php-extensions opcache pdo_mysql pdo_pgsql zip intl bcmath",
+				"COPY --chown=www-data:www-data . /var/www/html",
+			},
+		},
+		{
+			fixture: "go_cmd",
+			stack:   StackGo,
+			port:    8080,
+			want: []string{
+				"FROM golang:1.22-alpine AS build",
+				"COPY go.mod ./",
+				`    CGO_ENABLED=0 go build -trimpath -ldflags="-s -w" -o /out/app ./cmd/server`,
+				"EXPOSE 8080",
+			},
+		},
+		{
+			fixture: "python_flask",
+			stack:   StackPython,
+			port:    8000,
+			want: []string{
+				"FROM python:3.12-slim",
+				"RUN --mount=type=cache,target=/root/.cache/pip pip install -r requirements.txt gunicorn",
+				`CMD ["gunicorn", "app:app", "--bind", "0.0.0.0:8000"]`,
+			},
+		},
+		{
+			fixture: "python_fastapi",
+			stack:   StackPython,
+			port:    8000,
+			want: []string{
+				"RUN --mount=type=cache,target=/root/.cache/pip pip install -r requirements.txt",
+				`CMD ["uvicorn", "main:app", "--host", "0.0.0.0", "--port", "8000"]`,
+			},
+		},
+		{
+			fixture: "node_server",
+			stack:   StackNode,
+			port:    3000,
+			want: []string{
+				"FROM node:18-alpine",
+				"COPY package.json package-lock.json ./",
+				"RUN --mount=type=cache,target=/root/.npm npm ci",
+				"RUN npm prune --omit=dev",
+				`CMD ["npm", "start"]`,
+			},
+		},
+		{
+			fixture: "node_spa",
+			stack:   StackNode,
+			port:    80,
+			want: []string{
+				"FROM node:20-alpine AS build",
+				"RUN --mount=type=cache,target=/usr/local/share/.cache/yarn yarn install --frozen-lockfile",
+				"RUN yarn run build",
+				"FROM nginx:1.27-alpine",
+				"COPY --from=build /app/dist /usr/share/nginx/html",
+			},
+		},
+		{
+			fixture: "static",
+			stack:   StackStatic,
+			port:    80,
+			want: []string{
+				"FROM nginx:1.27-alpine",
+				"COPY . /usr/share/nginx/html",
+				"HEALTHCHECK --interval=30s --timeout=5s --start-period=30s --retries=3 CMD wget -q -S -O /dev/null http://127.0.0.1/ 2>&1 | grep -q HTTP/",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			plan, err := DetectBuildPlan(filepath.Join("testdata", "stacks", tt.fixture))
+			if err != nil {
+				t.Fatalf("DetectBuildPlan: %v", err)
+			}
+			if plan.Stack != tt.stack || plan.Port != tt.port {
+				t.Errorf("got stack %s on port %d, want %s on port %d", plan.Stack, plan.Port, tt.stack, tt.port)
+			}
+			if m := generatedRe.FindStringSubmatch(plan.Dockerfile); m == nil || m[1] != tt.stack {
+				t.Errorf("Dockerfile does not start with the generated header for %s", tt.stack)
+			}
+			lines := strings.Split(plan.Dockerfile, "\n")
+			for _, want := range tt.want {
+				if !containsString(lines, want) {
+					t.Errorf("Dockerfile has no line %q:\n%s", want, plan.Dockerfile)
+				}
+			}
+			if !strings.Contains(plan.Dockerignore, ".env\n") {
+				t.Errorf(".dockerignore does not exclude .env:\n%s", plan.Dockerignore)
+			}
+		})
+	}
+}
+
+func TestDetectBuildPlanUnknownStack(t *testing.T) {
+	if plan, err := DetectBuildPlan(filepath.Join("testdata", "stacks", "empty")); err == nil {
+		t.Errorf("detected a %s stack in a tree without any manifest", plan.Stack)
+	}
+}
@@ -0,0 +1,799 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/goccy/go-yaml"
+)
+
+// A staging clone is a copy of a project under <name>-staging: same compose
+// file and .env, a copy of every volume, databases copied with a logical
+// dump, its own private network and a temporary subdomain. Promoting it
+// brings its compose file and .env back to production, keeping production's
+// domains, ports, networks and secrets.
+
+const (
+	stagingSuffix      = "-staging"
+	databaseReadyWait  = 2 * time.Minute
+	restoreOutputLines = 5
+)
+
+// Keys of a service that belong to its environment rather than to the app:
+// promoting keeps production's
+var environmentKeys = []string{"container_name", "ports", "networks"}
+
+var hostRuleRe = regexp.MustCompile("Host\\(`([^`]+)`\\)")
+
+// databaseEngine dumps a whole database server to stdout and restores such
+// a dump from stdin, with the credentials the official images are set up with
+type databaseEngine struct {
+	Name, Ready, Dump, Restore string
+}
+
+var (
+	postgresEngine = databaseEngine{
+		Name:    "postgres",
+		Ready:   `pg_isready -q -U "${POSTGRES_USER:-postgres}"`,
+		Dump:    `exec pg_dumpall -U "${POSTGRES_USER:-postgres}"`,
+		Restore: `exec psql -q -U "${POSTGRES_USER:-postgres}" -d postgres`,
+	}
+	mysqlEngine = databaseEngine{
+		Name:  "mysql",
+		Ready: `export MYSQL_PWD="${MYSQL_ROOT_PASSWORD:-$MARIADB_ROOT_PASSWORD}"; $(command -v mysqladmin || command -v mariadb-admin) -uroot ping --silent`,
+		Dump: `export MYSQL_PWD="${MYSQL_ROOT_PASSWORD:-$MARIADB_ROOT_PASSWORD}"; C=$(command -v mysql || command -v mariadb)
+DBS=$($C -uroot -N -e 'SHOW DATABASES' | grep -Ev '^(mysql|information_schema|performance_schema|sys)$')
+exec $(command -v mysqldump || command -v mariadb-dump) -uroot --single-transaction --routines --events --triggers --databases $DBS`,
+		Restore: `export MYSQL_PWD="${MYSQL_ROOT_PASSWORD:-$MARIADB_ROOT_PASSWORD}"; exec $(command -v mysql || command -v mariadb) -uroot`,
+	}
+	mongoEngine = databaseEngine{
+		Name:    "mongo",
+		Ready:   `$(command -v mongosh || command -v mongo) --quiet --eval 'db.runCommand({ping: 1})' >/dev/null`,
+		Dump:    `if [ -n "$MONGO_INITDB_ROOT_USERNAME" ]; then set -- --username "$MONGO_INITDB_ROOT_USERNAME" --password "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin; fi; exec mongodump --archive --quiet "$@"`,
+		Restore: `if [ -n "$MONGO_INITDB_ROOT_USERNAME" ]; then set -- --username "$MONGO_INITDB_ROOT_USERNAME" --password "$MONGO_INITDB_ROOT_PASSWORD" --authenticationDatabase admin; fi; exec mongorestore --archive --drop --quiet "$@"`,
+	}
+)
+
+// detectDatabaseEngine tells from its image whether a service is a database
+// the clone can dump
+func detectDatabaseEngine(image string) *databaseEngine {
+	repo := imageRepo(image)
+	if i := strings.LastIndex(repo, "/"); i >= 0 {
+		repo = repo[i+1:]
+	}
+	switch {
+	case strings.HasPrefix(repo, "postgres"), strings.HasPrefix(repo, "postgis"):
+		return &postgresEngine
+	case strings.HasPrefix(repo, "mysql"), strings.HasPrefix(repo, "mariadb"), strings.HasPrefix(repo, "percona"):
+		return &mysqlEngine
+	case strings.HasPrefix(repo, "mongo"):
+		return &mongoEngine
+	}
+	return nil
+}
+
+// stagingPlan is what cloning a compose file found out
+type stagingPlan struct {
+	doc       yaml.MapSlice
+	volumes   map[string]string   // production volume -> staging volume
+	databases map[string][]string // database service -> volumes it mounts
+	binds     map[string][]string // database service -> project paths it mounts
+	engines   map[string]*databaseEngine
+	warnings  []string
+}
+
+// CloneToStaging copies a project into <name>-staging and starts it as a job.
+// domain is the staging subdomain; empty picks a random one next to the
+// production domain.
+func CloneToStaging(project, domain, user string) (Job, error) {
+	if !projectExists(project) {
+		return Job{}, fmt.Errorf("project %s not found", project)
+	}
+	if database.DB == nil {
+		return Job{}, fmt.Errorf("database not initialized")
+	}
+	if getOrCreateProject(project).StagingOf != "" {
+		return Job{}, fmt.Errorf("project %s is already a staging project", project)
+	}
+	staging := project + stagingSuffix
+	if err := ValidateNewProjectName(staging); err != nil {
+		return Job{}, err
+	}
+	content, err := os.ReadFile(projectComposePath(project))
+	if err != nil {
+		return Job{}, fmt.Errorf("project %s has no docker-compose.yml", project)
+	}
+	var doc yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(content, &doc, yaml.UseOrderedMap()); err != nil {
+		return Job{}, fmt.Errorf("invalid compose file: %v", err)
+	}
+	if domain == "" {
+		domain = stagingDomain(doc)
+	} else if err := ValidateDomain(domain); err != nil {
+		return Job{}, err
+	}
+
+	plan, err := stagingCompose(doc, project, staging, domain)
+	if err != nil {
+		return Job{}, err
+	}
+	compose, err := yaml.MarshalWithOptions(plan.doc, yaml.IndentSequence(true))
+	if err != nil {
+		return Job{}, err
+	}
+
+	dir := filepath.Join(ProjectsRoot, staging)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return Job{}, fmt.Errorf("failed to create project directory: %v", err)
+	}
+	p := getOrCreateProject(staging)
+	var domains []string
+	if domain != "" {
+		domains = []string{domain}
+	}
+	database.DB.Model(&p).Updates(database.Project{Status: "creating", StagingOf: project, Domains: domains})
+
+	return StartJob("staging", staging, user, func(ctx context.Context, logf JobLogger) error {
+		err := populateStaging(ctx, project, staging, compose, plan, user, logf)
+		if err != nil {
+			database.DB.Model(&database.Project{}).Where("name = ?", staging).Update("status", "error")
+			return err
+		}
+		if domain != "" {
+			logf("Staging is available at https://" + domain)
+		}
+		return nil
+	}), nil
+}
+
+func populateStaging(ctx context.Context, project, staging string, compose []byte, plan stagingPlan, user string, logf JobLogger) error {
+	src, dst := filepath.Join(ProjectsRoot, project), filepath.Join(ProjectsRoot, staging)
+
+	// Databases that run are copied with a dump, consistent unlike their files
+	production := map[string]string{} // service -> running container
+	if containers, err := inspectProjectContainers(project); err == nil {
+		for _, ct := range containers {
+			if ct.State.Running {
+				production[ct.Config.Labels[composeServiceLabel]] = ct.ID
+			}
+		}
+	}
+	dumps := map[string]bool{}  // database services to dump
+	dumped := map[string]bool{} // their volumes, not copied
+	var skip []string           // their project paths, not copied
+	for service, volumes := range plan.databases {
+		if production[service] == "" {
+			continue
+		}
+		dumps[service] = true
+		for _, v := range volumes {
+			dumped[v] = true
+		}
+		for _, b := range plan.binds[service] {
+			logf(fmt.Sprintf("Not copying %s: the database of service %s is copied with a dump", b, service))
+			skip = append(skip, b)
+		}
+	}
+
+	// Project files first: .env and the data of relative bind mounts
+	logf("Copying project files...")
+	if err := copyDirExcept(src, dst, skip); err != nil {
+		return fmt.Errorf("failed to copy project files: %v", err)
+	}
+	os.RemoveAll(filepath.Join(dst, ".git"))
+	if err := os.WriteFile(filepath.Join(dst, "docker-compose.yml"), compose, 0644); err != nil {
+		return err
+	}
+	if err := copySecrets(project, staging); err != nil {
+		return fmt.Errorf("failed to copy secrets: %v", err)
+	}
+	RecordProjectChange(staging, user, "Clone "+project+" to staging", "docker-compose.yml")
+	for _, w := range plan.warnings {
+		logf("Warning: " + w)
+	}
+
+	if usesTraefikNetwork(plan.doc) {
+		if err := EnsureTraefikNetwork(); err != nil {
+			return fmt.Errorf("failed to prepare traefik network: %v", err)
+		}
+	}
+	if err := streamCompose(ctx, staging, logf, "up", "--no-start"); err != nil {
+		return err
+	}
+	for from, to := range plan.volumes {
+		if dumped[from] {
+			continue
+		}
+		if _, err := runDocker("volume", "inspect", from); err != nil {
+			logf(fmt.Sprintf("Volume %s does not exist yet, %s starts empty", from, to))
+			continue
+		}
+		logf(fmt.Sprintf("Copying volume %s to %s...", from, to))
+		if _, err := runDocker("run", "--rm", "--network", "none", "-v", from+":/from:ro", "-v", to+":/to",
+			volumeHelperImage, "cp", "-a", "/from/.", "/to/"); err != nil {
+			return fmt.Errorf("failed to copy volume %s: %v", from, err)
+		}
+	}
+	if err := streamCompose(ctx, staging, logf, "up", "-d"); err != nil {
+		return err
+	}
+
+	if len(dumps) > 0 {
+		containers, err := inspectProjectContainers(staging)
+		if err != nil {
+			return err
+		}
+		others := []string{}
+		for _, ct := range containers {
+			service := ct.Config.Labels[composeServiceLabel]
+			engine := plan.engines[service]
+			if !dumps[service] {
+				if !containsString(others, service) {
+					others = append(others, service)
+				}
+				continue
+			}
+			logf(fmt.Sprintf("Copying %s database of service %s...", engine.Name, service))
+			if err := waitDatabaseReady(ct.ID, engine); err != nil {
+				return fmt.Errorf("database of service %s: %v", service, err)
+			}
+			if err := copyDatabase(production[service], ct.ID, engine, logf); err != nil {
+				return fmt.Errorf("failed to copy database of service %s: %v", service, err)
+			}
+		}
+		// Apps that connected to the empty database start again on the copy
+		if len(others) > 0 {
+			if err := streamCompose(ctx, staging, logf, append([]string{"restart"}, others...)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	syncProjectStatus(staging)
+	recordDeploymentLogged(staging, user, "staging", "cloned from "+project)
+	return nil
+}
+
+// stagingCompose rewrites a production compose file for its staging clone
+func stagingCompose(doc yaml.MapSlice, project, staging, domain string) (stagingPlan, error) {
+	plan := stagingPlan{volumes: map[string]string{}, databases: map[string][]string{}, binds: map[string][]string{},
+		engines: map[string]*databaseEngine{}}
+	doc = retargetSecrets(doc, project, staging)
+
+	// Networks: a private default, no shared external ones
+	networks, _ := mapValue(doc, "networks").(yaml.MapSlice)
+	dropped := map[string]bool{}
+	kept := yaml.MapSlice{{Key: "default", Value: yaml.MapSlice{{Key: "name", Value: projectNetworkName(staging)}}}}
+	for _, n := range networks {
+		key := fmt.Sprint(n.Key)
+		def, _ := n.Value.(yaml.MapSlice)
+		switch {
+		case key == "default":
+		case fmt.Sprint(mapValue(def, "external")) == "true":
+			dropped[key] = true
+			if name := fmt.Sprint(mapValue(def, "name")); name != TraefikNetwork {
+				plan.warnings = append(plan.warnings, fmt.Sprintf("external network %s is not attached to the staging clone", key))
+			}
+		default:
+			if mapValue(def, "name") != nil {
+				def = setMapValue(def, "name", staging+"-"+key)
+			}
+			kept = append(kept, yaml.MapItem{Key: key, Value: def})
+		}
+	}
+	doc = setMapValue(doc, "networks", kept)
+
+	// Volumes: every named volume gets the staging project's own copy
+	volumes, _ := mapValue(doc, "volumes").(yaml.MapSlice)
+	for i, v := range volumes {
+		key := fmt.Sprint(v.Key)
+		def, _ := v.Value.(yaml.MapSlice)
+		from := project + "_" + key
+		if name := mapValue(def, "name"); name != nil {
+			from = fmt.Sprint(name)
+		} else if fmt.Sprint(mapValue(def, "external")) == "true" {
+			from = key
+		}
+		plan.volumes[from] = staging + "_" + key
+		clean := yaml.MapSlice{}
+		for _, item := range def {
+			if k := fmt.Sprint(item.Key); k != "name" && k != "external" {
+				clean = append(clean, item)
+			}
+		}
+		volumes[i].Value = clean
+	}
+	volumeSource := map[string]string{} // key -> production volume
+	for from, to := range plan.volumes {
+		volumeSource[strings.TrimPrefix(to, staging+"_")] = from
+	}
+
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	var routed []string
+	ports := map[string]int{}
+	for i, svc := range services {
+		name := fmt.Sprint(svc.Key)
+		def, _ := svc.Value.(yaml.MapSlice)
+
+		if mapValue(def, "container_name") != nil {
+			def = deleteMapKey(def, "container_name")
+		}
+		if publishesHostPort(def) {
+			def = deleteMapKey(def, "ports")
+			plan.warnings = append(plan.warnings, fmt.Sprintf("service %s does not publish its host ports in staging", name))
+		}
+		switch n := mapValue(def, "networks").(type) {
+		case yaml.MapSlice:
+			left := yaml.MapSlice{}
+			for _, item := range n {
+				if !dropped[fmt.Sprint(item.Key)] {
+					left = append(left, item)
+				}
+			}
+			def = setMapValue(def, "networks", left)
+		case []interface{}:
+			left := []interface{}{}
+			for _, item := range n {
+				if !dropped[fmt.Sprint(item)] {
+					left = append(left, item)
+				}
+			}
+			def = setMapValue(def, "networks", left)
+		}
+
+		mounts := serviceVolumeMounts(def)
+		for _, m := range mounts {
+			if strings.HasPrefix(m, "/") && !strings.HasPrefix(m, filepath.Join(ProjectsRoot, project)+"/") {
+				plan.warnings = append(plan.warnings, fmt.Sprintf("service %s mounts %s, which is shared with production", name, m))
+			}
+		}
+		if engine := detectDatabaseEngine(fmt.Sprint(mapValue(def, "image"))); engine != nil {
+			plan.engines[name] = engine
+			for _, m := range mounts {
+				if from, ok := volumeSource[m]; ok {
+					plan.databases[name] = append(plan.databases[name], from)
+				} else if rel, ok := projectBindPath(project, m); ok {
+					plan.binds[name] = append(plan.binds[name], rel)
+				}
+			}
+			if _, ok := plan.databases[name]; !ok {
+				plan.databases[name] = []string{}
+			}
+		}
+
+		if routedByTraefik(def) {
+			routed = append(routed, name)
+			ports[name] = traefikServicePort(def)
+		}
+		services[i].Value = def
+	}
+	doc = setMapValue(doc, "services", services)
+
+	if len(routed) > 0 && domain == "" {
+		return plan, fmt.Errorf("set the staging domain: the production project has none to derive it from")
+	}
+	for i, name := range routed {
+		router, d := staging, domain
+		if i > 0 {
+			router, d = staging+"-"+name, name+"-"+domain
+		}
+		var err error
+		if doc, err = routeDomains(doc, router, name, ports[name], []string{d}); err != nil {
+			return plan, err
+		}
+	}
+	plan.doc = doc
+	return plan, nil
+}
+
+// projectBindPath returns the path inside the project directory of a bind
+// mount source, if it is one
+func projectBindPath(project, source string) (string, bool) {
+	dir := filepath.Join(ProjectsRoot, project)
+	switch {
+	case strings.HasPrefix(source, "/"):
+	case strings.HasPrefix(source, "."):
+		source = filepath.Join(dir, source)
+	default:
+		return "", false
+	}
+	rel, err := filepath.Rel(dir, filepath.Clean(source))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// copyDirExcept copies src into dst like cp -a, leaving the paths in skip,
+// relative to src, as empty directories
+func copyDirExcept(src, dst string, skip []string) error {
+	if len(skip) == 0 {
+		if out, err := exec.Command("cp", "-a", src+"/.", dst).CombinedOutput(); err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		from, to := filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())
+		skipped := false
+		var nested []string
+		for _, s := range skip {
+			first, rest, deeper := strings.Cut(s, "/")
+			switch {
+			case first != e.Name():
+			case deeper:
+				nested = append(nested, rest)
+			default:
+				skipped = true
+			}
+		}
+		if !skipped && (len(nested) == 0 || !e.IsDir()) {
+			if out, err := exec.Command("cp", "-a", from, to).CombinedOutput(); err != nil {
+				return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+			}
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(to, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if !skipped {
+			if err := copyDirExcept(from, to, nested); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// serviceVolumeMounts lists the sources a service mounts: volume names, or
+// paths for bind mounts
+func serviceVolumeMounts(def yaml.MapSlice) []string {
+	var sources []string
+	entries, _ := mapValue(def, "volumes").([]interface{})
+	for _, e := range entries {
+		if long, ok := e.(yaml.MapSlice); ok {
+			if s := mapValue(long, "source"); s != nil {
+				sources = append(sources, fmt.Sprint(s))
+			}
+			continue
+		}
+		if source, _, found := strings.Cut(fmt.Sprint(e), ":"); found {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// traefikServicePort reads the port Traefik forwards to from the labels
+func traefikServicePort(def yaml.MapSlice) int {
+	var port int
+	visit := func(k, v string) {
+		if strings.HasPrefix(k, "traefik.http.services.") && strings.HasSuffix(k, ".loadbalancer.server.port") {
+			fmt.Sscan(v, &port)
+		}
+	}
+	switch labels := mapValue(def, "labels").(type) {
+	case yaml.MapSlice:
+		for _, l := range labels {
+			visit(fmt.Sprint(l.Key), fmt.Sprint(l.Value))
+		}
+	case []interface{}:
+		for _, l := range labels {
+			k, v, _ := strings.Cut(fmt.Sprint(l), "=")
+			visit(k, v)
+		}
+	}
+	return port
+}
+
+// stagingDomain picks a random subdomain next to the first production
+// domain: shop.example.com gives shop-staging-1a2b3c.example.com
+func stagingDomain(doc yaml.MapSlice) string {
+	services, _ := mapValue(doc, "services").(yaml.MapSlice)
+	for _, svc := range services {
+		def, _ := svc.Value.(yaml.MapSlice)
+		labels, _ := yaml.Marshal(mapValue(def, "labels"))
+		if m := hostRuleRe.FindStringSubmatch(string(labels)); m != nil {
+			return siblingDomain(m[1], "staging-"+randomHex(3))
+		}
+	}
+	return ""
+}
+
+// siblingDomain tags the first label of a domain, or adds a label to a
+// bare domain: shop.example.com gives shop-<tag>.example.com
+func siblingDomain(domain, tag string) string {
+	first, rest, found := strings.Cut(domain, ".")
+	if !found || !strings.Contains(rest, ".") {
+		return tag + "." + domain
+	}
+	return first + "-" + tag + "." + rest
+}
+
+func waitDatabaseReady(container string, engine *databaseEngine) error {
+	deadline := time.Now().Add(databaseReadyWait)
+	ready := 0
+	for time.Now().Before(deadline) {
+		// Images restart the server once initialized: wait for two answers
+		if err := exec.Command("docker", "exec", container, "sh", "-c", engine.Ready).Run(); err == nil {
+			if ready++; ready == 2 {
+				return nil
+			}
+		} else {
+			ready = 0
+		}
+		time.Sleep(3 * time.Second)
+	}
+	return fmt.Errorf("not ready after %s", databaseReadyWait)
+}
+
+// copyDatabase pipes a dump of the production database into staging's
+func copyDatabase(from, to string, engine *databaseEngine, logf JobLogger) error {
+	dump := exec.Command("docker", "exec", from, "sh", "-c", engine.Dump)
+	restore := exec.Command("docker", "exec", "-i", to, "sh", "-c", engine.Restore)
+	pr, pw := io.Pipe()
+	var dumpErr, restoreOut strings.Builder
+	dump.Stdout, dump.Stderr = pw, &dumpErr
+	restore.Stdin, restore.Stdout, restore.Stderr = pr, &restoreOut, &restoreOut
+
+	if err := restore.Start(); err != nil {
+		return err
+	}
+	err := dump.Run()
+	pw.CloseWithError(err)
+	restoreErr := restore.Wait()
+
+	logRestoreOutput(restoreOut.String(), logf)
+	if err != nil {
+		return fmt.Errorf("dump failed: %v: %s", err, strings.TrimSpace(dumpErr.String()))
+	}
+	return restoreErr
+}
+
+// logRestoreOutput logs the tail of what a restore printed. A restore over
+// a freshly initialized server reports objects that already exist; the
+// tail is enough to see real problems.
+func logRestoreOutput(out string, logf JobLogger) {
+	lines := splitLines(out)
+	if len(lines) > restoreOutputLines {
+		lines = lines[len(lines)-restoreOutputLines:]
+	}
+	for _, l := range lines {
+		logf(l)
+	}
+}
+
+// PromotePlan shows what promoting a staging project would change
+type PromotePlan struct {
+	Production string `json:"production"`
+	Current    string `json:"current"`
+	Compose    string `json:"compose"`
+	EnvChanged bool   `json:"env_changed"`
+	// Secrets staging has and production does not: production's are kept
+	MissingSecrets []string `json:"missing_secrets"`
+}
+
+// GetPromotePlan builds the compose file production would get
+func GetPromotePlan(staging string) (PromotePlan, error) {
+	p := getOrCreateProject(staging)
+	if !projectExists(staging) || p.StagingOf == "" {
+		return PromotePlan{}, fmt.Errorf("project %s is not a staging project", staging)
+	}
+	plan := PromotePlan{Production: p.StagingOf}
+	if !projectExists(plan.Production) {
+		return plan, fmt.Errorf("production project %s not found", plan.Production)
+	}
+	stagingContent, err := os.ReadFile(projectComposePath(staging))
+	if err != nil {
+		return plan, err
+	}
+	current, err := os.ReadFile(projectComposePath(plan.Production))
+	if err != nil {
+		return plan, err
+	}
+	// Production keeps reading its own secrets
+	stagingContent = bytes.ReplaceAll(stagingContent, []byte(secretsEnvPath(staging)), []byte(secretsEnvPath(plan.Production)))
+	compose, err := promotedCompose(stagingContent, current)
+	if err != nil {
+		return plan, err
+	}
+	plan.Current, plan.Compose = string(current), string(compose)
+	stagingEnv, _ := os.ReadFile(filepath.Join(ProjectsRoot, staging, ".env"))
+	productionEnv, _ := os.ReadFile(filepath.Join(ProjectsRoot, plan.Production, ".env"))
+	plan.EnvChanged = string(stagingEnv) != string(productionEnv)
+
+	plan.MissingSecrets = []string{}
+	stagingSecrets, _ := ListSecrets(staging)
+	productionSecrets, _ := ListSecrets(plan.Production)
+	have := map[string]bool{}
+	for _, s := range productionSecrets {
+		have[s.Key] = true
+	}
+	for _, s := range stagingSecrets {
+		if !have[s.Key] {
+			plan.MissingSecrets = append(plan.MissingSecrets, s.Key)
+		}
+	}
+	return plan, nil
+}
+
+// PromoteStaging applies a staging project's compose file and .env to
+// production and redeploys it. confirm must be the production project name.
+func PromoteStaging(staging, confirm, user string) (Job, error) {
+	plan, err := GetPromotePlan(staging)
+	if err != nil {
+		return Job{}, err
+	}
+	production := plan.Production
+	if confirm != production {
+		return Job{}, fmt.Errorf("type the production project name %s to confirm", production)
+	}
+	if !beginProjectOperation(production) {
+		return Job{}, fmt.Errorf("another deployment is already running for this project")
+	}
+
+	dir := filepath.Join(ProjectsRoot, production)
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(plan.Compose), 0644); err != nil {
+		endProjectOperation(production)
+		return Job{}, err
+	}
+	if env, err := os.ReadFile(filepath.Join(ProjectsRoot, staging, ".env")); err == nil {
+		err = os.WriteFile(filepath.Join(dir, ".env"), env, 0600)
+		if err != nil {
+			endProjectOperation(production)
+			return Job{}, err
+		}
+	} else {
+		os.Remove(filepath.Join(dir, ".env"))
+	}
+	RecordProjectChange(production, user, "Promote "+staging, "docker-compose.yml")
+
+	return startHeldJob("promote", production, user, func(ctx context.Context, logf JobLogger) error {
+		var doc yaml.MapSlice
+		yaml.UnmarshalWithOptions([]byte(plan.Compose), &doc, yaml.UseOrderedMap())
+		if usesTraefikNetwork(doc) {
+			if err := EnsureTraefikNetwork(); err != nil {
+				return fmt.Errorf("failed to prepare traefik network: %v", err)
+			}
+		}
+		if err := composeUp(ctx, production, logf); err != nil {
+			return err
+		}
+		logf("Waiting for services to become healthy...")
+		if err := waitProjectHealthy(ctx, production, updateHealthTimeout); err != nil {
+			go SendAlert(fmt.Sprintf("Project *%s* is not healthy after promoting %s: %v", production, staging, err))
+			return fmt.Errorf("promoted deployment is not healthy: %v", err)
+		}
+		syncProjectStatus(production)
+		recordDeploymentLogged(production, user, "promote", "promoted from "+staging)
+		return nil
+	}), nil
+}
+
+// promotedCompose takes the services from staging and, for those production
+// already has, production's container names, ports, networks and Traefik
+// labels. Top-level networks and volumes stay production's.
+func promotedCompose(stagingContent, productionContent []byte) ([]byte, error) {
+	var staging, production yaml.MapSlice
+	if err := yaml.UnmarshalWithOptions(stagingContent, &staging, yaml.UseOrderedMap()); err != nil {
+		return nil, fmt.Errorf("invalid staging compose file: %v", err)
+	}
+	if err := yaml.UnmarshalWithOptions(productionContent, &production, yaml.UseOrderedMap()); err != nil {
+		return nil, fmt.Errorf("invalid production compose file: %v", err)
+	}
+
+	stagingServices, _ := mapValue(staging, "services").(yaml.MapSlice)
+	productionServices, _ := mapValue(production, "services").(yaml.MapSlice)
+	for i, svc := range stagingServices {
+		def, _ := svc.Value.(yaml.MapSlice)
+		prod, known := mapValue(productionServices, fmt.Sprint(svc.Key)).(yaml.MapSlice)
+		for _, k := range environmentKeys {
+			if v := mapValue(prod, k); known && v != nil {
+				def = setMapValue(def, k, v)
+			} else {
+				def = deleteMapKey(def, k)
+			}
+		}
+		labels := nonTraefikLabels(mapValue(def, "labels"))
+		if known {
+			labels = append(labels, traefikOnlyLabels(mapValue(prod, "labels"))...)
+		}
+		switch {
+		case len(labels) == 0:
+			def = deleteMapKey(def, "labels")
+		case isLabelList(mapValue(def, "labels")):
+			list := make([]interface{}, len(labels))
+			for j, l := range labels {
+				list[j] = fmt.Sprintf("%v=%v", l.Key, l.Value)
+			}
+			def = setMapValue(def, "labels", list)
+		default:
+			def = setMapValue(def, "labels", labels)
+		}
+		stagingServices[i].Value = def
+	}
+
+	out := yaml.MapSlice{}
+	for _, item := range staging {
+		switch key := fmt.Sprint(item.Key); key {
+		case "services":
+			out = append(out, yaml.MapItem{Key: key, Value: stagingServices})
+		case "networks", "volumes":
+		default:
+			out = append(out, item)
+		}
+	}
+	networks, _ := mapValue(production, "networks").(yaml.MapSlice)
+	if len(networks) > 0 {
+		out = append(out, yaml.MapItem{Key: "networks", Value: networks})
+	}
+	volumes, _ := mapValue(production, "volumes").(yaml.MapSlice)
+	stagingVolumes, _ := mapValue(staging, "volumes").(yaml.MapSlice)
+	for _, v := range stagingVolumes {
+		if !mapHasKey(volumes, fmt.Sprint(v.Key)) {
+			volumes = append(volumes, v)
+		}
+	}
+	if len(volumes) > 0 {
+		out = append(out, yaml.MapItem{Key: "volumes", Value: volumes})
+	}
+	return yaml.MarshalWithOptions(out, yaml.IndentSequence(true))
+}
+
+// labelItems turns map or list style labels into key/value items
+func labelItems(labels interface{}) yaml.MapSlice {
+	items := yaml.MapSlice{}
+	switch l := labels.(type) {
+	case yaml.MapSlice:
+		items = append(items, l...)
+	case []interface{}:
+		for _, e := range l {
+			k, v, _ := strings.Cut(fmt.Sprint(e), "=")
+			items = append(items, yaml.MapItem{Key: k, Value: v})
+		}
+	}
+	return items
+}
+
+func isLabelList(labels interface{}) bool {
+	_, ok := labels.([]interface{})
+	return ok
+}
+
+func nonTraefikLabels(labels interface{}) yaml.MapSlice {
+	kept := yaml.MapSlice{}
+	for _, item := range labelItems(labels) {
+		if !strings.HasPrefix(fmt.Sprint(item.Key), "traefik.") {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func traefikOnlyLabels(labels interface{}) yaml.MapSlice {
+	kept := yaml.MapSlice{}
+	for _, item := range labelItems(labels) {
+		if strings.HasPrefix(fmt.Sprint(item.Key), "traefik.") {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,327 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/goccy/go-yaml"
+)
+
+// BuiltinTemplates holds the templates shipped with the panel; it is set
+// from the embedded templates/ directory at startup.
+var BuiltinTemplates fs.FS
+
+const userTemplatesDir = "data/templates"
+
+// Template parameter types
+const (
+	ParamString   = "string"
+	ParamInt      = "int"
+	ParamBool     = "bool"
+	ParamDomain   = "domain"
+	ParamPassword = "password" // generated when left empty
+	ParamSelect   = "select"
+)
+
+// TemplateParam is one input declared in a template's metadata header
+type TemplateParam struct {
+	Name        string      `json:"name" yaml:"name"`
+	Label       string      `json:"label,omitempty" yaml:"label"`
+	Description string      `json:"description,omitempty" yaml:"description"`
+	Type        string      `json:"type" yaml:"type"`
+	Default     interface{} `json:"default,omitempty" yaml:"default"`
+	Required    bool        `json:"required" yaml:"required"`
+	Options     []string    `json:"options,omitempty" yaml:"options"`
+}
+
+// Template is a compose file with a metadata header. The header is a YAML
+// document above the first "---" line; the compose document below it is
+// rendered with text/template using the parameters and .ProjectName.
+type Template struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name" yaml:"name"`
+	Description string          `json:"description" yaml:"description"`
+	Source      string          `json:"source"` // builtin or user
+	Parameters  []TemplateParam `json:"parameters" yaml:"parameters"`
+	// Why a user template cannot be used; it is listed so it can be fixed
+	Error string `json:"error,omitempty"`
+
+	body string
+}
+
+var (
+	templateIDRe    = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	templateParamRe = regexp.MustCompile(`^[A-Z][A-Za-z0-9_]*$`)
+)
+
+var templateFuncs = template.FuncMap{
+	// quote renders a value as a double-quoted YAML scalar
+	"quote": func(v interface{}) string {
+		b, _ := json.Marshal(fmt.Sprint(v))
+		return string(b)
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// parseTemplate splits and checks the metadata header and the compose body
+func parseTemplate(id, source string, content []byte) (*Template, error) {
+	text := strings.ReplaceAll(string(content), "\r\n", "\n")
+	header, body, found := strings.Cut(text, "\n---\n")
+	if !found {
+		return nil, fmt.Errorf("template %s has no metadata header (missing --- separator)", id)
+	}
+
+	t := &Template{}
+	if err := yaml.Unmarshal([]byte(header), t); err != nil {
+		return nil, fmt.Errorf("template %s: invalid metadata header: %v", id, err)
+	}
+	t.ID, t.Source, t.body = id, source, body
+	if t.Name == "" {
+		t.Name = id
+	}
+
+	seen := map[string]bool{}
+	for i, p := range t.Parameters {
+		if !templateParamRe.MatchString(p.Name) || p.Name == "ProjectName" {
+			return nil, fmt.Errorf("template %s: invalid parameter name %q", id, p.Name)
+		}
+		if seen[p.Name] {
+			return nil, fmt.Errorf("template %s: duplicate parameter %s", id, p.Name)
+		}
+		seen[p.Name] = true
+		if p.Type == "" {
+			t.Parameters[i].Type = ParamString
+		}
+		switch t.Parameters[i].Type {
+		case ParamString, ParamInt, ParamBool, ParamDomain, ParamPassword:
+		case ParamSelect:
+			if len(p.Options) == 0 {
+				return nil, fmt.Errorf("template %s: select parameter %s has no options", id, p.Name)
+			}
+		default:
+			return nil, fmt.Errorf("template %s: parameter %s has unknown type %q", id, p.Name, p.Type)
+		}
+		if p.Label == "" {
+			t.Parameters[i].Label = p.Name
+		}
+	}
+
+	if _, err := t.compile(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *Template) compile() (*template.Template, error) {
+	tpl, err := template.New(t.ID).Option("missingkey=error").Funcs(templateFuncs).Parse(t.body)
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %v", t.ID, err)
+	}
+	return tpl, nil
+}
+
+// ListTemplates returns the builtin templates and the user's own from
+// data/templates; a user template replaces a builtin one with the same ID.
+func ListTemplates() ([]*Template, error) {
+	byID := map[string]*Template{}
+
+	if BuiltinTemplates != nil {
+		files, _ := fs.Glob(BuiltinTemplates, "templates/*.yaml")
+		for _, f := range files {
+			content, err := fs.ReadFile(BuiltinTemplates, f)
+			if err != nil {
+				return nil, err
+			}
+			t, err := parseTemplate(strings.TrimSuffix(path.Base(f), ".yaml"), "builtin", content)
+			if err != nil {
+				return nil, err
+			}
+			byID[t.ID] = t
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(userTemplatesDir, "*.yaml"))
+	for _, f := range files {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimSuffix(filepath.Base(f), ".yaml")
+		t, err := parseTemplate(id, "user", content)
+		if err != nil {
+			// One broken upload should not hide the whole catalogue
+			log.Printf("Broken user template %s: %v", f, err)
+			t = &Template{ID: id, Name: id, Source: "user", Parameters: []TemplateParam{}, Error: err.Error()}
+		}
+		byID[t.ID] = t
+	}
+
+	list := make([]*Template, 0, len(byID))
+	for _, t := range byID {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func GetTemplate(id string) (*Template, error) {
+	list, err := ListTemplates()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		if t.ID != id {
+			continue
+		}
+		if t.Error != "" {
+			return nil, fmt.Errorf("%s", t.Error)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("template %s not found", id)
+}
+
+// SaveUserTemplate stores an uploaded template after checking it parses
+func SaveUserTemplate(id string, content []byte) (*Template, error) {
+	if !templateIDRe.MatchString(id) {
+		return nil, fmt.Errorf("invalid template id %q", id)
+	}
+	t, err := parseTemplate(id, "user", content)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(userTemplatesDir, 0755); err != nil {
+		return nil, err
+	}
+	return t, os.WriteFile(filepath.Join(userTemplatesDir, id+".yaml"), content, 0644)
+}
+
+func DeleteUserTemplate(id string) error {
+	if !templateIDRe.MatchString(id) {
+		return fmt.Errorf("invalid template id %q", id)
+	}
+	err := os.Remove(filepath.Join(userTemplatesDir, id+".yaml"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("user template %s not found", id)
+	}
+	return err
+}
+
+// resolveParams checks the submitted values against the declared parameters
+// and fills in defaults
+func (t *Template) resolveParams(values map[string]string) (map[string]interface{}, error) {
+	declared := map[string]bool{}
+	data := map[string]interface{}{}
+
+	for _, p := range t.Parameters {
+		declared[p.Name] = true
+		v, ok := values[p.Name]
+		if !ok || v == "" {
+			if p.Default != nil {
+				v = fmt.Sprint(p.Default)
+			}
+		}
+		if v == "" {
+			switch {
+			case p.Type == ParamPassword:
+				v = randomPassword(24)
+			case p.Required:
+				return nil, fmt.Errorf("parameter %s is required", p.Label)
+			}
+		}
+		if strings.ContainsFunc(v, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+			return nil, fmt.Errorf("parameter %s cannot contain control characters", p.Label)
+		}
+
+		switch p.Type {
+		case ParamInt:
+			if v == "" {
+				data[p.Name] = 0
+				continue
+			}
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s must be a whole number", p.Label)
+			}
+			data[p.Name] = n
+		case ParamBool:
+			if v == "" {
+				data[p.Name] = false
+				continue
+			}
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s must be true or false", p.Label)
+			}
+			data[p.Name] = b
+		case ParamDomain:
+			if v != "" {
+				if err := ValidateDomain(v); err != nil {
+					return nil, fmt.Errorf("parameter %s: %v", p.Label, err)
+				}
+			}
+			data[p.Name] = v
+		case ParamSelect:
+			if v != "" && !containsString(p.Options, v) {
+				return nil, fmt.Errorf("parameter %s must be one of %s", p.Label, strings.Join(p.Options, ", "))
+			}
+			data[p.Name] = v
+		default:
+			data[p.Name] = v
+		}
+	}
+
+	for k := range values {
+		if !declared[k] {
+			return nil, fmt.Errorf("unknown parameter %s", k)
+		}
+	}
+	return data, nil
+}
+
+// Render produces the compose file of a new project from the template
+func (t *Template) Render(project string, values map[string]string) ([]byte, error) {
+	data, err := t.resolveParams(values)
+	if err != nil {
+		return nil, err
+	}
+	data["ProjectName"] = project
+
+	tpl, err := t.compile()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render template %s: %v", t.ID, err)
+	}
+	if _, err := ParseComposeDocument(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("template %s rendered an invalid compose file: %v", t.ID, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func randomPassword(n int) string {
+	const chars = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	b := make([]byte, n)
+	for i := range b {
+		idx, _ := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		b[i] = chars[idx.Int64()]
+	}
+	return string(b)
+}
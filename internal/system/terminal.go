@@ -2,6 +2,7 @@
 package system
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -19,14 +20,14 @@ func ExecuteContainerCommand(containerID, command string) (string, error) {
 	return string(output), nil
 }
 
-func CreateBackup(projectID string) (string, error) {
+func CreateBackup(ctx context.Context, projectID string) (string, error) {
 	os.MkdirAll(BackupRoot, 0755)
 	
 	fileName := fmt.Sprintf("%s_%d.tar.gz", projectID, time.Now().Unix())
 	filePath := filepath.Join(BackupRoot, fileName)
 	projectPath := filepath.Join(ProjectsRoot, projectID)
 	
-	cmd := exec.Command("tar", "-czf", filePath, "-C", projectPath, ".")
+	cmd := exec.CommandContext(ctx, "tar", "-czf", filePath, "-C", projectPath, ".")
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return "", fmt.Errorf("backup failed: %v, output: %s", err, string(output))
 	}
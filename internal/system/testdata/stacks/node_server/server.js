@@ -0,0 +1 @@
+require("express")().listen(process.env.PORT)
@@ -0,0 +1,502 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+)
+
+// Update policies a project can choose
+const (
+	UpdatePolicyNotify = "notify"
+	UpdatePolicyAuto   = "auto"
+	UpdatePolicyPinned = "pinned"
+)
+
+// ServiceUpdate compares the running image of one service with the registry
+type ServiceUpdate struct {
+	Service         string   `json:"service"`
+	Image           string   `json:"image"`
+	LocalDigests    []string `json:"local_digests"`
+	RemoteDigest    string   `json:"remote_digest"`
+	UpdateAvailable bool     `json:"update_available"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// ProjectUpdateStatus is the latest update check of a project
+type ProjectUpdateStatus struct {
+	Project           string          `json:"project"`
+	Policy            string          `json:"policy"`
+	MaintenanceWindow string          `json:"maintenance_window"`
+	UpdateAvailable   bool            `json:"update_available"`
+	Services          []ServiceUpdate `json:"services"`
+	CheckedAt         string          `json:"checked_at"`
+}
+
+const (
+	updateCheckInterval = 6 * time.Hour
+	updateHealthTimeout = 2 * time.Minute
+	healthStablePeriod  = 10 * time.Second
+)
+
+var (
+	updatesMu      sync.Mutex
+	updateStatuses = map[string]ProjectUpdateStatus{}
+	notifiedUpdate = map[string]string{} // project/service -> remote digest already alerted
+	updatingNow    = map[string]bool{}
+	updaterOnce    sync.Once
+)
+
+// StartUpdateChecker compares image digests with their registries every few
+// hours and, every few minutes, applies pending updates of "auto" projects
+// whose maintenance window is open.
+func StartUpdateChecker() {
+	updaterOnce.Do(func() {
+		go func() {
+			var lastCheck time.Time
+			ticker := time.NewTicker(10 * time.Minute)
+			defer ticker.Stop()
+			for {
+				if time.Since(lastCheck) >= updateCheckInterval {
+					CheckAllUpdates()
+					lastCheck = time.Now()
+				}
+				applyScheduledUpdates()
+				<-ticker.C
+			}
+		}()
+	})
+}
+
+// StartUpdateCheck queues a check of every project for image updates; the
+// results are read from GetUpdateStatuses once the job is done
+func StartUpdateCheck(user string) Job {
+	return StartJob("update-check", "", user, func(ctx context.Context, logf JobLogger) error {
+		statuses := CheckAllUpdates()
+		for _, status := range statuses {
+			if status.UpdateAvailable {
+				logf(status.Project + ": update available")
+			} else {
+				logf(status.Project + ": up to date")
+			}
+		}
+		logf(fmt.Sprintf("Checked %d projects", len(statuses)))
+		return nil
+	})
+}
+
+// CheckAllUpdates checks every panel project that is not pinned
+func CheckAllUpdates() []ProjectUpdateStatus {
+	entries, _ := os.ReadDir(ProjectsRoot)
+	statuses := []ProjectUpdateStatus{}
+	for _, e := range entries {
+		if !IsProjectDir(e) {
+			continue
+		}
+		p := getOrCreateProject(e.Name())
+		if p.UpdatePolicy == UpdatePolicyPinned {
+			continue
+		}
+		status, err := CheckProjectUpdates(e.Name())
+		if err != nil {
+			log.Printf("Update check failed for %s: %v", e.Name(), err)
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// CheckProjectUpdates compares each service's local image digests with the
+// digest its tag currently points to in the registry.
+func CheckProjectUpdates(project string) (ProjectUpdateStatus, error) {
+	p := getOrCreateProject(project)
+	status := ProjectUpdateStatus{
+		Project:           project,
+		Policy:            p.UpdatePolicy,
+		MaintenanceWindow: p.MaintenanceWindow,
+		Services:          []ServiceUpdate{},
+		CheckedAt:         time.Now().Format(time.RFC3339),
+	}
+
+	containers, err := inspectProjectContainers(project)
+	if err != nil {
+		return status, err
+	}
+
+	seen := map[string]bool{}
+	for _, ct := range containers {
+		service := ct.Config.Labels[composeServiceLabel]
+		if seen[service] {
+			continue
+		}
+		seen[service] = true
+
+		su := ServiceUpdate{Service: service, Image: ct.Config.Image, LocalDigests: []string{}}
+		if parseImageRef(ct.Config.Image).Digest != "" {
+			// Pinned by digest in the compose file: nothing to compare
+			status.Services = append(status.Services, su)
+			continue
+		}
+		if digests, err := runDocker("image", "inspect", "--format", "{{range .RepoDigests}}{{println .}}{{end}}", ct.Image); err == nil {
+			for _, d := range splitLines(digests) {
+				if idx := strings.Index(d, "@"); idx >= 0 {
+					su.LocalDigests = append(su.LocalDigests, d[idx+1:])
+				}
+			}
+		}
+
+		if len(su.LocalDigests) == 0 {
+			// Built locally (e.g. from a git source): there is no registry to compare with
+			status.Services = append(status.Services, su)
+			continue
+		}
+
+		remote, err := RemoteDigest(ct.Config.Image)
+		if err != nil {
+			su.Error = err.Error()
+		} else {
+			su.RemoteDigest = remote
+			su.UpdateAvailable = !containsString(su.LocalDigests, remote)
+		}
+		if su.UpdateAvailable {
+			status.UpdateAvailable = true
+		}
+		status.Services = append(status.Services, su)
+	}
+	sort.Slice(status.Services, func(i, j int) bool { return status.Services[i].Service < status.Services[j].Service })
+
+	now := time.Now()
+	if database.DB != nil {
+		database.DB.Model(&database.Project{}).Where("name = ?", project).
+			Updates(map[string]interface{}{"update_available": status.UpdateAvailable, "last_update_check": &now})
+	}
+
+	updatesMu.Lock()
+	updateStatuses[project] = status
+	var fresh []string
+	for _, su := range status.Services {
+		key := project + "/" + su.Service
+		if su.UpdateAvailable && notifiedUpdate[key] != su.RemoteDigest {
+			notifiedUpdate[key] = su.RemoteDigest
+			fresh = append(fresh, su.Image)
+		}
+	}
+	updatesMu.Unlock()
+
+	if len(fresh) > 0 && status.Policy != UpdatePolicyPinned {
+		go SendAlert(fmt.Sprintf("Update available for project *%s*: %s", project, strings.Join(fresh, ", ")))
+	}
+	return status, nil
+}
+
+// GetUpdateStatuses returns the cached result of the last checks
+func GetUpdateStatuses() []ProjectUpdateStatus {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+	out := make([]ProjectUpdateStatus, 0, len(updateStatuses))
+	for _, s := range updateStatuses {
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Project < out[j].Project })
+	return out
+}
+
+func SetUpdatePolicy(project, policy, window string) error {
+	switch policy {
+	case UpdatePolicyNotify, UpdatePolicyAuto, UpdatePolicyPinned:
+	default:
+		return fmt.Errorf("unknown update policy: %s", policy)
+	}
+	if window != "" {
+		if _, _, err := parseWindow(window); err != nil {
+			return err
+		}
+	}
+	if policy == UpdatePolicyAuto && window == "" {
+		return fmt.Errorf("auto updates need a maintenance window, e.g. 02:00-04:00")
+	}
+	if database.DB == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	if !projectExists(project) {
+		return fmt.Errorf("project %s not found", project)
+	}
+	getOrCreateProject(project)
+	return database.DB.Model(&database.Project{}).Where("name = ?", project).
+		Updates(map[string]interface{}{"update_policy": policy, "maintenance_window": window}).Error
+}
+
+// updateParams are what an update job needs to run again after a restart
+type updateParams struct {
+	Auto bool `json:"auto"` // applied in a maintenance window: alert the outcome
+}
+
+// UpdateProject queues pulling new images, recreating the services and
+// waiting for them to become healthy. On failure the previous images are
+// re-tagged and the services recreated from them.
+func UpdateProject(project, user string) (Job, error) {
+	if !composeNameRe.MatchString(project) || !projectExists(project) {
+		return Job{}, fmt.Errorf("project %s not found", project)
+	}
+	return enqueueJob("update", project, user, updateParams{}, updateTask(project, user, false)), nil
+}
+
+func updateTask(project, user string, auto bool) jobTask {
+	return func(ctx context.Context, logf JobLogger) error {
+		err := applyUpdate(ctx, project, user, logf)
+		if auto {
+			switch {
+			case err == nil:
+				SendAlert(fmt.Sprintf("Project *%s* was updated automatically.", project))
+			case errors.Is(err, errRolledBack):
+				SendAlert(fmt.Sprintf("Auto-update of *%s* was rolled back: %v", project, err))
+			default:
+				SendAlert(fmt.Sprintf("Auto-update of *%s* failed: %v", project, err))
+			}
+		}
+		return err
+	}
+}
+
+// errRolledBack marks an update that failed but left the previous images running
+var errRolledBack = errors.New("rolled back to the previous images")
+
+func applyUpdate(ctx context.Context, project, user string, logf JobLogger) error {
+	containers, err := inspectProjectContainers(project)
+	if err != nil {
+		return err
+	}
+	previous := map[string]string{} // image reference -> image ID in use
+	for _, ct := range containers {
+		previous[ct.Config.Image] = ct.Image
+	}
+
+	setJobProgress(ctx, 10, "Pulling images")
+	if err := streamCompose(ctx, project, pullProgress(ctx, logf, 10, 50), "pull"); err != nil {
+		return err
+	}
+	setJobProgress(ctx, 50, "Recreating services")
+	err = composeUp(ctx, project, logf)
+	if err == nil {
+		setJobProgress(ctx, 70, "Waiting for services to become healthy")
+		logf("Waiting for services to become healthy...")
+		err = waitProjectHealthy(ctx, project, updateHealthTimeout)
+	}
+	if err == nil {
+		CheckProjectUpdates(project)
+		recordDeploymentLogged(project, user, "update", "")
+		logf("Project updated")
+		return nil
+	}
+
+	// Roll back to the exact images that were running before, even when the
+	// job was canceled: the project must not stay half updated
+	logf(fmt.Sprintf("Update failed: %v", err))
+	setJobProgress(ctx, 90, "Rolling back")
+	for ref, id := range previous {
+		runDocker("image", "tag", id, ref)
+	}
+	if rbErr := streamCompose(context.Background(), project, logf, "up", "-d", "--force-recreate", "--pull", "never"); rbErr != nil {
+		return fmt.Errorf("update failed: %v; rollback failed: %v", err, rbErr)
+	}
+	return fmt.Errorf("update failed: %v; %w", err, errRolledBack)
+}
+
+// beginProjectOperation marks a project as being redeployed so updates,
+// deploys and rollbacks never run over each other
+func beginProjectOperation(project string) bool {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+	if updatingNow[project] {
+		return false
+	}
+	updatingNow[project] = true
+	return true
+}
+
+// isProjectBusy reports whether a deploy, update, rollback or other
+// operation is running on a project
+func isProjectBusy(project string) bool {
+	updatesMu.Lock()
+	defer updatesMu.Unlock()
+	return updatingNow[project]
+}
+
+// endProjectOperation releases a project and starts the jobs queued for it
+func endProjectOperation(project string) {
+	updatesMu.Lock()
+	delete(updatingNow, project)
+	updatesMu.Unlock()
+	scheduleJobs()
+}
+
+// waitProjectHealthy waits until every container of a project is running,
+// passes its healthcheck if it has one, and stays that way for a short while.
+// When ctx is a job's, the job shows which containers it is waiting for and
+// stops waiting when it is canceled.
+func waitProjectHealthy(ctx context.Context, project string, timeout time.Duration) error {
+	lastWaiting := ""
+	return waitHealthy(ctx, func() ([]containerInspect, error) {
+		return inspectProjectContainers(project)
+	}, "project", timeout, func(ready, total int, waiting string) {
+		setJobProgress(ctx, 0, fmt.Sprintf("Waiting for services to become healthy (%d/%d ready)", ready, total))
+		if waiting != lastWaiting {
+			if waiting != "" {
+				jobLog(ctx, "Waiting for "+waiting)
+			} else {
+				jobLog(ctx, fmt.Sprintf("All %d containers are up, checking they stay healthy for %s", total, healthStablePeriod))
+			}
+			lastWaiting = waiting
+		}
+	})
+}
+
+// waitContainersHealthy is waitProjectHealthy for a set of containers
+func waitContainersHealthy(ctx context.Context, ids []string, timeout time.Duration) error {
+	args := []string{"ps", "-a", "-q", "--no-trunc"}
+	for _, id := range ids {
+		args = append(args, "--filter", "id="+id)
+	}
+	return waitHealthy(ctx, func() ([]containerInspect, error) {
+		return inspectContainers(args...)
+	}, "containers", timeout, nil)
+}
+
+// waitHealthy polls list until its containers are healthy, and stops
+// waiting as soon as ctx is done. report, if set, gets how many are ready
+// and the ones still waited for at every poll.
+func waitHealthy(ctx context.Context, list func() ([]containerInspect, error), what string, timeout time.Duration,
+	report func(ready, total int, waiting string)) error {
+	deadline := time.Now().Add(timeout)
+	var healthySince time.Time
+	restarts := map[string]int{}
+
+	for time.Now().Before(deadline) {
+		containers, err := list()
+		if err != nil {
+			return err
+		}
+		if len(containers) == 0 {
+			return fmt.Errorf("%s has no containers", what)
+		}
+
+		ready := true
+		waiting := []string{}
+		for _, ct := range containers {
+			name := strings.TrimPrefix(ct.Name, "/")
+			if prev, ok := restarts[name]; ok && ct.RestartCount > prev {
+				return fmt.Errorf("container %s restarted while starting up", name)
+			}
+			restarts[name] = ct.RestartCount
+
+			switch {
+			case ct.State.Status == "exited" || ct.State.Status == "dead":
+				return fmt.Errorf("container %s exited", name)
+			case ct.State.Health != nil && ct.State.Health.Status == "unhealthy":
+				return fmt.Errorf("container %s is unhealthy", name)
+			case !ct.State.Running:
+				ready = false
+				waiting = append(waiting, fmt.Sprintf("%s (%s)", name, ct.State.Status))
+			case ct.State.Health != nil && ct.State.Health.Status != "healthy":
+				ready = false
+				waiting = append(waiting, fmt.Sprintf("%s (health: %s)", name, ct.State.Health.Status))
+			}
+		}
+		if report != nil {
+			report(len(containers)-len(waiting), len(containers), strings.Join(waiting, ", "))
+		}
+
+		if !ready {
+			healthySince = time.Time{}
+		} else if healthySince.IsZero() {
+			healthySince = time.Now()
+		} else if time.Since(healthySince) >= healthStablePeriod {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+	return fmt.Errorf("%s did not become healthy within %s", what, timeout)
+}
+
+func applyScheduledUpdates() {
+	if database.DB == nil {
+		return
+	}
+	var projects []database.Project
+	database.DB.Where("update_policy = ? AND update_available = ?", UpdatePolicyAuto, true).Find(&projects)
+	for _, p := range projects {
+		if !inMaintenanceWindow(p.MaintenanceWindow, time.Now()) || hasPendingJob(p.Name, "update") {
+			continue
+		}
+		job := enqueueJob("update", p.Name, "system", updateParams{Auto: true}, updateTask(p.Name, "system", true))
+		log.Printf("Auto-update of %s queued as job %s", p.Name, job.ID)
+	}
+}
+
+// parseWindow reads "HH:MM-HH:MM" into minutes since midnight
+func parseWindow(window string) (int, int, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", window)
+	}
+	var bounds [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid maintenance window %q, expected HH:MM-HH:MM", window)
+		}
+		bounds[i] = t.Hour()*60 + t.Minute()
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// inMaintenanceWindow reports whether now falls in the window; windows may
+// wrap past midnight ("23:00-02:00").
+func inMaintenanceWindow(window string, now time.Time) bool {
+	start, end, err := parseWindow(window)
+	if err != nil {
+		return false
+	}
+	m := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return m >= start && m < end
+	}
+	return m >= start || m < end
+}
+
+// getOrCreateProject returns the database record of a project directory,
+// creating it with default settings the first time.
+func getOrCreateProject(name string) database.Project {
+	p := database.Project{Name: name, UpdatePolicy: UpdatePolicyNotify}
+	if database.DB == nil {
+		return p
+	}
+	database.DB.Where(database.Project{Name: name}).Attrs(database.Project{UpdatePolicy: UpdatePolicyNotify}).FirstOrCreate(&p)
+	if p.UpdatePolicy == "" {
+		p.UpdatePolicy = UpdatePolicyNotify
+	}
+	return p
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,253 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+)
+
+// Uploaded projects are built from a source archive instead of a git
+// repository. The archive is unpacked into ProjectsRoot/<name>/source and
+// its content hash stands in for the commit.
+
+const (
+	maxUploadSize   = 256 << 20 // the archive itself
+	maxSourceSize   = 1 << 30   // what it unpacks to
+	maxSourceFiles  = 100000
+	uploadTempName  = "source.upload"
+	unpackedTmpName = "source.new"
+)
+
+// CreateUploadProject registers a project built from an uploaded .zip,
+// .tar.gz or .tar source archive and starts its first build and deploy
+func CreateUploadProject(name, filename string, archive io.Reader, domains []string, port int, user string) (Job, error) {
+	if err := validateSourceProject(name, domains, port); err != nil {
+		return Job{}, err
+	}
+	dir := filepath.Join(ProjectsRoot, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Job{}, fmt.Errorf("failed to create project directory: %v", err)
+	}
+	revision, err := unpackSource(dir, filename, archive)
+	if err != nil {
+		os.RemoveAll(dir)
+		return Job{}, err
+	}
+
+	p := getOrCreateProject(name)
+	database.DB.Model(&p).Updates(database.Project{
+		Status: "creating", SourceType: SourceUpload, GitCommit: revision, AppPort: port, Domains: domains,
+	})
+	return startFirstBuild(name, user)
+}
+
+// ReplaceUploadSource swaps an uploaded project's source for a new archive
+// and redeploys it
+func ReplaceUploadSource(project, filename string, archive io.Reader, user string) (Job, error) {
+	if !projectExists(project) {
+		return Job{}, fmt.Errorf("project %s not found", project)
+	}
+	if getOrCreateProject(project).SourceType != SourceUpload {
+		return Job{}, fmt.Errorf("project %s is not built from an uploaded archive", project)
+	}
+	if !beginProjectOperation(project) {
+		return Job{}, fmt.Errorf("another deployment is already running for this project")
+	}
+	revision, err := unpackSource(filepath.Join(ProjectsRoot, project), filename, archive)
+	if err != nil {
+		endProjectOperation(project)
+		return Job{}, err
+	}
+	database.DB.Model(&database.Project{}).Where("name = ?", project).Update("git_commit", revision)
+
+	return startHeldJob("build", project, user, func(ctx context.Context, logf JobLogger) error {
+		return deployFromUpload(ctx, project, user, logf)
+	}), nil
+}
+
+// deployFromUpload builds and deploys the source last uploaded
+func deployFromUpload(ctx context.Context, project, user string, logf JobLogger) error {
+	p := getOrCreateProject(project)
+	if _, err := os.Stat(filepath.Join(ProjectsRoot, project, sourceDir)); err != nil || p.GitCommit == "" {
+		return fmt.Errorf("project %s has no uploaded source", project)
+	}
+	logf("Building uploaded source " + p.GitCommit)
+	return buildAndDeploy(ctx, project, user, p, p.GitCommit, "upload", "upload "+p.GitCommit, logf)
+}
+
+// unpackSource replaces dir/source with the content of an archive and
+// returns a short hash of the archive. An archive holding a single top
+// directory, as the ones downloaded from GitHub, is unpacked without it.
+func unpackSource(dir, filename string, archive io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(dir, uploadTempName)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(archive, maxUploadSize+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to receive archive: %v", err)
+	}
+	if n > maxUploadSize {
+		return "", fmt.Errorf("archive is larger than %dMB", maxUploadSize>>20)
+	}
+
+	unpacked := filepath.Join(dir, unpackedTmpName)
+	os.RemoveAll(unpacked)
+	defer os.RemoveAll(unpacked)
+	if err := os.Mkdir(unpacked, 0755); err != nil {
+		return "", err
+	}
+
+	lower := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		err = extractZip(tmp, n, unpacked)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		tmp.Seek(0, io.SeekStart)
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(tmp); err == nil {
+			err = extractTar(gz, unpacked, maxSourceSize)
+		}
+	case strings.HasSuffix(lower, ".tar"):
+		tmp.Seek(0, io.SeekStart)
+		err = extractTar(tmp, unpacked, maxSourceSize)
+	default:
+		return "", fmt.Errorf("unsupported archive %q: use .zip, .tar.gz or .tar", filename)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to unpack archive: %v", err)
+	}
+
+	root := unpacked
+	if entries, _ := os.ReadDir(unpacked); len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(unpacked, entries[0].Name())
+	} else if len(entries) == 0 {
+		return "", fmt.Errorf("archive is empty")
+	}
+	src := filepath.Join(dir, sourceDir)
+	if err := os.RemoveAll(src); err != nil {
+		return "", err
+	}
+	if err := os.Rename(root, src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:12], nil
+}
+
+// sourceWriter writes archive entries under a directory, refusing paths
+// that leave it and stopping once the size or file count limit is reached.
+// Links and special files are skipped.
+type sourceWriter struct {
+	dest  string
+	limit int64
+	size  int64
+	files int
+}
+
+func (w *sourceWriter) path(name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("entry %q leaves the archive", name)
+	}
+	return filepath.Join(w.dest, rel), nil
+}
+
+func (w *sourceWriter) dir(name string) error {
+	path, err := w.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, 0755)
+}
+
+func (w *sourceWriter) file(name string, mode os.FileMode, r io.Reader) error {
+	path, err := w.path(name)
+	if err != nil {
+		return err
+	}
+	if w.files++; w.files > maxSourceFiles {
+		return fmt.Errorf("archive has more than %d files", maxSourceFiles)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	perm := os.FileMode(0644)
+	if mode&0111 != 0 {
+		perm = 0755
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(r, w.limit-w.size+1))
+	if w.size += n; w.size > w.limit {
+		return fmt.Errorf("archive unpacks to more than %dMB", w.limit>>20)
+	}
+	return err
+}
+
+func extractZip(r io.ReaderAt, size int64, dest string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	w := &sourceWriter{dest: dest, limit: maxSourceSize}
+	for _, f := range zr.File {
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			if err := w.dir(f.Name); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = w.file(f.Name, mode, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func extractTar(r io.Reader, dest string, limit int64) error {
+	tr := tar.NewReader(r)
+	w := &sourceWriter{dest: dest, limit: limit}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = w.dir(h.Name)
+		case tar.TypeReg:
+			err = w.file(h.Name, h.FileInfo().Mode(), tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
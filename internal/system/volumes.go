@@ -0,0 +1,266 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VolumeInfo describes a named volume and who mounts it
+type VolumeInfo struct {
+	Name       string            `json:"name"`
+	Driver     string            `json:"driver"`
+	Mountpoint string            `json:"mountpoint"`
+	CreatedAt  string            `json:"created_at"`
+	Labels     map[string]string `json:"labels"`
+	Size       int64             `json:"size"`
+	SizeHuman  string            `json:"size_human"`
+	Containers []string          `json:"containers"`
+	Project    string            `json:"project"`
+	InUse      bool              `json:"in_use"`
+}
+
+// VolumeFile is an entry inside a volume, listed through the helper container
+type VolumeFile struct {
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+	IsDir   bool   `json:"is_dir"`
+	Size    int64  `json:"size"`
+	ModTime string `json:"mod_time"`
+}
+
+// volumeHelperImage runs the short-lived containers used to read volume data
+const volumeHelperImage = "alpine:3.20"
+
+var volumeNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+type volumeInspect struct {
+	Name       string            `json:"Name"`
+	Driver     string            `json:"Driver"`
+	Mountpoint string            `json:"Mountpoint"`
+	CreatedAt  string            `json:"CreatedAt"`
+	Labels     map[string]string `json:"Labels"`
+}
+
+func ListVolumes() ([]VolumeInfo, error) {
+	names, err := runDocker("volume", "ls", "-q")
+	if err != nil {
+		return nil, err
+	}
+	nameList := splitLines(names)
+	if len(nameList) == 0 {
+		return []VolumeInfo{}, nil
+	}
+
+	output, err := runDocker(append([]string{"volume", "inspect"}, nameList...)...)
+	if err != nil {
+		return nil, err
+	}
+	var inspected []volumeInspect
+	if err := json.Unmarshal([]byte(output), &inspected); err != nil {
+		return nil, err
+	}
+
+	sizes := volumeSizes()
+
+	containers, err := inspectAllContainers()
+	if err != nil {
+		return nil, err
+	}
+	users := map[string][]string{}
+	for _, ct := range containers {
+		for _, m := range ct.Mounts {
+			if m.Type == "volume" {
+				users[m.Name] = append(users[m.Name], strings.TrimPrefix(ct.Name, "/"))
+			}
+		}
+	}
+
+	volumes := make([]VolumeInfo, 0, len(inspected))
+	for _, v := range inspected {
+		used := users[v.Name]
+		if used == nil {
+			used = []string{}
+		}
+		size, known := sizes[v.Name]
+		sizeHuman := "N/A"
+		if known {
+			sizeHuman = formatBytes(size)
+		}
+		volumes = append(volumes, VolumeInfo{
+			Name:       v.Name,
+			Driver:     v.Driver,
+			Mountpoint: v.Mountpoint,
+			CreatedAt:  v.CreatedAt,
+			Labels:     v.Labels,
+			Size:       size,
+			SizeHuman:  sizeHuman,
+			Containers: used,
+			Project:    v.Labels[composeProjectLabel],
+			InUse:      len(used) > 0,
+		})
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// volumeSizes reads per-volume disk usage from `docker system df -v`.
+// Sizing is best effort: a failure only leaves sizes unknown.
+func volumeSizes() map[string]int64 {
+	sizes := map[string]int64{}
+	output, err := runDocker("system", "df", "-v", "--format", "{{json .Volumes}}")
+	if err != nil {
+		return sizes
+	}
+	var vols []struct {
+		Name string `json:"Name"`
+		Size string `json:"Size"`
+	}
+	if json.Unmarshal([]byte(output), &vols) != nil {
+		return sizes
+	}
+	for _, v := range vols {
+		sizes[v.Name] = parseHumanSize(v.Size)
+	}
+	return sizes
+}
+
+func CreateVolume(name string, labels map[string]string) error {
+	if !volumeNameRe.MatchString(name) {
+		return fmt.Errorf("invalid volume name: %q", name)
+	}
+	args := []string{"volume", "create"}
+	for k, v := range labels {
+		args = append(args, "--label", k+"="+v)
+	}
+	_, err := runDocker(append(args, name)...)
+	return err
+}
+
+// RemoveVolume deletes a volume unless a container still mounts it
+func RemoveVolume(name string) error {
+	if !volumeNameRe.MatchString(name) {
+		return fmt.Errorf("invalid volume name: %q", name)
+	}
+	users, err := runDocker("ps", "-a", "-q", "--filter", "volume="+name)
+	if err != nil {
+		return err
+	}
+	if n := len(splitLines(users)); n > 0 {
+		return fmt.Errorf("volume %s is used by %d container(s)", name, n)
+	}
+	_, err = runDocker("volume", "rm", name)
+	return err
+}
+
+// PruneVolumes removes every volume no container references
+func PruneVolumes() (PruneReport, error) {
+	output, err := runDocker("volume", "prune", "-a", "-f")
+	if err != nil {
+		return PruneReport{}, err
+	}
+
+	// Volume prune lists bare names under a "Deleted Volumes:" header
+	report := PruneReport{Deleted: []string{}, Untagged: []string{}, ReclaimedSpace: "0B"}
+	for _, line := range splitLines(output) {
+		switch {
+		case line == "Deleted Volumes:":
+		case strings.HasPrefix(line, "Total reclaimed space:"):
+			report.ReclaimedSpace = strings.TrimSpace(strings.TrimPrefix(line, "Total reclaimed space:"))
+			report.ReclaimedBytes = parseHumanSize(report.ReclaimedSpace)
+		default:
+			report.Deleted = append(report.Deleted, line)
+		}
+	}
+	return report, nil
+}
+
+// volumePath maps a user path onto the helper container's /data mount.
+// Cleaning it as an absolute path first keeps ".." from escaping the volume.
+func volumePath(p string) string {
+	return path.Join("/data", path.Clean("/"+p))
+}
+
+func volumeHelper(name string, cmd ...string) *exec.Cmd {
+	args := []string{"run", "--rm", "--network", "none", "-v", name + ":/data:ro", volumeHelperImage}
+	return exec.Command("docker", append(args, cmd...)...)
+}
+
+// ListVolumeFiles lists a directory inside a volume
+func ListVolumeFiles(name, dir string) ([]VolumeFile, error) {
+	if !volumeNameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid volume name: %q", name)
+	}
+	target := volumePath(dir)
+
+	cmd := volumeHelper(name, "find", target, "-mindepth", "1", "-maxdepth", "1",
+		"-exec", "stat", "-c", "%n|%s|%Y|%F", "{}", "+")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume: %v, output: %s", err, string(output))
+	}
+
+	items := []VolumeFile{}
+	for _, line := range splitLines(string(output)) {
+		parts := strings.Split(line, "|")
+		if len(parts) != 4 {
+			continue
+		}
+		size, _ := strconv.ParseInt(parts[1], 10, 64)
+		mtime, _ := strconv.ParseInt(parts[2], 10, 64)
+		items = append(items, VolumeFile{
+			Name:    path.Base(parts[0]),
+			Path:    strings.TrimPrefix(parts[0], "/data"),
+			IsDir:   parts[3] == "directory",
+			Size:    size,
+			ModTime: time.Unix(mtime, 0).Format("2006-01-02 15:04:05"),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].IsDir != items[j].IsDir {
+			return items[i].IsDir
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+// DownloadVolumePath streams a file, or a tar of a directory, out of a volume.
+// start receives the suggested download file name before any data is written.
+func DownloadVolumePath(name, p string, w io.Writer, start func(fileName string)) error {
+	if !volumeNameRe.MatchString(name) {
+		return fmt.Errorf("invalid volume name: %q", name)
+	}
+	target := volumePath(p)
+
+	kind, err := volumeHelper(name, "stat", "-c", "%F", target).Output()
+	if err != nil {
+		return fmt.Errorf("path not found: %s", p)
+	}
+
+	var cmd *exec.Cmd
+	fileName := path.Base(target)
+	if fileName == "data" && target == "/data" {
+		fileName = name
+	}
+	if strings.TrimSpace(string(kind)) == "directory" {
+		cmd = volumeHelper(name, "tar", "-C", path.Dir(target), "-cf", "-", path.Base(target))
+		fileName += ".tar"
+	} else {
+		cmd = volumeHelper(name, "cat", target)
+	}
+
+	if start != nil {
+		start(fileName)
+	}
+	cmd.Stdout = w
+	return cmd.Run()
+}
@@ -0,0 +1,298 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+)
+
+// Webhook delivery outcomes
+const (
+	DeliveryAccepted  = "accepted"
+	DeliveryQueued    = "queued"
+	DeliveryIgnored   = "ignored"
+	DeliveryDuplicate = "duplicate"
+	DeliveryRejected  = "rejected"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookInfo is a project's webhook as shown in the panel. Secret is only
+// filled right after it is generated.
+type WebhookInfo struct {
+	database.Webhook
+	Path   string `json:"path"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookResult is what the endpoint answers to the git provider
+type WebhookResult struct {
+	Code    int    `json:"-"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	JobID   string `json:"job_id,omitempty"`
+}
+
+var deliveryMu sync.Mutex
+
+// pushPayload covers the push event fields of GitHub, GitLab and Gitea
+type pushPayload struct {
+	Ref         string `json:"ref"`
+	After       string `json:"after"`
+	CheckoutSHA string `json:"checkout_sha"` // GitLab
+	UserName    string `json:"user_name"`    // GitLab
+	HeadCommit  *struct {
+		Message string `json:"message"`
+	} `json:"head_commit"`
+	Commits []struct {
+		Message string `json:"message"`
+	} `json:"commits"`
+	Pusher struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+}
+
+func webhookPath(token string) string {
+	return "/api/webhooks/" + token
+}
+
+func GetWebhook(project string) (WebhookInfo, error) {
+	var hook database.Webhook
+	if database.DB == nil {
+		return WebhookInfo{}, fmt.Errorf("database not initialized")
+	}
+	if err := database.DB.Where("project = ?", project).First(&hook).Error; err != nil {
+		return WebhookInfo{}, fmt.Errorf("project %s has no webhook", project)
+	}
+	return WebhookInfo{Webhook: hook, Path: webhookPath(hook.Token)}, nil
+}
+
+// SaveWebhook creates or updates a project's webhook. A new secret is
+// generated on creation and when rotate is set; it is returned only then.
+func SaveWebhook(project, branch string, enabled, rotate bool) (WebhookInfo, error) {
+	if database.DB == nil {
+		return WebhookInfo{}, fmt.Errorf("database not initialized")
+	}
+	if !projectExists(project) {
+		return WebhookInfo{}, fmt.Errorf("project %s not found", project)
+	}
+	if branch != "" && (!gitBranchRe.MatchString(branch) || strings.Contains(branch, "..")) {
+		return WebhookInfo{}, fmt.Errorf("invalid branch %q", branch)
+	}
+
+	var hook database.Webhook
+	isNew := database.DB.Where("project = ?", project).First(&hook).Error != nil
+	hook.Project, hook.Branch, hook.Enabled = project, branch, enabled
+
+	secret := ""
+	if isNew || rotate {
+		secret = randomHex(24)
+		enc, err := security.EncryptString(secret)
+		if err != nil {
+			return WebhookInfo{}, err
+		}
+		hook.SecretEncrypted = enc
+	}
+	if isNew {
+		hook.Token = randomHex(16)
+	}
+	if err := database.DB.Save(&hook).Error; err != nil {
+		return WebhookInfo{}, err
+	}
+	return WebhookInfo{Webhook: hook, Path: webhookPath(hook.Token), Secret: secret}, nil
+}
+
+func DeleteWebhook(project string) error {
+	if database.DB == nil {
+		return fmt.Errorf("database not initialized")
+	}
+	res := database.DB.Where("project = ?", project).Delete(&database.Webhook{})
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("project %s has no webhook", project)
+	}
+	return res.Error
+}
+
+func ListWebhookDeliveries(project string, limit int) ([]database.WebhookDelivery, error) {
+	deliveries := []database.WebhookDelivery{}
+	if database.DB == nil {
+		return deliveries, fmt.Errorf("database not initialized")
+	}
+	err := database.DB.Where("project = ?", project).Order("id desc").Limit(limit).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// HandleWebhook verifies a delivery from GitHub, GitLab or Gitea, filters
+// it by branch, drops duplicates and redeploys the project on a push.
+// Every delivery that matches a webhook is logged.
+func HandleWebhook(token string, header http.Header, body []byte) WebhookResult {
+	if database.DB == nil {
+		return WebhookResult{Code: http.StatusServiceUnavailable, Status: DeliveryFailed, Message: "database not initialized"}
+	}
+	var hook database.Webhook
+	if token == "" || database.DB.Where("token = ?", token).First(&hook).Error != nil {
+		return WebhookResult{Code: http.StatusNotFound, Status: DeliveryRejected, Message: "unknown webhook"}
+	}
+
+	d := database.WebhookDelivery{Project: hook.Project}
+	finish := func(code int, status, message string) WebhookResult {
+		d.Status, d.Detail = status, message
+		if err := database.DB.Create(&d).Error; err != nil {
+			log.Printf("Failed to log webhook delivery for %s: %v", hook.Project, err)
+		}
+		return WebhookResult{Code: code, Status: status, Message: message, JobID: d.JobID}
+	}
+
+	secret, err := security.DecryptString(hook.SecretEncrypted)
+	if err != nil {
+		return finish(http.StatusInternalServerError, DeliveryFailed, "cannot read webhook secret")
+	}
+
+	// Gitea also sends GitHub-style headers, so it is recognised first
+	var valid bool
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		d.Provider, d.Event, d.DeliveryID = "gitea", header.Get("X-Gitea-Event"), header.Get("X-Gitea-Delivery")
+		valid = validHMAC(secret, body, header.Get("X-Gitea-Signature"))
+	case header.Get("X-Gitlab-Event") != "":
+		d.Provider, d.Event = "gitlab", header.Get("X-Gitlab-Event")
+		d.DeliveryID = header.Get("X-Gitlab-Event-UUID")
+		if d.DeliveryID == "" {
+			d.DeliveryID = header.Get("X-Gitlab-Webhook-UUID")
+		}
+		valid = subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	case header.Get("X-GitHub-Event") != "":
+		d.Provider, d.Event, d.DeliveryID = "github", header.Get("X-GitHub-Event"), header.Get("X-GitHub-Delivery")
+		valid = validHMAC(secret, body, strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256="))
+	default:
+		return finish(http.StatusBadRequest, DeliveryRejected, "unrecognised webhook provider")
+	}
+	if !valid {
+		return finish(http.StatusUnauthorized, DeliveryRejected, "invalid signature")
+	}
+	if !hook.Enabled {
+		return finish(http.StatusOK, DeliveryIgnored, "webhook is disabled")
+	}
+
+	switch d.Event {
+	case "ping":
+		return finish(http.StatusOK, DeliveryIgnored, "pong")
+	case "push", "Push Hook":
+	default:
+		return finish(http.StatusOK, DeliveryIgnored, "event "+d.Event+" does not trigger a deploy")
+	}
+
+	var push pushPayload
+	if err := json.Unmarshal(body, &push); err != nil {
+		return finish(http.StatusBadRequest, DeliveryRejected, "invalid JSON payload")
+	}
+	d.Branch = strings.TrimPrefix(push.Ref, "refs/heads/")
+	d.Commit = push.After
+	if push.CheckoutSHA != "" {
+		d.Commit = push.CheckoutSHA
+	}
+	d.Pusher = firstNonEmpty(push.Pusher.Login, push.Pusher.Username, push.Pusher.Name, push.UserName)
+	if push.HeadCommit != nil {
+		d.Message = push.HeadCommit.Message
+	} else if len(push.Commits) > 0 {
+		d.Message = push.Commits[len(push.Commits)-1].Message
+	}
+	if len(d.Message) > 200 {
+		d.Message = d.Message[:200] + "..."
+	}
+	if d.DeliveryID == "" {
+		d.DeliveryID = "commit:" + d.Commit
+	}
+
+	branch := hook.Branch
+	if branch == "" {
+		branch = getOrCreateProject(hook.Project).GitBranch
+	}
+	switch {
+	case !strings.HasPrefix(push.Ref, "refs/heads/"):
+		return finish(http.StatusOK, DeliveryIgnored, "not a branch push")
+	case strings.Trim(d.Commit, "0") == "":
+		return finish(http.StatusOK, DeliveryIgnored, "branch deleted")
+	case branch != "" && d.Branch != branch:
+		return finish(http.StatusOK, DeliveryIgnored, "push to "+d.Branch+", deploying only "+branch)
+	}
+
+	// Providers retry on timeouts: the same delivery must deploy only once
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+	var seen int64
+	database.DB.Model(&database.WebhookDelivery{}).
+		Where("project = ? AND delivery_id = ? AND status IN ?", hook.Project, d.DeliveryID, []string{DeliveryAccepted, DeliveryQueued}).
+		Count(&seen)
+	if seen > 0 {
+		return finish(http.StatusOK, DeliveryDuplicate, "delivery already processed")
+	}
+
+	user := "webhook:" + d.Provider
+	if d.Pusher != "" {
+		user += ":" + d.Pusher
+	}
+	job, queued, err := QueueDeploy(hook.Project, user)
+	if err != nil {
+		return finish(http.StatusInternalServerError, DeliveryFailed, err.Error())
+	}
+	d.JobID = job.ID
+	if queued {
+		return finish(http.StatusAccepted, DeliveryQueued, "another operation is running, redeploy queued after it")
+	}
+	return finish(http.StatusAccepted, DeliveryAccepted, "redeploy started")
+}
+
+// QueueDeploy queues a deploy of the project. A deploy still waiting in the
+// queue already covers the request since it deploys the latest state, so
+// several pushes in a row collapse into one.
+func QueueDeploy(project, user string) (Job, bool, error) {
+	for _, job := range ListJobs(JobFilter{Project: project, Status: JobQueued}) {
+		if job.Type == "deploy" || job.Type == "build" {
+			return job, true, nil
+		}
+	}
+	job, err := DeployProject(project, user)
+	if err != nil {
+		return Job{}, false, err
+	}
+	return job, job.Status == JobQueued, nil
+}
+
+func validHMAC(secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+// Copyright by AcmaTvirus
+package system
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/acmavirus/foxdocker-panel/internal/database"
+	"github.com/acmavirus/foxdocker-panel/internal/security"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testHookToken  = "0123456789abcdef"
+	testHookSecret = "s3cret"
+)
+
+// setupWebhookDB gives the test its own database with one enabled webhook
+// that deploys branch main of project web
+func setupWebhookDB(t *testing.T) {
+	t.Setenv("FOXDOCKER_SECRET_KEY", "webhook tests")
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&database.Project{}, &database.Webhook{}, &database.WebhookDelivery{}); err != nil {
+		t.Fatal(err)
+	}
+	previous := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = previous })
+
+	enc, err := security.EncryptString(testHookSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := database.Webhook{Project: "web", Token: testHookToken, SecretEncrypted: enc, Branch: "main", Enabled: true}
+	if err := db.Create(&hook).Error; err != nil {
+		t.Fatal(err)
+	}
+	// A delivery that already deployed, for the duplicate case
+	if err := db.Create(&database.WebhookDelivery{Project: "web", DeliveryID: "seen-1", Status: DeliveryAccepted}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandleWebhook(t *testing.T) {
+	setupWebhookDB(t)
+
+	const (
+		ping      = `{"zen":"hello"}`
+		pushMain  = `{"ref":"refs/heads/main","after":"1111111111111111111111111111111111111111","pusher":{"name":"dev"}}`
+		pushOther = `{"ref":"refs/heads/feature","after":"2222222222222222222222222222222222222222"}`
+		pushTag   = `{"ref":"refs/tags/v1.0.0","after":"3333333333333333333333333333333333333333"}`
+	)
+	tests := []struct {
+		name       string
+		token      string
+		header     map[string]string
+		body       string
+		wantCode   int
+		wantStatus string
+	}{
+		{
+			name:   "github valid signature",
+			header: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign(testHookSecret, ping)},
+			body:   ping, wantCode: http.StatusOK, wantStatus: DeliveryIgnored,
+		},
+		{
+			name:   "github tampered body",
+			header: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(testHookSecret, pushOther)},
+			body:   pushMain, wantCode: http.StatusUnauthorized, wantStatus: DeliveryRejected,
+		},
+		{
+			name:   "github wrong secret",
+			header: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign("guess", ping)},
+			body:   ping, wantCode: http.StatusUnauthorized, wantStatus: DeliveryRejected,
+		},
+		{
+			name:   "github signature not hex",
+			header: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=zz"},
+			body:   ping, wantCode: http.StatusUnauthorized, wantStatus: DeliveryRejected,
+		},
+		{
+			name:   "github missing signature",
+			header: map[string]string{"X-GitHub-Event": "ping"},
+			body:   ping, wantCode: http.StatusUnauthorized, wantStatus: DeliveryRejected,
+		},
+		{
+			// Gitea also sends the GitHub headers; its own signature is the one checked
+			name: "gitea valid signature",
+			header: map[string]string{"X-Gitea-Event": "ping", "X-Gitea-Signature": sign(testHookSecret, ping),
+				"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=00"},
+			body: ping, wantCode: http.StatusOK, wantStatus: DeliveryIgnored,
+		},
+		{
+			name:   "gitea tampered body",
+			header: map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": sign(testHookSecret, ping)},
+			body:   pushMain, wantCode: http.StatusUnauthorized, wantStatus: DeliveryRejected,
+		},
+		{
+			name:   "gitlab valid token",
+			header: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": testHookSecret},
+			body:   pushOther, wantCode: http.StatusOK, wantStatus: DeliveryIgnored,
+		},
+		{
+			name:   "gitlab wrong token",
+			header: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "guess"},
+			body:   pushMain, wantCode: http.StatusUnauthorized, wantStatus: DeliveryRejected,
+		},
+		{
+			name:   "push to another branch",
+			header: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(testHookSecret, pushOther)},
+			body:   pushOther, wantCode: http.StatusOK, wantStatus: DeliveryIgnored,
+		},
+		{
+			name:   "tag push",
+			header: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(testHookSecret, pushTag)},
+			body:   pushTag, wantCode: http.StatusOK, wantStatus: DeliveryIgnored,
+		},
+		{
+			name: "duplicate delivery",
+			header: map[string]string{"X-GitHub-Event": "push", "X-GitHub-Delivery": "seen-1",
+				"X-Hub-Signature-256": "sha256=" + sign(testHookSecret, pushMain)},
+			body: pushMain, wantCode: http.StatusOK, wantStatus: DeliveryDuplicate,
+		},
+		{
+			name:   "unknown provider",
+			header: map[string]string{"X-Hub-Signature-256": "sha256=" + sign(testHookSecret, ping)},
+			body:   ping, wantCode: http.StatusBadRequest, wantStatus: DeliveryRejected,
+		},
+		{
+			name:   "unknown token",
+			token:  "nope",
+			header: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign(testHookSecret, ping)},
+			body:   ping, wantCode: http.StatusNotFound, wantStatus: DeliveryRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if token == "" {
+				token = testHookToken
+			}
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			res := HandleWebhook(token, header, []byte(tt.body))
+			if res.Code != tt.wantCode || res.Status != tt.wantStatus {
+				t.Errorf("got %d %s (%s), want %d %s", res.Code, res.Status, res.Message, tt.wantCode, tt.wantStatus)
+			}
+			if token != testHookToken {
+				return
+			}
+			var last database.WebhookDelivery
+			database.DB.Order("id desc").First(&last)
+			if last.Status != res.Status {
+				t.Errorf("logged delivery has status %q, want %q", last.Status, res.Status)
+			}
+		})
+	}
+}
@@ -83,7 +83,8 @@ fi
 
 # 4. Tạo thư mục hệ thống
 echo "Khởi tạo thư mục hệ thống tại /opt/foxdocker..."
-mkdir -p /opt/foxdocker/data /opt/foxdocker/projects /opt/foxdocker/letsencrypt /opt/foxdocker/scripts
+mkdir -p /opt/foxdocker/data /opt/foxdocker/apps /opt/foxdocker/backups /opt/foxdocker/letsencrypt /opt/foxdocker/scripts
+mkdir -p -m 700 /opt/foxdocker/secrets
 
 # 4.1 Tải script cập nhật
 echo "Đang tải script cập nhật..."
@@ -110,6 +111,7 @@ services:
       - "/opt/foxdocker/letsencrypt:/letsencrypt"
     networks:
       - fox-net
+      - foxdocker-network
 
   fox-admin:
     image: ghcr.io/acmavirus/foxdocker-panel:latest
@@ -120,7 +122,11 @@ services:
     volumes:
       - "/var/run/docker.sock:/var/run/docker.sock"
       - "/opt/foxdocker/data:/app/data"
-      - "/opt/foxdocker/projects:/projects"
+      # Same paths as on the host: compose resolves the projects' bind
+      # mounts on the host
+      - "/opt/foxdocker/apps:/opt/foxdocker/apps"
+      - "/opt/foxdocker/backups:/opt/foxdocker/backups"
+      - "/opt/foxdocker/secrets:/opt/foxdocker/secrets"
       - "/var/log:/var/log:ro"
     environment:
       - JWT_SECRET=$(openssl rand -hex 32)
@@ -128,16 +134,23 @@ services:
       - "traefik.enable=true"
       - "traefik.http.routers.fox-admin.rule=Host(\`panel.yourdomain.com\`)"
       - "traefik.http.routers.fox-admin.entrypoints=web"
+      - "traefik.docker.network=foxdocker-network"
     networks:
       - fox-net
+      - foxdocker-network
 
 networks:
   fox-net:
     driver: bridge
+  # Shared with the projects the panel routes through Traefik
+  foxdocker-network:
+    name: foxdocker-network
+    external: true
 EOF
 
 # 6. Khởi chạy Panel
 echo "Đang tải và khởi chạy FoxDocker Panel từ GitHub Packages..."
+docker network inspect foxdocker-network &> /dev/null || docker network create foxdocker-network
 cd /opt/foxdocker && $COMPOSE_CMD pull && $COMPOSE_CMD up -d
 
 echo -e "${GREEN}========== CÀI ĐẶT HOÀN TẤT ==========${NC}"
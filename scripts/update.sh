@@ -22,6 +22,8 @@ if [ -z "$COMPOSE_CMD" ]; then
 fi
 
 cd /opt/foxdocker
+# Mạng dùng chung giữa Traefik và các project
+docker network inspect foxdocker-network &> /dev/null || docker network create foxdocker-network
 $COMPOSE_CMD pull
 $COMPOSE_CMD up -d
 